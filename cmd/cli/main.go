@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -205,6 +206,21 @@ var startRunCmd = &cobra.Command{
 		payload := map[string]interface{}{
 			"workflow_id": workflowID,
 		}
+
+		// Inputs are sent as strings; the server coerces them to their declared types
+		inputFlags, _ := cmd.Flags().GetStringArray("input")
+		if len(inputFlags) > 0 {
+			inputs := make(map[string]interface{})
+			for _, flag := range inputFlags {
+				parts := strings.SplitN(flag, "=", 2)
+				if len(parts) != 2 {
+					fmt.Printf("Error: invalid input %q, expected name=value\n", flag)
+					return
+				}
+				inputs[parts[0]] = parts[1]
+			}
+			payload["inputs"] = inputs
+		}
 		
 		result, err := apiCall("POST", fmt.Sprintf("/api/workflows/%s/runs", workflowID), payload)
 		if err != nil {
@@ -259,6 +275,7 @@ var listRunsCmd = &cobra.Command{
 }
 
 func init() {
+	startRunCmd.Flags().StringArrayP("input", "i", nil, "Workflow input as name=value (repeatable)")
 	runCmd.AddCommand(startRunCmd)
 	runCmd.AddCommand(listRunsCmd)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// containerStopTimeout bounds how long removing a job's containers, or
+// signalling a step in one, may take
+const containerStopTimeout = 30 * time.Second
+
+// containerStepWrapper runs a step's script file ($1) in the job container and
+// records the ID of its process group in a file ($0), so that a cancelled
+// step can be stopped inside the container. The wrapper becomes the leader of
+// a new process group with setsid where it is not one already.
+const containerStepWrapper = `if [ "$(cut -d' ' -f5 /proc/$$/stat 2>/dev/null)" != "$$" ] && command -v setsid >/dev/null 2>&1; then
+	exec setsid sh -c 'echo $$ > "$0"; exec sh "$1"' "$0" "$1"
+fi
+echo $$ > "$0"
+exec sh "$1"`
+
+// containerSignal signals the process group recorded by containerStepWrapper,
+// or just the process where it has no group of its own
+const containerSignal = `kill -$0 -$1 2>/dev/null || kill -$0 $1`
+
+// containerCLI runs docker or a compatible CLI such as podman. Variables are
+// handed to it in its own environment and only named on its command line, so
+// their values do not show up in the process list.
+type containerCLI struct {
+	path string
+	env  []string
+}
+
+func newContainerCLI(path string) *containerCLI {
+	return &containerCLI{path: path, env: baseEnvironment(false, nil)}
+}
+
+// command returns a CLI command whose environment also holds vars
+func (c *containerCLI) command(ctx context.Context, vars map[string]string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Env = append([]string(nil), c.env...)
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	return cmd
+}
+
+// run runs a CLI command and returns its output. The output is also part of
+// the error if the command fails.
+func (c *containerCLI) run(ctx context.Context, vars map[string]string, args ...string) (string, error) {
+	out, err := c.command(ctx, vars, args...).CombinedOutput()
+	out = bytes.TrimSpace(out)
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", c.path, args[0], err, out)
+	}
+	return string(out), nil
+}
+
+// remove removes an object such as a container once the job is done, even
+// if the job itself was cancelled
+func (c *containerCLI) remove(args ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), containerStopTimeout)
+	defer cancel()
+
+	if _, err := c.run(ctx, nil, args...); err != nil {
+		log.Printf("Failed to clean up: %v", err)
+	}
+}
+
+// containerExecutor runs the steps of a job in a container started from the
+// job's image. The job's directories are mounted at the same paths, so the
+// workspace and step files are where the steps expect them.
+type containerExecutor struct {
+	cli     *containerCLI
+	name    string
+	image   string
+	env     map[string]string // env of the container itself
+	network string            // where the job's services are, if it has any
+	mounts  map[string]string // paths in the container by host path
+	pidDir  string            // where the process group IDs of steps are recorded
+	baseEnv []string          // environment of the image
+	steps   int
+}
+
+// Start starts the container, pulling its image if needed. The container
+// idles until it is removed; steps are run in it one by one.
+func (e *containerExecutor) Start(ctx context.Context) error {
+	args := []string{"run", "--detach", "--name", e.name, "--entrypoint", "tail"}
+	if e.network != "" {
+		args = append(args, "--network", e.network)
+	}
+	for source, target := range e.mounts {
+		args = append(args, "--volume", source+":"+target)
+	}
+	args = append(args, envArgs(e.env)...)
+	args = append(args, e.image, "-f", "/dev/null")
+
+	if _, err := e.cli.run(ctx, e.env, args...); err != nil {
+		return fmt.Errorf("failed to start container from %s: %v", e.image, err)
+	}
+
+	out, err := e.cli.run(ctx, nil, "inspect", "--format", "{{json .Config.Env}}", e.name)
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &e.baseEnv)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %v", e.name, err)
+	}
+	return nil
+}
+
+func (e *containerExecutor) BaseEnv() []string {
+	return e.baseEnv
+}
+
+func (e *containerExecutor) Command(ctx context.Context, script, dir string, env []string, grace time.Duration) (*exec.Cmd, func()) {
+	// Later entries win, as they do for a process on the host
+	vars := make(map[string]string, len(env))
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		vars[name] = value
+	}
+
+	// The directory is mounted, so the file is read on the host
+	e.steps++
+	pidFile := filepath.Join(e.pidDir, fmt.Sprintf("step-%d.pid", e.steps))
+
+	args := []string{"exec", "--workdir", dir}
+	args = append(args, envArgs(vars)...)
+	args = append(args, e.name, "sh", "-c", containerStepWrapper, pidFile, script)
+	cmd := e.cli.command(ctx, vars, args...)
+
+	// Stopping the CLI would leave the step running in the container, so the
+	// step is signalled in there and the CLI exits along with it. A step that
+	// has not recorded its process group yet is kept from starting by stopping
+	// the CLI; should it start anyway, SIGKILL still finds it.
+	release := cancelWithGrace(cmd, grace, func(sig syscall.Signal) error {
+		started, err := e.signalStep(pidFile, sig)
+		if !started {
+			return cmd.Process.Kill()
+		}
+		return err
+	})
+	return cmd, func() {
+		release()
+		os.Remove(pidFile)
+	}
+}
+
+// signalStep sends a signal to a step's processes in the container. It
+// reports whether the step had started.
+func (e *containerExecutor) signalStep(pidFile string, sig syscall.Signal) (bool, error) {
+	data, err := os.ReadFile(pidFile)
+	pgid := strings.TrimSpace(string(data))
+	if err != nil || pgid == "" {
+		return false, nil
+	}
+
+	name := "TERM"
+	if sig == syscall.SIGKILL {
+		name = "KILL"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), containerStopTimeout)
+	defer cancel()
+	_, err = e.cli.run(ctx, nil, "exec", e.name, "sh", "-c", containerSignal, name, pgid)
+	return true, err
+}
+
+// Stop removes the container along with anything still running in it
+func (e *containerExecutor) Stop() {
+	e.cli.remove("rm", "--force", e.name)
+}
+
+// envArgs names vars on the CLI's command line, taking their values from its
+// environment
+func envArgs(vars map[string]string) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, "--env", name)
+	}
+	return args
+}
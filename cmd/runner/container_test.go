@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// stubCLI stands in for docker. Every invocation is recorded in its own file
+// as NUL-terminated arguments, next to the values of GREETING and MODE in its
+// environment. exec runs the command on the host, in the directory asked for.
+// Containers are in the state STUB_STATE, running by default, their image
+// health check reports STUB_HEALTH and their logs are STUB_LOGS. A container
+// port is published on the host port 1 followed by its number.
+const stubCLI = `#!/bin/sh
+n=$(ls "$STUB_DIR" | grep -c 'args$')
+printf '%s\0' "$@" > "$STUB_DIR/$n.args"
+printf '%s\n%s\n' "$GREETING" "$MODE" > "$STUB_DIR/$n.env"
+case "$1" in
+run) echo 0123456789ab ;;
+inspect)
+	case "$3" in
+	*State*) echo "${STUB_STATE:-running} $STUB_HEALTH" ;;
+	*) echo '["PATH=/usr/bin:/bin"]' ;;
+	esac ;;
+logs) echo "$STUB_LOGS" ;;
+port) printf '0.0.0.0:1%s\n[::]:1%s\n' "${3%/*}" "${3%/*}" ;;
+exec)
+	shift
+	while [ $# -gt 0 ]; do
+		case "$1" in
+		--workdir) cd "$2" || exit 126; shift 2 ;;
+		--env) shift 2 ;;
+		*) break ;;
+		esac
+	done
+	shift
+	exec "$@" ;;
+esac
+`
+
+// invocation is one recorded call of the stub CLI
+type invocation struct {
+	args []string
+	env  []string // GREETING and MODE
+}
+
+func readInvocations(t *testing.T, dir string) []invocation {
+	t.Helper()
+	var calls []invocation
+	for n := 0; ; n++ {
+		args, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(n)+".args"))
+		if os.IsNotExist(err) {
+			return calls
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(n)+".env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, invocation{
+			args: strings.Split(strings.TrimSuffix(string(args), "\x00"), "\x00"),
+			env:  strings.Split(strings.TrimSuffix(string(env), "\n"), "\n"),
+		})
+	}
+}
+
+// newStubRunner returns a runner whose container CLI is stubCLI, recording
+// into the returned directory, and a function returning the result reported
+// for job 7
+func newStubRunner(t *testing.T) (*Runner, string, func() types.JobResult) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub CLI is a shell script")
+	}
+
+	stubDir := t.TempDir()
+	cli := filepath.Join(t.TempDir(), "docker")
+	if err := os.WriteFile(cli, []byte(stubCLI), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STUB_DIR", stubDir)
+
+	var (
+		mu        sync.Mutex
+		jobResult types.JobResult
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/jobs/7/result") {
+			var result types.JobResult
+			json.NewDecoder(req.Body).Decode(&result)
+			mu.Lock()
+			jobResult = result
+			mu.Unlock()
+		}
+		w.Write([]byte("{}"))
+	}))
+
+	workDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Runner{
+		ID:           "runner-1",
+		ApiURL:       server.URL,
+		WorkDir:      workDir,
+		HostWorkDir:  "/host/work",
+		ContainerCLI: cli,
+		client:       server.Client(),
+		activeJobs:   make(map[uint]context.CancelFunc),
+	}
+	t.Cleanup(server.Close)
+
+	return r, stubDir, func() types.JobResult {
+		mu.Lock()
+		defer mu.Unlock()
+		return jobResult
+	}
+}
+
+func TestContainerJob(t *testing.T) {
+	r, stubDir, jobResult := newStubRunner(t)
+	workDir := r.WorkDir
+
+	r.executeJob(context.Background(), types.JobAssignment{
+		JobID: 7,
+		RunID: 1,
+		JobSpec: types.JobSpec{
+			Container: &types.ContainerSpec{
+				Image: "alpine:3",
+				Env:   map[string]string{"MODE": "container-mode"},
+			},
+			Env: map[string]string{"GREETING": "hello-from-env"},
+			Steps: []types.StepSpec{
+				{Name: "fail", Run: "exit 3"},
+			},
+		},
+		StepIDs: []uint{70},
+	})
+
+	if status := jobResult().Status; status != "failed" {
+		t.Errorf("job status = %q, want failed", status)
+	}
+
+	calls := readInvocations(t, stubDir)
+	if len(calls) != 4 {
+		t.Fatalf("got %d CLI invocations, want run, inspect, exec and rm: %q", len(calls), calls)
+	}
+
+	name := calls[0].args[3]
+	if !strings.HasPrefix(name, "relayforge-job-7-") {
+		t.Fatalf("container name = %q", name)
+	}
+	base := strings.TrimPrefix(name, "relayforge-")
+	root := filepath.Join(workDir, base)
+
+	wantRun := []string{
+		"run", "--detach", "--name", name, "--entrypoint", "tail",
+		"--volume", "/host/work/" + base + ":" + root,
+		"--env", "MODE",
+		"alpine:3", "-f", "/dev/null",
+	}
+	if !reflect.DeepEqual(calls[0].args, wantRun) {
+		t.Errorf("run args = %q, want %q", calls[0].args, wantRun)
+	}
+	if calls[0].env[1] != "container-mode" {
+		t.Errorf("run got MODE=%q in its environment", calls[0].env[1])
+	}
+
+	wantInspect := []string{"inspect", "--format", "{{json .Config.Env}}", name}
+	if !reflect.DeepEqual(calls[1].args, wantInspect) {
+		t.Errorf("inspect args = %q, want %q", calls[1].args, wantInspect)
+	}
+
+	// exec --workdir <workspace> --env NAME... <name> sh -c <wrapper> <pid file> <script file>
+	exec := calls[2].args
+	wantHead := []string{"exec", "--workdir", filepath.Join(root, "workspace")}
+	wantTail := []string{name, "sh", "-c", containerStepWrapper, filepath.Join(root, "temp", "step-1.pid")}
+	if len(exec) < len(wantHead)+len(wantTail)+1 ||
+		!reflect.DeepEqual(exec[:len(wantHead)], wantHead) ||
+		!reflect.DeepEqual(exec[len(exec)-len(wantTail)-1:len(exec)-1], wantTail) {
+		t.Fatalf("exec args = %q", exec)
+	}
+	if script := exec[len(exec)-1]; !strings.HasPrefix(script, filepath.Join(root, "temp")+string(filepath.Separator)) {
+		t.Errorf("script file %q is not in the job's temp directory", script)
+	}
+	var names []string
+	envFlags := exec[len(wantHead) : len(exec)-len(wantTail)-1]
+	for i := 0; i < len(envFlags); i += 2 {
+		if envFlags[i] != "--env" || i+1 == len(envFlags) {
+			t.Fatalf("exec args = %q, want only --env NAME between workdir and container", exec)
+		}
+		names = append(names, envFlags[i+1])
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("exec env names are not sorted: %q", names)
+	}
+	if i := sort.SearchStrings(names, "GREETING"); i == len(names) || names[i] != "GREETING" {
+		t.Errorf("exec env names %q lack GREETING", names)
+	}
+	if calls[2].env[0] != "hello-from-env" {
+		t.Errorf("exec got GREETING=%q in its environment", calls[2].env[0])
+	}
+
+	// Values are only in the CLI's environment, never on its command line
+	for _, call := range calls {
+		for _, arg := range call.args {
+			if strings.Contains(arg, "hello-from-env") || strings.Contains(arg, "container-mode") {
+				t.Errorf("%s was passed a value on its command line: %q", call.args[0], arg)
+			}
+		}
+	}
+
+	// The container is removed although the step failed
+	wantRm := []string{"rm", "--force", name}
+	if !reflect.DeepEqual(calls[3].args, wantRm) {
+		t.Errorf("rm args = %q, want %q", calls[3].args, wantRm)
+	}
+
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("job directory %s was not removed: %v", root, err)
+	}
+}
+
+func TestContainerStepCancel(t *testing.T) {
+	r, stubDir, jobResult := newStubRunner(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.executeJob(context.Background(), types.JobAssignment{
+			JobID: 7,
+			RunID: 1,
+			JobSpec: types.JobSpec{
+				Container: &types.ContainerSpec{Image: "alpine:3"},
+				Steps:     []types.StepSpec{{Name: "sleep", Run: "sleep 60"}},
+			},
+			StepIDs: []uint{70},
+		})
+	}()
+
+	// Cancel once the step has recorded its process group
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		matches, _ := filepath.Glob(filepath.Join(r.WorkDir, "job-7-*", "temp", "step-1.pid"))
+		if len(matches) > 0 {
+			if data, _ := os.ReadFile(matches[0]); len(data) > 0 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the step did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.cancelJob(7)
+
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		t.Fatal("the step was not stopped by SIGTERM")
+	}
+	if status := jobResult().Status; status != "cancelled" {
+		t.Errorf("job status = %q, want cancelled", status)
+	}
+
+	// run, inspect, exec, the signal and rm
+	calls := readInvocations(t, stubDir)
+	if len(calls) != 5 {
+		t.Fatalf("got %d CLI invocations: %q", len(calls), calls)
+	}
+	name := calls[0].args[3]
+	signal := calls[3].args
+	if len(signal) != 7 || !reflect.DeepEqual(signal[:6], []string{"exec", name, "sh", "-c", containerSignal, "TERM"}) {
+		t.Errorf("signal args = %q", signal)
+	}
+	if wantRm := []string{"rm", "--force", name}; !reflect.DeepEqual(calls[4].args, wantRm) {
+		t.Errorf("rm args = %q, want %q", calls[4].args, wantRm)
+	}
+}
+
+func TestServiceErrorMasked(t *testing.T) {
+	const secret = "hunter2-secret"
+
+	tests := []struct {
+		name   string
+		state  string
+		logs   string
+		health *types.HealthCheckSpec
+	}{
+		{
+			name:  "logs of an exited service",
+			state: "exited",
+			logs:  "FATAL: password " + secret + " is too short",
+		},
+		{
+			name:   "health check output",
+			health: &types.HealthCheckSpec{Command: "echo login with " + secret + " refused; exit 1", Retries: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _, jobResult := newStubRunner(t)
+			t.Setenv("STUB_STATE", test.state)
+			t.Setenv("STUB_LOGS", test.logs)
+
+			r.executeJob(context.Background(), types.JobAssignment{
+				JobID: 7,
+				RunID: 1,
+				JobSpec: types.JobSpec{
+					Services: map[string]types.ServiceSpec{
+						"db": {
+							Image:       "postgres:16",
+							Env:         map[string]string{"POSTGRES_PASSWORD": "${{ secrets.DB_PASSWORD }}"},
+							HealthCheck: test.health,
+						},
+					},
+					Steps: []types.StepSpec{{Name: "test", Run: "true"}},
+				},
+				StepIDs:  []uint{70},
+				Contexts: map[string]interface{}{"secrets": map[string]interface{}{"DB_PASSWORD": secret}},
+			})
+
+			result := jobResult()
+			if result.Status != "failed" {
+				t.Errorf("job status = %q, want failed", result.Status)
+			}
+			if strings.Contains(result.Error, secret) || !strings.Contains(result.Error, "***") {
+				t.Errorf("job error = %q, want the secret masked", result.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+)
+
+// defaultEnvAllowlist is the host environment steps get with
+// RUNNER_MINIMAL_ENV when RUNNER_ENV_ALLOWLIST is not set
+const defaultEnvAllowlist = "PATH,HOME,USER,LOGNAME,SHELL,LANG,LC_ALL,TZ,TMPDIR"
+
+// runnerOnlyEnv is configuration of the runner itself that steps never see
+var runnerOnlyEnv = map[string]bool{"RUNNER_REGISTRATION_TOKEN": true}
+
+// baseEnvironment returns the host environment that steps start from: all of
+// it, or only the allow-listed variables when minimal is set.
+func baseEnvironment(minimal bool, allowlist []string) []string {
+	allowed := make(map[string]bool, len(allowlist))
+	for _, name := range allowlist {
+		allowed[strings.TrimSpace(name)] = true
+	}
+
+	var env []string
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if runnerOnlyEnv[name] || (minimal && !allowed[name]) {
+			continue
+		}
+		env = append(env, entry)
+	}
+	return env
+}
+
+// jobEnv resolves the environment of a job's steps. Later layers override
+// earlier ones:
+//
+//  1. the runner's base environment
+//  2. INPUT_<NAME> for each workflow input
+//  3. the workflow env
+//  4. the job env
+//  5. variables set by earlier steps through $RELAYFORGE_ENV
+//  6. the step env
+//  7. RELAYFORGE_WORKSPACE, RELAYFORGE_OUTPUT, RELAYFORGE_ENV and
+//     RELAYFORGE_PATH
+//
+// Directories added through $RELAYFORGE_PATH are prepended to PATH, the most
+// recent first.
+type jobEnv struct {
+	base      []string
+	workspace string
+	workflow  map[string]string
+	job       map[string]string
+	set       map[string]string
+	path      []string
+}
+
+// resolve interpolates and layers the workflow, job and step env, along with
+// the variables set by earlier steps. The result is the step's env context.
+func (e *jobEnv) resolve(stepEnv map[string]string, ctx *expr.Context) (map[string]string, error) {
+	workflow, err := expr.InterpolateMap(e.workflow, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("env: %v", err)
+	}
+	job, err := expr.InterpolateMap(e.job, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("env: %v", err)
+	}
+	step, err := expr.InterpolateMap(stepEnv, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("env: %v", err)
+	}
+
+	// Values set by steps are taken literally, never evaluated
+	env := make(map[string]string)
+	for _, layer := range []map[string]string{workflow, job, e.set, step} {
+		for key, value := range layer {
+			env[key] = value
+		}
+	}
+	return env, nil
+}
+
+// environ returns the environment of a step's process: the base
+// environment, then vars, then the workspace and step files. Later entries
+// win.
+func (e *jobEnv) environ(vars map[string]string, files *stepFiles) []string {
+	env := append([]string(nil), e.base...)
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+
+	if len(e.path) > 0 {
+		path, ok := vars["PATH"]
+		if !ok {
+			for _, entry := range e.base {
+				if strings.HasPrefix(entry, "PATH=") {
+					path = strings.TrimPrefix(entry, "PATH=")
+				}
+			}
+		}
+		dirs := append(append([]string(nil), e.path...), path)
+		env = append(env, "PATH="+strings.Join(dirs, string(os.PathListSeparator)))
+	}
+
+	env = append(env, workspaceEnv+"="+e.workspace)
+	return append(env, files.environ()...)
+}
+
+// absorb takes in the variables and PATH directories a step set for the
+// steps after it
+func (e *jobEnv) absorb(files *stepFiles) error {
+	set, err := readKeyValues(files.env)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", envEnv, err)
+	}
+	dirs, err := readPaths(files.path)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", pathEnv, err)
+	}
+
+	for key, value := range set {
+		e.set[key] = value
+	}
+	// Directories added last come first, in the order they were written
+	e.path = append(dirs, e.path...)
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// environMap turns an environment into a map, later entries winning as they
+// do for a process
+func environMap(env []string) map[string]string {
+	vars := make(map[string]string)
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		vars[name] = value
+	}
+	return vars
+}
+
+func TestBaseEnvironment(t *testing.T) {
+	t.Setenv("RELAYFORGE_TEST_ALLOWED", "allowed")
+	t.Setenv("RELAYFORGE_TEST_OTHER", "other")
+	t.Setenv("RUNNER_REGISTRATION_TOKEN", "rfreg_secret")
+
+	tests := []struct {
+		name      string
+		minimal   bool
+		allowlist []string
+		want      map[string]bool
+	}{
+		{
+			name: "full",
+			want: map[string]bool{"RELAYFORGE_TEST_ALLOWED": true, "RELAYFORGE_TEST_OTHER": true, "PATH": true},
+		},
+		{
+			name:      "minimal",
+			minimal:   true,
+			allowlist: []string{"PATH", " RELAYFORGE_TEST_ALLOWED ", "RUNNER_REGISTRATION_TOKEN"},
+			want:      map[string]bool{"RELAYFORGE_TEST_ALLOWED": true, "PATH": true},
+		},
+		{
+			name:      "default allowlist",
+			minimal:   true,
+			allowlist: strings.Split(defaultEnvAllowlist, ","),
+			want:      map[string]bool{"PATH": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := environMap(baseEnvironment(test.minimal, test.allowlist))
+			for name := range test.want {
+				if _, ok := env[name]; !ok {
+					t.Errorf("%s is missing", name)
+				}
+			}
+			// The registration token never reaches steps, allow-listed or not
+			if _, ok := env["RUNNER_REGISTRATION_TOKEN"]; ok {
+				t.Error("RUNNER_REGISTRATION_TOKEN is passed on")
+			}
+			if test.minimal {
+				allowed := make(map[string]bool)
+				for _, name := range test.allowlist {
+					allowed[strings.TrimSpace(name)] = true
+				}
+				for name := range env {
+					if !allowed[name] {
+						t.Errorf("%s is not allow-listed", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestJobEnvResolve(t *testing.T) {
+	env := &jobEnv{
+		workflow: map[string]string{"A": "workflow", "B": "workflow", "C": "workflow", "D": "workflow", "OS": "${{ matrix.os }}"},
+		job:      map[string]string{"A": "job", "B": "job", "C": "job"},
+		set:      map[string]string{"A": "set", "B": "set", "LITERAL": "${{ matrix.os }}"},
+	}
+	ctx := &expr.Context{Values: map[string]interface{}{"matrix": map[string]interface{}{"os": "linux"}}}
+
+	got, err := env.resolve(map[string]string{"A": "step", "STEP": "on ${{ matrix.os }}"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"A":    "step",
+		"B":    "set",
+		"C":    "job",
+		"D":    "workflow",
+		"OS":   "linux",
+		"STEP": "on linux",
+		// Values set by steps are taken literally
+		"LITERAL": "${{ matrix.os }}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	bad := map[string]string{"BAD": "${{ matrix.os =="}
+	invalid := []struct {
+		layer   string
+		env     *jobEnv
+		stepEnv map[string]string
+	}{
+		{"workflow", &jobEnv{workflow: bad}, nil},
+		{"job", &jobEnv{job: bad}, nil},
+		{"step", &jobEnv{}, bad},
+	}
+	for _, test := range invalid {
+		if _, err := test.env.resolve(test.stepEnv, ctx); err == nil || !strings.HasPrefix(err.Error(), "env: ") {
+			t.Errorf("got %v for an invalid expression in the %s env, want an env error", err, test.layer)
+		}
+	}
+}
+
+func TestJobEnvEnviron(t *testing.T) {
+	files := &stepFiles{output: "/tmp/step/output", env: "/tmp/step/env", path: "/tmp/step/path"}
+	base := []string{"PATH=/usr/bin:/bin", "HOME=/home/runner", "KEEP=base", "OVERRIDE=base", outputEnv + "=/base"}
+
+	tests := []struct {
+		name string
+		path []string
+		vars map[string]string
+		want map[string]string
+	}{
+		{
+			name: "vars override the base",
+			vars: map[string]string{"OVERRIDE": "var", workspaceEnv: "/elsewhere", outputEnv: "/elsewhere"},
+			want: map[string]string{"PATH": "/usr/bin:/bin", "OVERRIDE": "var"},
+		},
+		{
+			name: "added directories come first",
+			path: []string{"/opt/new/bin", "/opt/old/bin"},
+			want: map[string]string{"PATH": "/opt/new/bin:/opt/old/bin:/usr/bin:/bin"},
+		},
+		{
+			name: "added directories before the PATH of the env",
+			path: []string{"/opt/tool/bin"},
+			vars: map[string]string{"PATH": "/custom/bin"},
+			want: map[string]string{"PATH": "/opt/tool/bin:/custom/bin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := &jobEnv{base: base, workspace: "/work/workspace", path: test.path}
+			got := environMap(env.environ(test.vars, files))
+
+			want := map[string]string{
+				"HOME":       "/home/runner",
+				"KEEP":       "base",
+				"OVERRIDE":   "base",
+				workspaceEnv: "/work/workspace",
+				outputEnv:    files.output,
+				envEnv:       files.env,
+				pathEnv:      files.path,
+			}
+			for key, value := range test.want {
+				want[key] = value
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestJobEnvAbsorb(t *testing.T) {
+	write := func(t *testing.T, env, path string) *stepFiles {
+		t.Helper()
+		files, err := createStepFiles(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(files.env, []byte(env), 0o600)
+		os.WriteFile(files.path, []byte(path), 0o600)
+		return files
+	}
+
+	env := &jobEnv{set: make(map[string]string)}
+	if err := env.absorb(write(t, "A=1\nB<<EOF\nline\nEOF\n", "/opt/a/bin\n/opt/b/bin\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.absorb(write(t, "A=2\n", "/opt/c/bin\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{"A": "2", "B": "line"}; !reflect.DeepEqual(env.set, want) {
+		t.Errorf("set = %q, want %q", env.set, want)
+	}
+	if want := []string{"/opt/c/bin", "/opt/a/bin", "/opt/b/bin"}; !reflect.DeepEqual(env.path, want) {
+		t.Errorf("path = %q, want %q", env.path, want)
+	}
+
+	// A malformed file takes nothing in
+	tests := []struct {
+		name, env, path, wantErr string
+	}{
+		{"env", "not a value\n", "", "invalid RELAYFORGE_ENV: line 1: expected name=value or name<<DELIMITER"},
+		{"env heredoc", "A<<EOF\n", "/opt/d/bin\n", `invalid RELAYFORGE_ENV: line 1: missing delimiter "EOF" for "A"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := env.absorb(write(t, test.env, test.path))
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("got %v, want %q", err, test.wantErr)
+			}
+			if len(env.path) != 3 || env.set["A"] != "2" {
+				t.Errorf("took in set %q and path %q from a malformed file", env.set, env.path)
+			}
+		})
+	}
+}
+
+// TestStepEnvLayers pins down which layer wins for a variable set in several:
+// the runner's base environment, INPUT_<NAME>, the workflow env, the job env,
+// $RELAYFORGE_ENV of earlier steps and the step env, later ones winning
+func TestStepEnvLayers(t *testing.T) {
+	r, results, jobResult := newShellRunner(t)
+	r.BaseEnv = append(r.BaseEnv,
+		"INPUT_A=base", "INPUT_B=base", "INPUT_C=base", "INPUT_D=base", "INPUT_E=base", "INPUT_F=base")
+
+	r.executeJob(context.Background(), types.JobAssignment{
+		JobID: 7,
+		RunID: 1,
+		Workflow: types.WorkflowSpec{
+			Env: map[string]string{"INPUT_A": "workflow", "INPUT_B": "workflow", "INPUT_C": "workflow", "INPUT_D": "workflow",
+				workspaceEnv: "/elsewhere"},
+		},
+		JobSpec: types.JobSpec{
+			Env: map[string]string{"INPUT_A": "job", "INPUT_B": "job", "INPUT_C": "job"},
+			Steps: []types.StepSpec{
+				{Name: "set", Run: `echo INPUT_A=set >> "$RELAYFORGE_ENV"; echo INPUT_B=set >> "$RELAYFORGE_ENV"
+mkdir -p bin && printf '#!/bin/sh\necho tool\n' > bin/tool && chmod +x bin/tool && echo "$PWD/bin" >> "$RELAYFORGE_PATH"`},
+				{
+					Name: "print",
+					Env:  map[string]string{"INPUT_A": "step"},
+					Run: `for name in A B C D E F; do eval "echo $name=\$INPUT_$name"; done >> "$RELAYFORGE_OUTPUT"
+echo "workspace=$([ "$RELAYFORGE_WORKSPACE" = "$PWD" ] && echo ok)" >> "$RELAYFORGE_OUTPUT"
+echo "tool=$(tool)" >> "$RELAYFORGE_OUTPUT"`,
+				},
+			},
+		},
+		StepIDs:  []uint{70, 71},
+		Contexts: map[string]interface{}{"inputs": map[string]interface{}{"a": "input", "b": "input", "c": "input", "d": "input", "e": "input"}},
+	})
+
+	if status := jobResult().Status; status != "success" {
+		t.Fatalf("job status = %q: %+v", status, results())
+	}
+	want := map[string]string{
+		"A": "step", "B": "set", "C": "job", "D": "workflow", "E": "input", "F": "base",
+		"workspace": "ok", "tool": "tool",
+	}
+	got := finalResults(results())[71].Outputs
+	if !reflect.DeepEqual(got, want) {
+		var names []string
+		for name := range want {
+			if got[name] != want[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		t.Errorf("got %q, want %q; wrong layer for %q", got, want, names)
+	}
+}
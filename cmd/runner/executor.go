@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// Executor runs the steps of a job, on the host or elsewhere. Whatever runs
+// them, step results and output are handled the same way.
+type Executor interface {
+	// Start prepares the job before its first step
+	Start(ctx context.Context) error
+	// BaseEnv returns the environment steps start from
+	BaseEnv() []string
+	// Command returns the command running a step's script file in dir with env.
+	// When ctx is done, the script and everything it started get SIGTERM, and
+	// SIGKILL once grace has passed. release must be called once the command
+	// has been waited for.
+	Command(ctx context.Context, script, dir string, env []string, grace time.Duration) (cmd *exec.Cmd, release func())
+	// Stop releases what Start set up, once the job has finished
+	Stop()
+}
+
+// shellExecutor runs steps with sh on the runner's host
+type shellExecutor struct {
+	env []string
+}
+
+func (e *shellExecutor) Start(ctx context.Context) error {
+	return nil
+}
+
+func (e *shellExecutor) BaseEnv() []string {
+	return e.env
+}
+
+func (e *shellExecutor) Command(ctx context.Context, script, dir string, env []string, grace time.Duration) (*exec.Cmd, func()) {
+	cmd := exec.CommandContext(ctx, "sh", script)
+	cmd.Dir = dir
+	cmd.Env = env
+	return cmd, setProcessGroup(cmd, grace)
+}
+
+func (e *shellExecutor) Stop() {}
+
+// cancelWithGrace makes cancelling cmd call signal with SIGTERM and, unless
+// the command has been waited for by then, with SIGKILL after grace. The
+// returned function must be called once the command has been waited for; it
+// stops a pending SIGKILL, whose target may have been reused by then.
+func cancelWithGrace(cmd *exec.Cmd, grace time.Duration, signal func(syscall.Signal) error) func() {
+	var (
+		mu     sync.Mutex
+		kill   *time.Timer
+		waited bool
+	)
+
+	cmd.Cancel = func() error {
+		mu.Lock()
+		if !waited {
+			kill = time.AfterFunc(grace, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !waited {
+					signal(syscall.SIGKILL)
+				}
+			})
+		}
+		mu.Unlock()
+		return signal(syscall.SIGTERM)
+	}
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		waited = true
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// newExecutor returns the executor for a job: a container executor if the
+// job declares a container, otherwise a shell executor. A job container joins
+// the network of the job's services.
+func (r *Runner) newExecutor(jobSpec types.JobSpec, dirs *jobDirs, exprCtx *expr.Context, network string) (Executor, error) {
+	if jobSpec.Container == nil {
+		return &shellExecutor{env: r.BaseEnv}, nil
+	}
+
+	image, err := expr.Interpolate(jobSpec.Container.Image, exprCtx)
+	if err != nil {
+		return nil, fmt.Errorf("container image: %v", err)
+	}
+	env, err := expr.InterpolateMap(jobSpec.Container.Env, exprCtx)
+	if err != nil {
+		return nil, fmt.Errorf("container env: %v", err)
+	}
+	return &containerExecutor{
+		cli:     newContainerCLI(r.ContainerCLI),
+		name:    "relayforge-" + filepath.Base(dirs.root),
+		image:   image,
+		env:     env,
+		network: network,
+		mounts:  map[string]string{dirs.hostRoot: dirs.root},
+		pidDir:  dirs.temp,
+	}, nil
+}
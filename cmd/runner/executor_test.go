@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCancelWithGrace(t *testing.T) {
+	const grace = 50 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		releaseWait time.Duration // how long after cancelling the command is waited for
+		want        []syscall.Signal
+	}{
+		{"exits on SIGTERM", 0, []syscall.Signal{syscall.SIGTERM}},
+		{"killed after the grace period", 4 * grace, []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				signals []syscall.Signal
+			)
+			cmd := exec.Command("true")
+			release := cancelWithGrace(cmd, grace, func(sig syscall.Signal) error {
+				mu.Lock()
+				defer mu.Unlock()
+				signals = append(signals, sig)
+				return nil
+			})
+
+			if err := cmd.Cancel(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(test.releaseWait)
+			release()
+			// A SIGKILL that was stopped never comes
+			time.Sleep(2 * grace)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(signals, test.want) {
+				t.Errorf("got signals %v, want %v", signals, test.want)
+			}
+		})
+	}
+}
+
+func TestCancelWithGraceAfterWait(t *testing.T) {
+	var signals []syscall.Signal
+	cmd := exec.Command("true")
+	release := cancelWithGrace(cmd, time.Millisecond, func(sig syscall.Signal) error {
+		signals = append(signals, sig)
+		return nil
+	})
+
+	// Once the command has been waited for, cancelling it starts no timer
+	release()
+	cmd.Cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	if want := []syscall.Signal{syscall.SIGTERM}; !reflect.DeepEqual(signals, want) {
+		t.Errorf("got signals %v, want %v", signals, want)
+	}
+}
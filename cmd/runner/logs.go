@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+const (
+	// logFlushInterval is how often streamed output is sent to the server
+	logFlushInterval = time.Second
+	// maxLogBatch is the largest number of lines sent in one request
+	maxLogBatch = 500
+	// maxPendingLogLines bounds the lines kept while the server is unreachable;
+	// the oldest are dropped beyond it
+	maxPendingLogLines = 10000
+	// maxLogLineLength splits very long lines so a step printing without
+	// newlines is still streamed
+	maxLogLineLength = 64 * 1024
+)
+
+// logStreamer sends the output of a running step to the server line by line.
+// Lines are numbered, and a batch stays pending until the server accepted it,
+// so a batch that is resent after a failed request is not stored twice.
+type logStreamer struct {
+	runner *Runner
+	path   string
+	mask   *masker
+
+	mu       sync.Mutex
+	sequence int64
+	pending  []types.LogLine
+	partial  map[string][]byte // unterminated last line of each stream
+	lost     bool              // the lease is gone, nothing more is accepted
+
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// streamLogs starts streaming the output of a step, masking secrets in it.
+// close must be called once the step has finished.
+func (r *Runner) streamLogs(jobID, stepID uint, mask *masker) *logStreamer {
+	s := &logStreamer{
+		runner:   r,
+		path:     fmt.Sprintf("/api/runners/%s/jobs/%d/steps/%d/logs", r.ID, jobID, stepID),
+		mask:     mask,
+		partial:  make(map[string][]byte),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// writer returns a writer for the stdout or stderr stream of the step
+func (s *logStreamer) writer(stream string) io.Writer {
+	return &streamWriter{streamer: s, stream: stream}
+}
+
+type streamWriter struct {
+	streamer *logStreamer
+	stream   string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.streamer.write(w.stream, p)
+	return len(p), nil
+}
+
+func (s *logStreamer) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := append(s.partial[stream], p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.addLine(stream, buf[:i])
+		buf = buf[i+1:]
+	}
+	for len(buf) >= maxLogLineLength {
+		n := s.mask.cut(buf, maxLogLineLength)
+		s.addLine(stream, buf[:n])
+		buf = buf[n:]
+	}
+	s.partial[stream] = append([]byte(nil), buf...)
+}
+
+// addLine masks a complete line, numbers it and queues it. A line that
+// starts with ::add-mask:: registers a value to mask from then on. The caller
+// holds s.mu.
+func (s *logStreamer) addLine(stream string, line []byte) {
+	if s.lost {
+		return
+	}
+
+	content := strings.TrimSuffix(string(line), "\r")
+	if value := strings.TrimPrefix(content, addMaskCommand); value != content {
+		s.mask.add(strings.TrimSpace(value))
+	}
+	content = s.mask.mask(content)
+
+	if len(s.pending) >= maxPendingLogLines {
+		log.Printf("Dropping log line %d for %s: server unreachable", s.pending[0].Sequence, s.path)
+		s.pending = s.pending[1:]
+	}
+
+	s.sequence++
+	s.pending = append(s.pending, types.LogLine{
+		Sequence:  s.sequence,
+		Stream:    stream,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+	})
+}
+
+func (s *logStreamer) run() {
+	defer close(s.finished)
+
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			s.flushAll()
+			return
+		}
+	}
+}
+
+// close sends the remaining output, including unterminated lines, and waits
+// until it was delivered or given up on.
+func (s *logStreamer) close() {
+	s.mu.Lock()
+	for _, stream := range []string{"stdout", "stderr"} {
+		if len(s.partial[stream]) > 0 {
+			s.addLine(stream, s.partial[stream])
+			s.partial[stream] = nil
+		}
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+	<-s.finished
+}
+
+// flushAll sends every pending line, retrying a few times on failure
+func (s *logStreamer) flushAll() {
+	for attempt := 1; attempt <= reportAttempts; attempt++ {
+		for s.flush() {
+		}
+		s.mu.Lock()
+		remaining := len(s.pending)
+		s.mu.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	log.Printf("Gave up sending logs to %s", s.path)
+}
+
+// flush sends one batch of pending lines. It reports whether the batch was
+// accepted and there are more lines to send.
+func (s *logStreamer) flush() bool {
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	batch := s.pending
+	if len(batch) > maxLogBatch {
+		batch = batch[:maxLogBatch]
+	}
+	batch = append([]types.LogLine(nil), batch...)
+	s.mu.Unlock()
+
+	resp, err := s.runner.apiRequest("POST", s.path, types.LogChunk{Lines: batch})
+	if err != nil {
+		log.Printf("Failed to send logs to %s: %v", s.path, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusConflict:
+		// The job is no longer ours, so its logs are not wanted either
+		s.mu.Lock()
+		s.lost = true
+		s.pending = nil
+		s.mu.Unlock()
+		return false
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Failed to send logs to %s: %s: %s", s.path, resp.Status, body)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return false
+		}
+		// Client errors will not succeed on retry
+	}
+
+	// Drop the sent lines; lines dropped meanwhile for lack of room are
+	// skipped by sequence number
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := batch[len(batch)-1].Sequence
+	for len(s.pending) > 0 && s.pending[0].Sequence <= last {
+		s.pending = s.pending[1:]
+	}
+	return len(s.pending) > 0
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,41 +12,88 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
 	"github.com/lockb0x-llc/relayforge/pkg/types"
 )
 
+// leaseRenewInterval is how often a running job's lease is renewed. It must
+// stay well below the server's lease duration.
+const leaseRenewInterval = 30 * time.Second
+
+// reportAttempts is how many times a result is posted before giving up.
+const reportAttempts = 3
+
+// killGracePeriod is how long a cancelled step gets to exit after SIGTERM
+// before its process group is killed.
+const killGracePeriod = 10 * time.Second
+
+// processWaitDelay is how long to wait for a killed step's output to close
+// before giving up on it.
+const processWaitDelay = 5 * time.Second
+
 type Runner struct {
-	ID      string
-	Name    string
-	Version string
-	Tags    []string
-	ApiURL  string
-	Token   string
-	client  *http.Client
+	ID                string
+	Name              string
+	Version           string
+	Tags              []string
+	ApiURL            string
+	Token             string // runner secret issued on registration
+	CredentialsFile   string
+	HeartbeatInterval time.Duration
+	BaseEnv           []string // host environment that steps start from
+	WorkDir           string   // root of the job workspaces
+	KeepWorkspaces    bool     // keep the workspaces of jobs that did not succeed
+	ContainerCLI      string   // docker or a compatible CLI, for container jobs
+	HostWorkDir       string   // WorkDir on the host that runs job containers
+	client            *http.Client
+
+	mu         sync.Mutex
+	activeJobs map[uint]context.CancelFunc // cancels the job's steps
 }
 
 func main() {
-	runner := &Runner{
-		ID:      fmt.Sprintf("runner-%d", time.Now().Unix()),
-		Name:    getEnv("RUNNER_NAME", "relayforge-runner"),
-		Version: "1.0.0",
-		Tags:    strings.Split(getEnv("RUNNER_TAGS", "linux,shell"), ","),
-		ApiURL:  getEnv("API_URL", "http://localhost:8080"),
-		Token:   getEnv("RUNNER_TOKEN", ""),
-		client:  &http.Client{Timeout: 30 * time.Second},
+	heartbeatInterval, err := time.ParseDuration(getEnv("RUNNER_HEARTBEAT_INTERVAL", "15s"))
+	if err != nil || heartbeatInterval <= 0 {
+		log.Fatal("Invalid RUNNER_HEARTBEAT_INTERVAL:", getEnv("RUNNER_HEARTBEAT_INTERVAL", ""))
 	}
 
-	log.Printf("Starting RelayForge Runner %s", runner.ID)
+	minimalEnv := getEnv("RUNNER_MINIMAL_ENV", "false") == "true"
+	envAllowlist := strings.Split(getEnv("RUNNER_ENV_ALLOWLIST", defaultEnvAllowlist), ",")
+
+	runner := &Runner{
+		Name:              getEnv("RUNNER_NAME", "relayforge-runner"),
+		Version:           "1.0.0",
+		Tags:              strings.Split(getEnv("RUNNER_TAGS", "linux,shell"), ","),
+		ApiURL:            getEnv("API_URL", "http://localhost:8080"),
+		CredentialsFile:   getEnv("RUNNER_CREDENTIALS_FILE", defaultCredentialsFile()),
+		HeartbeatInterval: heartbeatInterval,
+		BaseEnv:           baseEnvironment(minimalEnv, envAllowlist),
+		WorkDir:           getEnv("RUNNER_WORK_DIR", defaultWorkDir()),
+		KeepWorkspaces:    getEnv("RUNNER_KEEP_FAILED_WORKSPACES", "false") == "true",
+		ContainerCLI:      getEnv("RUNNER_CONTAINER_CLI", "docker"),
+		HostWorkDir:       getEnv("RUNNER_HOST_WORK_DIR", ""),
+		client:            &http.Client{Timeout: 30 * time.Second},
+		activeJobs:        make(map[uint]context.CancelFunc),
+	}
 
-	// Register runner
-	if err := runner.register(); err != nil {
-		log.Fatal("Failed to register runner:", err)
+	// Reuse the credentials of a previous registration, or register with a one-time token
+	if err := runner.loadCredentials(); err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("Failed to load runner credentials:", err)
+		}
+		if err := runner.register(getEnv("RUNNER_REGISTRATION_TOKEN", "")); err != nil {
+			log.Fatal("Failed to register runner:", err)
+		}
 	}
 
+	log.Printf("Starting RelayForge Runner %s", runner.ID)
+
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	
@@ -57,11 +105,37 @@ func main() {
 		cancel()
 	}()
 
-	// Start job polling
-	runner.startJobPolling(ctx)
+	// Jobs are aborted rather than finished once the server rejects the
+	// runner's credentials, since their results could not be reported
+	jobsCtx, abortJobs := context.WithCancel(context.Background())
+	defer abortJobs()
+
+	// Keep the server informed that we are alive
+	heartbeatErr := make(chan error, 1)
+	go func() {
+		err := runner.startHeartbeat(ctx)
+		if err != nil {
+			abortJobs()
+			cancel()
+		}
+		heartbeatErr <- err
+	}()
+
+	// Start job polling; it returns once the current job has been cleaned up
+	runner.startJobPolling(ctx, jobsCtx)
+	cancel()
+	if err := <-heartbeatErr; err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (r *Runner) register() error {
+// register exchanges a one-time registration token for runner credentials
+// and stores them in the credentials file.
+func (r *Runner) register(token string) error {
+	if token == "" {
+		return fmt.Errorf("no credentials found at %s and RUNNER_REGISTRATION_TOKEN is not set", r.CredentialsFile)
+	}
+
 	registration := types.RunnerRegistration{
 		Name:    r.Name,
 		Version: r.Version,
@@ -75,9 +149,7 @@ func (r *Runner) register() error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	if r.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+r.Token)
-	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	resp, err := r.client.Do(req)
 	if err != nil {
@@ -90,11 +162,148 @@ func (r *Runner) register() error {
 		return fmt.Errorf("registration failed: %s", body)
 	}
 
+	// The server assigns the ID and secret we use for all later calls
+	var result struct {
+		Credentials types.RunnerCredentials `json:"credentials"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid registration response: %v", err)
+	}
+	r.ID = result.Credentials.RunnerID
+	r.Token = result.Credentials.Secret
+
+	if err := r.saveCredentials(result.Credentials); err != nil {
+		return fmt.Errorf("registered as %s but failed to save credentials: %v", r.ID, err)
+	}
+
 	log.Printf("Runner registered successfully: %s", r.ID)
 	return nil
 }
 
-func (r *Runner) startJobPolling(ctx context.Context) {
+// loadCredentials reads the runner ID and secret from the credentials file
+func (r *Runner) loadCredentials() error {
+	data, err := os.ReadFile(r.CredentialsFile)
+	if err != nil {
+		return err
+	}
+
+	var credentials types.RunnerCredentials
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return fmt.Errorf("invalid credentials file %s: %v", r.CredentialsFile, err)
+	}
+	if credentials.RunnerID == "" || credentials.Secret == "" {
+		return fmt.Errorf("incomplete credentials file %s", r.CredentialsFile)
+	}
+
+	r.ID = credentials.RunnerID
+	r.Token = credentials.Secret
+	return nil
+}
+
+// saveCredentials writes the runner credentials readable by the owner only
+func (r *Runner) saveCredentials(credentials types.RunnerCredentials) error {
+	if err := os.MkdirAll(filepath.Dir(r.CredentialsFile), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.CredentialsFile, data, 0600)
+}
+
+// defaultCredentialsFile returns the per-user location of the credentials file
+func defaultCredentialsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "relayforge", "runner.json")
+}
+
+// startHeartbeat sends heartbeats until ctx is cancelled. It returns an error
+// if the server rejects the runner's credentials.
+func (r *Runner) startHeartbeat(ctx context.Context) error {
+	ticker := time.NewTicker(r.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.sendHeartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendHeartbeat reports the active jobs and cancels those the server asks
+// for. Only rejected credentials are returned as an error; other failures
+// are logged and retried with the next heartbeat.
+func (r *Runner) sendHeartbeat() error {
+	heartbeat := types.RunnerHeartbeat{ActiveJobs: []uint{}}
+	r.mu.Lock()
+	for jobID := range r.activeJobs {
+		heartbeat.ActiveJobs = append(heartbeat.ActiveJobs, jobID)
+	}
+	r.mu.Unlock()
+
+	resp, err := r.apiRequest("POST", fmt.Sprintf("/api/runners/%s/heartbeat", r.ID), heartbeat)
+	if err != nil {
+		log.Printf("Heartbeat failed: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("runner credentials were rejected; remove %s and register again", r.CredentialsFile)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Heartbeat failed: %s", body)
+		return nil
+	}
+
+	var response types.HeartbeatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		log.Printf("Invalid heartbeat response: %v", err)
+		return nil
+	}
+	for _, jobID := range response.Cancel {
+		r.cancelJob(jobID)
+	}
+	return nil
+}
+
+// setJobActive tracks the jobs this runner is executing for heartbeats.
+// cancel stops the job's steps when its run is cancelled.
+func (r *Runner) setJobActive(jobID uint, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel != nil {
+		r.activeJobs[jobID] = cancel
+	} else {
+		delete(r.activeJobs, jobID)
+	}
+}
+
+// cancelJob cancels an active job on request of the server
+func (r *Runner) cancelJob(jobID uint) {
+	r.mu.Lock()
+	cancel, ok := r.activeJobs[jobID]
+	r.mu.Unlock()
+	if ok {
+		log.Printf("Cancelling job %d", jobID)
+		cancel()
+	}
+}
+
+// startJobPolling executes jobs one at a time until ctx is cancelled. A job
+// that is executing then still finishes, unless jobsCtx is cancelled too.
+func (r *Runner) startJobPolling(ctx, jobsCtx context.Context) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -103,117 +312,612 @@ func (r *Runner) startJobPolling(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			r.pollForJobs()
+			r.pollForJobs(ctx, jobsCtx)
+		}
+	}
+}
+
+func (r *Runner) pollForJobs(ctx, jobsCtx context.Context) {
+	assignment, err := r.acquireJob()
+	if err != nil {
+		log.Printf("Failed to acquire job: %v", err)
+		return
+	}
+	if assignment == nil {
+		return
+	}
+
+	// Keep the lease alive for as long as the job is executing, and abort
+	// the job if the lease is lost
+	jobCtx, abortJob := context.WithCancel(jobsCtx)
+	defer abortJob()
+	leaseCtx, stopRenewing := context.WithCancel(ctx)
+	defer stopRenewing()
+	go r.renewLease(leaseCtx, assignment.JobID, abortJob)
+
+	r.executeJob(jobCtx, *assignment)
+}
+
+// acquireJob asks the API for the next job. It returns nil when there is nothing to do.
+func (r *Runner) acquireJob() (*types.JobAssignment, error) {
+	resp, err := r.apiRequest("POST", fmt.Sprintf("/api/runners/%s/jobs/acquire", r.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("acquire failed: %s", body)
+	}
+
+	var result struct {
+		Assignment types.JobAssignment `json:"assignment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid assignment: %v", err)
+	}
+
+	log.Printf("Acquired job %d (lease expires %s)", result.Assignment.JobID, result.Assignment.LeaseExpiresAt)
+	return &result.Assignment, nil
+}
+
+// renewLease periodically extends the job lease until ctx is cancelled. If
+// the server no longer considers the job leased to this runner, e.g. because
+// it timed out, abort is called.
+func (r *Runner) renewLease(ctx context.Context, jobID uint, abort context.CancelFunc) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resp, err := r.apiRequest("POST", fmt.Sprintf("/api/runners/%s/jobs/%d/lease", r.ID, jobID), nil)
+			if err != nil {
+				log.Printf("Failed to renew lease for job %d: %v", jobID, err)
+				continue
+			}
+			if resp.StatusCode == http.StatusConflict {
+				resp.Body.Close()
+				log.Printf("Lost lease on job %d, aborting it", jobID)
+				abort()
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				log.Printf("Failed to renew lease for job %d: %s", jobID, body)
+			} else {
+				var result struct {
+					Lease types.JobLease `json:"lease"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Lease.Cancelled {
+					r.cancelJob(jobID)
+				}
+			}
+			resp.Body.Close()
 		}
 	}
 }
 
-func (r *Runner) pollForJobs() {
-	// In a real implementation, this would poll the API for available jobs
-	// For this demo, we'll simulate job execution
-	log.Println("Polling for jobs...")
+// jobState is what the steps of a job share
+type jobState struct {
+	id       uint
+	dirs     *jobDirs
+	executor Executor
+	env      *jobEnv
+	mask     *masker
 }
 
-func (r *Runner) executeJob(assignment types.JobAssignment) {
+func (r *Runner) executeJob(ctx context.Context, assignment types.JobAssignment) {
 	log.Printf("Executing job %d for run %d", assignment.JobID, assignment.RunID)
 
 	// Parse workflow and job
 	jobSpec := assignment.JobSpec
+	startedAt := time.Now().Format(time.RFC3339)
+
+	// Secret values never leave the runner unmasked
+	secrets, _ := assignment.Contexts["secrets"].(map[string]interface{})
+	mask := newMasker(secrets)
+
+	if len(assignment.StepIDs) != len(jobSpec.Steps) {
+		r.reportJobResult(mask, types.JobResult{
+			JobID:     assignment.JobID,
+			Status:    "failed",
+			Error:     "assignment step IDs do not match the job's steps",
+			StartedAt: startedAt,
+		})
+		return
+	}
+
+	// Each job starts in an empty workspace of its own
+	dirs, err := r.createJobDirs(assignment.JobID)
+	if err != nil {
+		r.reportJobResult(mask, types.JobResult{
+			JobID:     assignment.JobID,
+			Status:    "failed",
+			Error:     fmt.Sprintf("failed to create workspace: %v", err),
+			StartedAt: startedAt,
+		})
+		return
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded && r.KeepWorkspaces {
+			log.Printf("Keeping workspace %s of job %d", dirs.workspace, assignment.JobID)
+			return
+		}
+		if err := dirs.remove(); err != nil {
+			log.Printf("Failed to remove workspace %s: %v", dirs.root, err)
+		}
+	}()
 
-	// Execute steps
+	// The job timeout covers all of its steps
+	var jobTimeout time.Duration
+	if jobSpec.Timeout != "" {
+		jobTimeout, _ = time.ParseDuration(jobSpec.Timeout)
+	}
+	if jobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jobTimeout)
+		defer cancel()
+	}
+
+	// Cancelling the run stops the current step; the steps after it only run
+	// if their condition asks for it
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	r.setJobActive(assignment.JobID, cancelRun)
+	defer r.setJobActive(assignment.JobID, nil)
+
+	// Job status as seen by the status functions in step conditions, and the
+	// results of the steps with an id
+	exprCtx := &expr.Context{Values: assignment.Contexts, Status: expr.StatusSuccess}
+	if exprCtx.Values == nil {
+		exprCtx.Values = make(map[string]interface{})
+	}
+	steps := make(map[string]interface{})
+	exprCtx.Values["steps"] = steps
+
+	// None of the steps run if their services or executor cannot be started,
+	// e.g. because an image cannot be pulled. Services are torn down last.
+	services, startErr := r.newServices(jobSpec, dirs, exprCtx)
+	if startErr == nil {
+		defer services.Stop()
+		startErr = services.Start(runCtx)
+		exprCtx.Values["services"] = services.Context()
+	}
+	var executor Executor
+	if startErr == nil {
+		executor, startErr = r.newExecutor(jobSpec, dirs, exprCtx, services.network)
+	}
+	if startErr == nil {
+		defer executor.Stop()
+		startErr = executor.Start(runCtx)
+	}
+
+	job := &jobState{
+		id:       assignment.JobID,
+		dirs:     dirs,
+		executor: executor,
+		mask:     mask,
+		env: &jobEnv{
+			workspace: dirs.workspace,
+			workflow:  assignment.Workflow.Env,
+			job:       jobSpec.Env,
+			set:       make(map[string]string),
+		},
+	}
+	if startErr == nil {
+		job.env.base = executor.BaseEnv()
+	}
+
+	// Execute steps. A failed step fails the job unless it continues on
+	// error, but later steps still get the chance to run if their condition
+	// asks for it, e.g. if: failure()
+	jobErr := startErr
 	for i, step := range jobSpec.Steps {
-		if err := r.executeStep(assignment.JobID, uint(i+1), step); err != nil {
+		if ctx.Err() != nil || startErr != nil {
+			break
+		}
+		stepID := assignment.StepIDs[i]
+
+		stepCtx := runCtx
+		if runCtx.Err() != nil {
+			// Steps that still run after cancellation cannot be cancelled again
+			exprCtx.Status = expr.StatusCancelled
+			stepCtx = ctx
+		}
+
+		result, err := r.runStep(stepCtx, job, stepID, step, exprCtx)
+		if step.ID != "" {
+			outputs := make(map[string]interface{}, len(result.Outputs))
+			for name, value := range result.Outputs {
+				outputs[name] = value
+			}
+			steps[step.ID] = map[string]interface{}{
+				"outcome":    result.Outcome,
+				"conclusion": result.Conclusion,
+				"outputs":    outputs,
+			}
+		}
+
+		switch {
+		case err == nil:
+		case result.Conclusion == "success":
+			log.Printf("Step failed, continuing on error: %v", err)
+		default:
 			log.Printf("Step failed: %v", err)
-			r.reportJobResult(types.JobResult{
-				JobID:  assignment.JobID,
-				Status: "failed",
-				Error:  err.Error(),
-			})
-			return
+			if jobErr == nil {
+				jobErr = err
+			}
+			if exprCtx.Status != expr.StatusCancelled {
+				exprCtx.Status = expr.StatusFailure
+			}
 		}
 	}
 
-	// Report success
-	r.reportJobResult(types.JobResult{
-		JobID:  assignment.JobID,
-		Status: "success",
-	})
+	outputs := jobOutputs(jobSpec, exprCtx, mask)
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		r.reportJobResult(mask, types.JobResult{
+			JobID:      assignment.JobID,
+			Status:     "timed_out",
+			Error:      fmt.Sprintf("job exceeded its timeout of %s", jobTimeout),
+			Outputs:    outputs,
+			StartedAt:  startedAt,
+			FinishedAt: time.Now().Format(time.RFC3339),
+		})
+	case ctx.Err() != nil:
+		// The lease was lost, so the server has already settled the job
+		log.Printf("Job %d aborted", assignment.JobID)
+	case runCtx.Err() != nil:
+		r.reportJobResult(mask, types.JobResult{
+			JobID:      assignment.JobID,
+			Status:     "cancelled",
+			Error:      "run was cancelled",
+			Outputs:    outputs,
+			StartedAt:  startedAt,
+			FinishedAt: time.Now().Format(time.RFC3339),
+		})
+	case jobErr != nil:
+		r.reportJobResult(mask, types.JobResult{
+			JobID:      assignment.JobID,
+			Status:     "failed",
+			Error:      jobErr.Error(),
+			Outputs:    outputs,
+			StartedAt:  startedAt,
+			FinishedAt: time.Now().Format(time.RFC3339),
+		})
+	default:
+		succeeded = true
+		r.reportJobResult(mask, types.JobResult{
+			JobID:      assignment.JobID,
+			Status:     "success",
+			Outputs:    outputs,
+			StartedAt:  startedAt,
+			FinishedAt: time.Now().Format(time.RFC3339),
+		})
+	}
+}
+
+// jobOutputs evaluates the outputs a job declares, once its steps are done.
+// Outputs that are empty, cannot be evaluated or contain a secret are left
+// out, so the other jobs of a matrix do not overwrite them with nothing.
+func jobOutputs(jobSpec types.JobSpec, exprCtx *expr.Context, mask *masker) map[string]string {
+	if len(jobSpec.Outputs) == 0 {
+		return nil
+	}
+
+	outputs := make(map[string]string, len(jobSpec.Outputs))
+	for name, value := range jobSpec.Outputs {
+		value, err := expr.Interpolate(value, exprCtx)
+		if err != nil {
+			log.Printf("Skipping job output %s: %v", name, err)
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if mask.mask(value) != value {
+			log.Printf("Skipping job output %s: it contains a secret", name)
+			continue
+		}
+		outputs[name] = value
+	}
+	return outputs
+}
+
+// runStep evaluates a step's condition, interpolates its expressions and
+// executes it. It returns the step's result, whose outcome is success,
+// failed, timed_out, cancelled or skipped. Steps that cannot be evaluated are
+// reported as failed.
+func (r *Runner) runStep(ctx context.Context, job *jobState, stepID uint, step types.StepSpec, exprCtx *expr.Context) (types.StepResult, error) {
+	// The env context holds the workflow, job and step env along with what
+	// earlier steps set
+	env, err := job.env.resolve(step.Env, exprCtx)
+	if err != nil {
+		return r.failStep(job, stepID, step, err)
+	}
+
+	values := make(map[string]interface{}, len(exprCtx.Values))
+	for key, value := range exprCtx.Values {
+		values[key] = value
+	}
+	stepEnvContext := make(map[string]interface{}, len(env))
+	for key, value := range env {
+		stepEnvContext[key] = value
+	}
+	values["env"] = stepEnvContext
+	stepCtx := &expr.Context{Values: values, Status: exprCtx.Status}
+
+	ok, err := expr.EvaluateCondition(step.If, stepCtx)
+	if err != nil {
+		return r.failStep(job, stepID, step, err)
+	}
+	if !ok {
+		log.Printf("Skipping step %s: condition %q is false", step.Name, step.If)
+		return r.finishStep(job, step, types.StepResult{StepID: stepID, Status: "skipped"}), nil
+	}
+
+	if step.Run, err = expr.Interpolate(step.Run, stepCtx); err != nil {
+		return r.failStep(job, stepID, step, fmt.Errorf("run: %v", err))
+	}
+	if step.With, err = expr.InterpolateMap(step.With, stepCtx); err != nil {
+		return r.failStep(job, stepID, step, fmt.Errorf("with: %v", err))
+	}
+
+	// Inputs are also exposed as INPUT_<NAME>, below the env
+	step.Env = inputEnv(exprCtx.Values["inputs"])
+	for key, value := range env {
+		step.Env[key] = value
+	}
+
+	return r.executeStep(ctx, job, stepID, step)
+}
+
+// inputEnv turns the inputs context into INPUT_<NAME> environment variables.
+// Names are upper-cased and anything but letters and digits becomes _.
+func inputEnv(inputs interface{}) map[string]string {
+	env := make(map[string]string)
+	values, _ := inputs.(map[string]interface{})
+	for name, value := range values {
+		key := strings.Map(func(c rune) rune {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+				return c
+			}
+			return '_'
+		}, strings.ToUpper(name))
+		env["INPUT_"+key] = expr.ToString(value)
+	}
+	return env
+}
+
+// failStep reports a step that failed before its command could be started
+func (r *Runner) failStep(job *jobState, stepID uint, step types.StepSpec, err error) (types.StepResult, error) {
+	now := time.Now().Format(time.RFC3339)
+	return r.finishStep(job, step, types.StepResult{
+		StepID:     stepID,
+		Status:     "failed",
+		Error:      err.Error(),
+		ExitCode:   1,
+		StartedAt:  now,
+		FinishedAt: now,
+	}), err
+}
+
+// stepConclusion is the result of a step as it counts for the job. With
+// continue-on-error, a failed or timed out step still concludes as success.
+func stepConclusion(step types.StepSpec, outcome string) string {
+	if step.Continue && (outcome == "failed" || outcome == "timed_out") {
+		return "success"
+	}
+	return outcome
 }
 
-func (r *Runner) executeStep(jobID, stepID uint, step types.StepSpec) error {
+// finishStep reports the final result of a step with its outcome and
+// conclusion, and returns it
+func (r *Runner) finishStep(job *jobState, step types.StepSpec, result types.StepResult) types.StepResult {
+	result.Outcome = result.Status
+	result.Conclusion = stepConclusion(step, result.Status)
+	r.reportStepResult(job, result)
+	return result
+}
+
+// executeStep runs a step's command. When the step timeout passes or ctx is
+// done, it is stopped along with everything it started: first with SIGTERM,
+// then with SIGKILL after killGracePeriod. The outputs the step writes to
+// $RELAYFORGE_OUTPUT are returned with its result, and what it writes to
+// $RELAYFORGE_ENV and $RELAYFORGE_PATH is kept for later steps.
+func (r *Runner) executeStep(ctx context.Context, job *jobState, stepID uint, step types.StepSpec) (types.StepResult, error) {
 	log.Printf("Executing step: %s", step.Name)
 	
 	if step.Run == "" {
-		return fmt.Errorf("no command specified for step")
+		return r.failStep(job, stepID, step, fmt.Errorf("no command specified for step"))
 	}
 
-	// Prepare command
-	cmd := exec.Command("sh", "-c", step.Run)
-	
-	// Set working directory if specified
+	var stepTimeout time.Duration
+	if step.Timeout != "" {
+		stepTimeout, _ = time.ParseDuration(step.Timeout)
+	}
+	stepCtx := ctx
+	if stepTimeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, stepTimeout)
+		defer cancel()
+	}
+
+	// Steps run in the job's workspace unless they set a directory inside it
+	dir := job.dirs.workspace
 	if step.WorkingDir != "" {
-		cmd.Dir = step.WorkingDir
+		var err error
+		if dir, err = workingDir(job.dirs.workspace, step.WorkingDir); err != nil {
+			return r.failStep(job, stepID, step, err)
+		}
+	}
+
+	files, err := createStepFiles(job.dirs.temp)
+	if err != nil {
+		return r.failStep(job, stepID, step, fmt.Errorf("failed to create step files: %v", err))
 	}
+	defer files.remove()
 
-	// Set environment variables
-	cmd.Env = os.Environ()
-	for key, value := range step.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	// The script is run from a file only this user can read: on the command
+	// line, the values interpolated into it, such as secrets, would show up in
+	// the process list
+	if err := os.WriteFile(files.script, []byte(step.Run), 0o600); err != nil {
+		return r.failStep(job, stepID, step, fmt.Errorf("failed to write the step's script: %v", err))
 	}
 
-	// Capture output
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Prepare command
+	cmd, release := job.executor.Command(stepCtx, files.script, dir, job.env.environ(step.Env, files), killGracePeriod)
+	cmd.WaitDelay = killGracePeriod + processWaitDelay
 
 	// Start step
 	startTime := time.Now()
-	r.reportStepResult(types.StepResult{
+	r.reportStepResult(job, types.StepResult{
 		StepID:    stepID,
 		Status:    "running",
 		StartedAt: startTime.Format(time.RFC3339),
 	})
 
+	// Stream output while the command runs
+	logs := r.streamLogs(job.id, stepID, job.mask)
+	cmd.Stdout = logs.writer("stdout")
+	cmd.Stderr = logs.writer("stderr")
+
 	// Execute command
-	err := cmd.Run()
+	err = cmd.Run()
+	release()
 	finishTime := time.Now()
+	logs.close()
 
-	// Prepare result
+	// Prepare result; the output has already been streamed
 	result := types.StepResult{
 		StepID:     stepID,
-		Output:     stdout.String(),
+		StartedAt:  startTime.Format(time.RFC3339),
 		FinishedAt: finishTime.Format(time.RFC3339),
 	}
 
-	if err != nil {
+	switch {
+	case errors.Is(stepCtx.Err(), context.DeadlineExceeded):
+		result.Status = "timed_out"
+		result.ExitCode = -1
+		if ctx.Err() != nil {
+			err = fmt.Errorf("step %q was killed when the job timed out", step.Name)
+		} else {
+			err = fmt.Errorf("step %q timed out after %s", step.Name, stepTimeout)
+		}
+		result.Error = err.Error()
+	case ctx.Err() != nil:
+		result.Status = "cancelled"
+		result.ExitCode = -1
+		err = fmt.Errorf("step %q was cancelled", step.Name)
+		result.Error = err.Error()
+	case err != nil:
 		result.Status = "failed"
-		result.Error = stderr.String()
+		result.Error = err.Error()
 		if exitError, ok := err.(*exec.ExitError); ok {
 			result.ExitCode = exitError.ExitCode()
 		} else {
 			result.ExitCode = 1
 		}
-	} else {
+	default:
 		result.Status = "success"
 		result.ExitCode = 0
 	}
 
-	// Report result
-	r.reportStepResult(result)
+	// Step files are read whatever the step's outcome
+	outputs, fileErr := readKeyValues(files.output)
+	if fileErr != nil {
+		fileErr = fmt.Errorf("invalid %s: %v", outputEnv, fileErr)
+	} else {
+		fileErr = job.env.absorb(files)
+	}
+	if fileErr != nil && err == nil {
+		result.Status = "failed"
+		result.ExitCode = 1
+		result.Error = fileErr.Error()
+		err = fileErr
+	}
+
+	// The server only gets masked outputs; later steps see the actual values
+	result.Outputs = make(map[string]string, len(outputs))
+	for name, value := range outputs {
+		result.Outputs[name] = job.mask.mask(value)
+	}
+	result = r.finishStep(job, step, result)
+	result.Outputs = outputs
 
-	return err
+	return result, err
 }
 
-func (r *Runner) reportJobResult(result types.JobResult) {
-	payload, _ := json.Marshal(result)
-	log.Printf("Reporting job result: %s", payload)
-	// In real implementation, this would POST to the API
+// reportJobResult reports a job's result. Its error may hold output of the
+// job's services or values it was given, such as secrets, so it is masked.
+func (r *Runner) reportJobResult(mask *masker, result types.JobResult) {
+	log.Printf("Reporting job %d result: %s", result.JobID, result.Status)
+	result.Error = mask.mask(result.Error)
+	r.report(fmt.Sprintf("/api/runners/%s/jobs/%d/result", r.ID, result.JobID), result)
 }
 
-func (r *Runner) reportStepResult(result types.StepResult) {
-	payload, _ := json.Marshal(result)
-	log.Printf("Reporting step result: %s", payload)
-	// In real implementation, this would POST to the API
+// reportStepResult reports a step's result. Its error may hold values the
+// step was given, such as secrets, so it is masked.
+func (r *Runner) reportStepResult(job *jobState, result types.StepResult) {
+	log.Printf("Reporting step %d result: %s", result.StepID, result.Status)
+	result.Error = job.mask.mask(result.Error)
+	r.report(fmt.Sprintf("/api/runners/%s/jobs/%d/steps/%d/result", r.ID, job.id, result.StepID), result)
+}
+
+// report posts a result to the API, retrying a few times on transient failures
+func (r *Runner) report(path string, result interface{}) {
+	for attempt := 1; attempt <= reportAttempts; attempt++ {
+		resp, err := r.apiRequest("POST", path, result)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			err = fmt.Errorf("%s: %s", resp.Status, body)
+			// Client errors will not succeed on retry
+			if resp.StatusCode < http.StatusInternalServerError {
+				log.Printf("Failed to report result to %s: %v", path, err)
+				return
+			}
+		}
+		log.Printf("Failed to report result to %s (attempt %d/%d): %v", path, attempt, reportAttempts, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// apiRequest sends an authenticated JSON request to the API server
+func (r *Runner) apiRequest(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewBuffer(payload)
+	}
+
+	req, err := http.NewRequest(method, r.ApiURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	return r.client.Do(req)
 }
 
 func getEnv(key, defaultValue string) string {
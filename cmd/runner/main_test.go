@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// newShellRunner returns a runner executing jobs on the host, a function
+// returning the step results it reported, in order, and one returning the
+// result reported for job 7
+func newShellRunner(t *testing.T) (*Runner, func() []types.StepResult, func() types.JobResult) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("steps run with sh")
+	}
+
+	var (
+		mu        sync.Mutex
+		results   []types.StepResult
+		jobResult types.JobResult
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(req.URL.Path, "/steps/") && strings.HasSuffix(req.URL.Path, "/result"):
+			var result types.StepResult
+			json.NewDecoder(req.Body).Decode(&result)
+			results = append(results, result)
+		case strings.HasSuffix(req.URL.Path, "/jobs/7/result"):
+			json.NewDecoder(req.Body).Decode(&jobResult)
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	r := &Runner{
+		ID:         "runner-1",
+		ApiURL:     server.URL,
+		BaseEnv:    os.Environ(),
+		WorkDir:    t.TempDir(),
+		client:     server.Client(),
+		activeJobs: make(map[uint]context.CancelFunc),
+	}
+	return r, func() []types.StepResult {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]types.StepResult(nil), results...)
+		}, func() types.JobResult {
+			mu.Lock()
+			defer mu.Unlock()
+			return jobResult
+		}
+}
+
+// finalResults returns the last result reported for each step
+func finalResults(results []types.StepResult) map[uint]types.StepResult {
+	final := make(map[uint]types.StepResult)
+	for _, result := range results {
+		if result.Status != "running" {
+			final[result.StepID] = result
+		}
+	}
+	return final
+}
+
+// stepStatuses returns the final status of each step by ID
+func stepStatuses(results []types.StepResult) map[uint]string {
+	statuses := make(map[uint]string)
+	for id, result := range finalResults(results) {
+		statuses[id] = result.Status
+	}
+	return statuses
+}
+
+// waitFor polls until ok returns true, failing the test after 10 seconds
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStepTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		jobTimeout string
+		step       types.StepSpec
+		wantStep   types.StepResult
+		wantAfter  string
+		wantJob    string
+	}{
+		{
+			name: "step timeout",
+			step: types.StepSpec{Name: "sleep", Run: "sleep 60", Timeout: "200ms"},
+			wantStep: types.StepResult{
+				Status: "timed_out", Outcome: "timed_out", Conclusion: "timed_out", ExitCode: -1,
+				Error: `step "sleep" timed out after 200ms`,
+			},
+			wantAfter: "skipped",
+			wantJob:   "failed",
+		},
+		{
+			name:       "job timeout",
+			jobTimeout: "300ms",
+			step:       types.StepSpec{Name: "sleep", Run: "sleep 60", Timeout: "1m"},
+			wantStep: types.StepResult{
+				Status: "timed_out", Outcome: "timed_out", Conclusion: "timed_out", ExitCode: -1,
+				Error: `step "sleep" was killed when the job timed out`,
+			},
+			wantJob: "timed_out",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, results, jobResult := newShellRunner(t)
+
+			start := time.Now()
+			r.executeJob(context.Background(), types.JobAssignment{
+				JobID: 7,
+				RunID: 1,
+				JobSpec: types.JobSpec{
+					Timeout: test.jobTimeout,
+					Steps:   []types.StepSpec{test.step, {Name: "after", Run: "true"}},
+				},
+				StepIDs: []uint{70, 71},
+			})
+
+			// sleep exits on SIGTERM, so the grace period is not waited out
+			if elapsed := time.Since(start); elapsed >= killGracePeriod {
+				t.Errorf("the job took %s to stop", elapsed)
+			}
+
+			final := finalResults(results())
+			got := final[70]
+			got.StepID, got.StartedAt, got.FinishedAt = 0, "", ""
+			if got.Status != test.wantStep.Status || got.Outcome != test.wantStep.Outcome ||
+				got.Conclusion != test.wantStep.Conclusion || got.ExitCode != test.wantStep.ExitCode ||
+				got.Error != test.wantStep.Error {
+				t.Errorf("got step result %+v, want %+v", got, test.wantStep)
+			}
+			if after, ok := final[71]; test.wantAfter == "" && ok {
+				t.Errorf("the step after the timeout reported %s, want it not run", after.Status)
+			} else if after.Status != test.wantAfter {
+				t.Errorf("the step after the timeout is %q, want %q", after.Status, test.wantAfter)
+			}
+			if status := jobResult().Status; status != test.wantJob {
+				t.Errorf("job status = %q, want %q", status, test.wantJob)
+			}
+		})
+	}
+}
+
+func TestStepConclusion(t *testing.T) {
+	tests := []struct {
+		outcome         string
+		continueOnError bool
+		want            string
+	}{
+		{"success", false, "success"},
+		{"failed", false, "failed"},
+		{"failed", true, "success"},
+		{"timed_out", false, "timed_out"},
+		{"timed_out", true, "success"},
+		{"cancelled", true, "cancelled"},
+		{"skipped", true, "skipped"},
+	}
+
+	for _, test := range tests {
+		if got := stepConclusion(types.StepSpec{Continue: test.continueOnError}, test.outcome); got != test.want {
+			t.Errorf("stepConclusion(continue-on-error %v, %q) = %q, want %q", test.continueOnError, test.outcome, got, test.want)
+		}
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	tests := []struct {
+		name            string
+		continueOnError bool
+		wantCheck       string
+		wantStatus      map[uint]string
+		wantJob         string
+	}{
+		{
+			name:            "continue-on-error",
+			continueOnError: true,
+			wantCheck:       "failed/success/yes",
+			wantStatus:      map[uint]string{70: "failed", 71: "success", 72: "skipped"},
+			wantJob:         "success",
+		},
+		{
+			name:            "failing step",
+			continueOnError: false,
+			wantStatus:      map[uint]string{70: "failed", 71: "skipped", 72: "success"},
+			wantJob:         "failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, results, jobResult := newShellRunner(t)
+
+			r.executeJob(context.Background(), types.JobAssignment{
+				JobID: 7,
+				RunID: 1,
+				JobSpec: types.JobSpec{
+					Steps: []types.StepSpec{
+						{ID: "flaky", Name: "flaky", Continue: test.continueOnError, Run: `echo partial=yes >> "$RELAYFORGE_OUTPUT"; exit 4`},
+						{Name: "check", Run: `echo "result=${{ steps.flaky.outcome }}/${{ steps.flaky.conclusion }}/${{ steps.flaky.outputs.partial }}" >> "$RELAYFORGE_OUTPUT"`},
+						{Name: "on failure", If: "failure()", Run: "true"},
+					},
+				},
+				StepIDs: []uint{70, 71, 72},
+			})
+
+			final := finalResults(results())
+			statuses := make(map[uint]string)
+			for id, result := range final {
+				statuses[id] = result.Status
+			}
+			if !reflect.DeepEqual(statuses, test.wantStatus) {
+				t.Errorf("got step statuses %v, want %v", statuses, test.wantStatus)
+			}
+
+			flaky := final[70]
+			wantConclusion := stepConclusion(types.StepSpec{Continue: test.continueOnError}, "failed")
+			if flaky.Outcome != "failed" || flaky.Conclusion != wantConclusion || flaky.ExitCode != 4 {
+				t.Errorf("got outcome %q, conclusion %q and exit code %d, want failed, %s and 4",
+					flaky.Outcome, flaky.Conclusion, flaky.ExitCode, wantConclusion)
+			}
+			// Outputs of a failed step are still kept
+			if flaky.Outputs["partial"] != "yes" {
+				t.Errorf("got outputs %v of the failed step", flaky.Outputs)
+			}
+			if got := final[71].Outputs["result"]; got != test.wantCheck {
+				t.Errorf("later steps see %q, want %q", got, test.wantCheck)
+			}
+			if status := jobResult().Status; status != test.wantJob {
+				t.Errorf("job status = %q, want %q", status, test.wantJob)
+			}
+		})
+	}
+}
+
+func TestStepTimeoutContinueOnError(t *testing.T) {
+	r, results, jobResult := newShellRunner(t)
+
+	r.executeJob(context.Background(), types.JobAssignment{
+		JobID: 7,
+		RunID: 1,
+		JobSpec: types.JobSpec{
+			Steps: []types.StepSpec{
+				{Name: "sleep", Run: "sleep 60", Timeout: "200ms", Continue: true},
+				{Name: "after", Run: "true"},
+			},
+		},
+		StepIDs: []uint{70, 71},
+	})
+
+	final := finalResults(results())
+	if got := final[70]; got.Status != "timed_out" || got.Outcome != "timed_out" || got.Conclusion != "success" {
+		t.Errorf("got status %q, outcome %q and conclusion %q, want timed_out, timed_out and success",
+			got.Status, got.Outcome, got.Conclusion)
+	}
+	if got := final[71].Status; got != "success" {
+		t.Errorf("the step after the timeout is %q, want success", got)
+	}
+	if status := jobResult().Status; status != "success" {
+		t.Errorf("job status = %q, want success", status)
+	}
+}
+
+func TestStepCancel(t *testing.T) {
+	r, results, jobResult := newShellRunner(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.executeJob(context.Background(), types.JobAssignment{
+			JobID: 7,
+			RunID: 1,
+			JobSpec: types.JobSpec{
+				Steps: []types.StepSpec{
+					{Name: "sleep", Run: "sleep 60"},
+					{Name: "next", Run: "true"},
+					{Name: "cleanup", If: "always()", Run: "true"},
+					{Name: "on cancel", If: "cancelled()", Run: "true"},
+					{Name: "on failure", If: "failure()", Run: "true"},
+				},
+			},
+			StepIDs: []uint{70, 71, 72, 73, 74},
+		})
+	}()
+
+	waitFor(t, "the step to start", func() bool { return len(results()) > 0 })
+	r.cancelJob(7)
+
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		t.Fatal("the step was not stopped by SIGTERM")
+	}
+
+	want := map[uint]string{70: "cancelled", 71: "skipped", 72: "success", 73: "success", 74: "skipped"}
+	if got := stepStatuses(results()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got step statuses %v, want %v", got, want)
+	}
+	if got := finalResults(results())[70]; got.ExitCode != -1 || got.Error != `step "sleep" was cancelled` {
+		t.Errorf("got cancelled step result %+v", got)
+	}
+	if result := jobResult(); result.Status != "cancelled" || result.Error != "run was cancelled" {
+		t.Errorf("got job result %s (%q), want cancelled", result.Status, result.Error)
+	}
+
+	// The job is no longer active, so cancelling it again does nothing
+	r.cancelJob(7)
+}
+
+func TestStepScriptNotInProcessList(t *testing.T) {
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("no /proc to read command lines from")
+	}
+	const secret = "hunter2-secret"
+	r, results, jobResult := newShellRunner(t)
+	out := t.TempDir()
+
+	r.executeJob(context.Background(), types.JobAssignment{
+		JobID: 7,
+		RunID: 1,
+		JobSpec: types.JobSpec{
+			Steps: []types.StepSpec{{
+				Name: "login",
+				Run: `test '${{ secrets.TOKEN }}' = "$EXPECTED" || exit 9
+tr '\0' ' ' < /proc/$$/cmdline > ` + out + `/cmdline
+ls -ln "$0" | cut -c1-10 > ` + out + `/mode`,
+				Env: map[string]string{"EXPECTED": secret},
+			}},
+		},
+		StepIDs:  []uint{70},
+		Contexts: map[string]interface{}{"secrets": map[string]interface{}{"TOKEN": secret}},
+	})
+
+	if status := jobResult().Status; status != "success" {
+		t.Fatalf("job status = %q, want the script to see the secret: %+v", status, results())
+	}
+	cmdline, err := os.ReadFile(filepath.Join(out, "cmdline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(cmdline), secret) || strings.Contains(string(cmdline), "secrets.TOKEN") {
+		t.Errorf("the step's command line %q holds its script", cmdline)
+	}
+	if mode, _ := os.ReadFile(filepath.Join(out, "mode")); strings.TrimSpace(string(mode)) != "-rw-------" {
+		t.Errorf("script file mode is %q, want it readable by the runner's user only", mode)
+	}
+}
+
+func TestJobOutputs(t *testing.T) {
+	const secret = "hunter2-secret"
+	exprCtx := &expr.Context{Values: map[string]interface{}{
+		"steps": map[string]interface{}{
+			"build": map[string]interface{}{
+				"outputs": map[string]interface{}{"version": "1.2.0", "token": secret, "empty": ""},
+			},
+		},
+		"matrix": map[string]interface{}{"os": "linux"},
+	}}
+
+	tests := []struct {
+		name    string
+		outputs map[string]string
+		want    map[string]string
+	}{
+		{name: "no outputs", outputs: nil, want: nil},
+		{
+			name: "step outputs",
+			outputs: map[string]string{
+				"version": "${{ steps.build.outputs.version }}",
+				"image":   "app:${{ steps.build.outputs.version }}-${{ matrix.os }}",
+			},
+			want: map[string]string{"version": "1.2.0", "image": "app:1.2.0-linux"},
+		},
+		{
+			name: "containing a secret",
+			outputs: map[string]string{
+				"token":   "${{ steps.build.outputs.token }}",
+				"header":  "Bearer ${{ steps.build.outputs.token }}",
+				"version": "${{ steps.build.outputs.version }}",
+			},
+			want: map[string]string{"version": "1.2.0"},
+		},
+		{
+			name:    "empty",
+			outputs: map[string]string{"empty": "${{ steps.build.outputs.empty }}", "missing": "${{ steps.test.outputs.version }}"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "invalid expression",
+			outputs: map[string]string{"broken": "${{ steps.build.outputs.version ==", "version": "${{ steps.build.outputs.version }}"},
+			want:    map[string]string{"version": "1.2.0"},
+		},
+	}
+
+	mask := newMasker(map[string]interface{}{"TOKEN": secret})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := jobOutputs(types.JobSpec{Outputs: test.outputs}, exprCtx, mask)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// addMaskCommand registers a value to redact when a step prints it at the
+// start of a line, e.g. echo "::add-mask::$TOKEN"
+const addMaskCommand = "::add-mask::"
+
+// minMaskLength keeps very short values from being masked, which would
+// garble the output without protecting anything
+const minMaskLength = 3
+
+const maskReplacement = "***"
+
+// masker redacts secret values from step output, along with their base64
+// and URL-escaped forms.
+type masker struct {
+	mu       sync.Mutex
+	values   map[string]bool
+	sorted   []string // longest first, so a secret wins over its substrings
+	replacer *strings.Replacer
+}
+
+// newMasker returns a masker for the secrets of a job
+func newMasker(secrets map[string]interface{}) *masker {
+	m := &masker{values: make(map[string]bool)}
+	for _, value := range secrets {
+		if s, ok := value.(string); ok {
+			m.add(s)
+		}
+	}
+	return m
+}
+
+// add registers a value to mask. Each line of a multi-line value is masked
+// on its own too, since output is processed line by line.
+func (m *masker) add(value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	candidates := []string{value}
+	for _, line := range strings.Split(value, "\n") {
+		candidates = append(candidates, strings.TrimSuffix(line, "\r"))
+	}
+
+	changed := false
+	for _, candidate := range candidates {
+		for _, form := range encodedForms(candidate) {
+			if len(strings.TrimSpace(form)) < minMaskLength || m.values[form] {
+				continue
+			}
+			m.values[form] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	m.sorted = m.sorted[:0]
+	for v := range m.values {
+		m.sorted = append(m.sorted, v)
+	}
+	sort.Slice(m.sorted, func(i, j int) bool {
+		if len(m.sorted[i]) != len(m.sorted[j]) {
+			return len(m.sorted[i]) > len(m.sorted[j])
+		}
+		return m.sorted[i] < m.sorted[j]
+	})
+
+	pairs := make([]string, 0, 2*len(m.sorted))
+	for _, v := range m.sorted {
+		pairs = append(pairs, v, maskReplacement)
+	}
+	m.replacer = strings.NewReplacer(pairs...)
+}
+
+// encodedForms returns a value as it may show up in output
+func encodedForms(value string) []string {
+	data := []byte(value)
+	return []string{
+		value,
+		base64.StdEncoding.EncodeToString(data),
+		base64.RawStdEncoding.EncodeToString(data),
+		base64.URLEncoding.EncodeToString(data),
+		base64.RawURLEncoding.EncodeToString(data),
+		url.QueryEscape(value),
+		url.PathEscape(value),
+	}
+}
+
+// mask redacts every registered value in a line of output
+func (m *masker) mask(line string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replacer == nil {
+		return line
+	}
+	return m.replacer.Replace(line)
+}
+
+// cut returns where to split output that is too long to wait for the end of
+// its line: at n, or earlier so that no registered value straddles the cut
+// and escapes masking.
+func (m *masker) cut(buf []byte, n int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cut := n
+	for _, v := range m.sorted {
+		start := n - len(v) + 1
+		if start < 0 {
+			start = 0
+		}
+		end := n + len(v) - 1
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if i := strings.Index(string(buf[start:end]), v); i >= 0 && start+i > 0 && start+i < cut {
+			cut = start + i
+		}
+	}
+	return cut
+}
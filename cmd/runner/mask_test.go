@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestMask(t *testing.T) {
+	const secret = "s3cr3t/p@ss word"
+
+	tests := []struct {
+		name    string
+		secrets map[string]interface{}
+		line    string
+		want    string
+	}{
+		{"plain", map[string]interface{}{"TOKEN": secret}, "token=" + secret + ".", "token=***."},
+		{"twice", map[string]interface{}{"TOKEN": secret}, secret + secret, "******"},
+		{"base64", map[string]interface{}{"TOKEN": secret}, base64.StdEncoding.EncodeToString([]byte(secret)), "***"},
+		{"raw base64", map[string]interface{}{"TOKEN": "abcd"}, base64.RawStdEncoding.EncodeToString([]byte("abcd")), "***"},
+		{"url-safe base64", map[string]interface{}{"TOKEN": "\xfb\xff\xfe"}, base64.URLEncoding.EncodeToString([]byte("\xfb\xff\xfe")), "***"},
+		{"query escaped", map[string]interface{}{"TOKEN": secret}, "?p=" + url.QueryEscape(secret), "?p=***"},
+		{"path escaped", map[string]interface{}{"TOKEN": secret}, "/" + url.PathEscape(secret), "/***"},
+		{"line of a multi-line value", map[string]interface{}{"KEY": "-----BEGIN-----\r\nbody-line\n-----END-----"}, "got body-line", "got ***"},
+		{"longest first", map[string]interface{}{"A": "abc", "B": "abcdef"}, "abcdefabc", "******"},
+		{"too short", map[string]interface{}{"TOKEN": "ab"}, "ab", "ab"},
+		{"not a string", map[string]interface{}{"TOKEN": 12345}, "12345", "12345"},
+		{"no secrets", nil, "plain output", "plain output"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newMasker(test.secrets).mask(test.line); got != test.want {
+				t.Errorf("mask(%q) = %q, want %q", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMaskCut(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		buf   string
+		n     int
+		want  int
+	}{
+		{"no values", "", "0123456789", 5, 5},
+		{"value elsewhere", "secret", "secret--------", 10, 10},
+		{"value ends at the cut", "secret", "--secret--", 8, 8},
+		{"value straddles the cut", "secret", "----secret", 6, 4},
+		{"value starts at the cut", "secret", "----secret", 4, 4},
+		{"value at the start", "secret", "secret----", 3, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMasker(nil)
+			if test.value != "" {
+				m.add(test.value)
+			}
+			if got := m.cut([]byte(test.buf), test.n); got != test.want {
+				t.Errorf("cut(%q, %d) = %d, want %d", test.buf, test.n, got, test.want)
+			}
+		})
+	}
+}
+
+// newLogRunner returns a runner whose server records the content of the log
+// lines and the step results it is sent
+func newLogRunner(t *testing.T) (*Runner, func() []string, func() []types.StepResult) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		lines   []string
+		results []types.StepResult
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/logs"):
+			var chunk types.LogChunk
+			json.NewDecoder(req.Body).Decode(&chunk)
+			for _, line := range chunk.Lines {
+				lines = append(lines, line.Content)
+			}
+		case strings.HasSuffix(req.URL.Path, "/result"):
+			var result types.StepResult
+			json.NewDecoder(req.Body).Decode(&result)
+			results = append(results, result)
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	r := &Runner{ID: "runner-1", ApiURL: server.URL, client: server.Client()}
+	return r, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), lines...)
+		}, func() []types.StepResult {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]types.StepResult(nil), results...)
+		}
+}
+
+func TestStreamLogsMask(t *testing.T) {
+	const secret = "hunter2-secret"
+	long := strings.Repeat("x", maxLogLineLength-3)
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "whole line",
+			chunks: []string{"password is " + secret + "\n"},
+			want:   []string{"password is ***"},
+		},
+		{
+			name:   "split across writes",
+			chunks: []string{"password is hunt", "er2-sec", "ret\n"},
+			want:   []string{"password is ***"},
+		},
+		{
+			name:   "unterminated last line",
+			chunks: []string{"a\n" + secret},
+			want:   []string{"a", "***"},
+		},
+		{
+			name:   "crlf",
+			chunks: []string{secret + "\r\n"},
+			want:   []string{"***"},
+		},
+		{
+			name:   "long line cut before the secret",
+			chunks: []string{long + secret, "\n"},
+			want:   []string{long, "***"},
+		},
+		{
+			name:   "add-mask",
+			chunks: []string{"before value-added\n", "::add-mask:: value-added \n", "after value-added\n"},
+			want:   []string{"before value-added", "::add-mask:: *** ", "after ***"},
+		},
+		{
+			name:   "add-mask split across writes",
+			chunks: []string{"::add-", "mask::value-", "added\nvalue-added\n"},
+			want:   []string{"::add-mask::***", "***"},
+		},
+		{
+			name:   "add-mask not at the start of a line",
+			chunks: []string{"echo ::add-mask::value-added\nvalue-added\n"},
+			want:   []string{"echo ::add-mask::value-added", "value-added"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, lines, _ := newLogRunner(t)
+			mask := newMasker(map[string]interface{}{"TOKEN": secret})
+
+			logs := r.streamLogs(7, 70, mask)
+			w := logs.writer("stdout")
+			for _, chunk := range test.chunks {
+				w.Write([]byte(chunk))
+			}
+			logs.close()
+
+			if got := lines(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got lines %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReportStepResultMasksError(t *testing.T) {
+	r, _, results := newLogRunner(t)
+	job := &jobState{id: 7, mask: newMasker(map[string]interface{}{"TOKEN": "hunter2-secret"})}
+
+	r.failStep(job, 70, types.StepSpec{Name: "deploy"}, errors.New("login as hunter2-secret failed"))
+
+	got := results()
+	if len(got) != 1 {
+		t.Fatalf("got %d step results, want 1", len(got))
+	}
+	if got[0].Error != "login as *** failed" {
+		t.Errorf("reported error %q, want it masked", got[0].Error)
+	}
+}
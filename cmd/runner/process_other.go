@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup is a no-op where process groups are not available;
+// cancelling the command kills the shell itself right away.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	return func() {}
+}
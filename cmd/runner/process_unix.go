@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup runs the command in a process group of its own. Cancelling
+// the command sends SIGTERM to the whole group and SIGKILL once grace has
+// passed, so processes started by the step's shell do not outlive it. The
+// returned function must be called once the command has been waited for.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cancelWithGrace(cmd, grace, func(sig syscall.Signal) error {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	})
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processExited reports whether pid has exited. A child whose parent has
+// exited may linger as a zombie until it is reaped, which counts as exited.
+func processExited(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	_, state, _ := strings.Cut(string(stat), ") ")
+	return err == nil && strings.HasPrefix(state, "Z")
+}
+
+func TestSetProcessGroup(t *testing.T) {
+	const grace = 200 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		script   string
+		wantKill bool
+	}{
+		{"children exit on SIGTERM", `sleep 60 & echo $! > "$PID_FILE"; wait`, false},
+		{"children ignoring SIGTERM are killed", `trap '' TERM; sleep 60 & echo $! > "$PID_FILE"; wait`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "child.pid")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cmd := exec.CommandContext(ctx, "sh", "-c", test.script)
+			cmd.Env = append(os.Environ(), "PID_FILE="+pidFile)
+			release := setProcessGroup(cmd, grace)
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			var child int
+			waitFor(t, "the child to start", func() bool {
+				data, _ := os.ReadFile(pidFile)
+				_, err := fmt.Sscan(string(data), &child)
+				return err == nil
+			})
+
+			start := time.Now()
+			cancel()
+			err := cmd.Wait()
+			release()
+			elapsed := time.Since(start)
+
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("got %v, want the shell to be killed", err)
+			}
+			wantSignal := syscall.SIGTERM
+			if test.wantKill {
+				wantSignal = syscall.SIGKILL
+			}
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); !ok || status.Signal() != wantSignal {
+				t.Errorf("the shell exited with %v, want it stopped by %v", exitErr, wantSignal)
+			}
+			if killed := elapsed >= grace; killed != test.wantKill {
+				t.Errorf("the shell stopped after %s with a grace period of %s", elapsed, grace)
+			}
+			waitFor(t, "the child to exit", func() bool { return processExited(child) })
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+const (
+	// defaultHealthInterval is how often a service is checked until it is ready
+	defaultHealthInterval = 2 * time.Second
+	// defaultHealthRetries is how many failed checks a service gets
+	defaultHealthRetries = 30
+	// serviceHost is where steps on the host reach published service ports
+	serviceHost = "127.0.0.1"
+)
+
+// service is a container running alongside a job's steps
+type service struct {
+	name      string // also its hostname on the job's network
+	container string
+	image     string
+	env       map[string]string
+	ports     []string
+	health    *types.HealthCheckSpec
+	addresses map[string]string // port steps reach each container port on
+}
+
+// jobServices runs the service containers of a job on a network of their
+// own. Steps in a job container reach the services by name on that network;
+// steps on the host reach them through ports published on localhost.
+type jobServices struct {
+	cli      *containerCLI
+	network  string
+	onHost   bool
+	services []*service
+	started  []string // containers to remove
+	created  bool     // whether the network is to be removed
+}
+
+// newServices prepares the services a job declares, interpolating their
+// image and env. A job without services gets an empty set.
+func (r *Runner) newServices(jobSpec types.JobSpec, dirs *jobDirs, exprCtx *expr.Context) (*jobServices, error) {
+	if len(jobSpec.Services) == 0 {
+		return &jobServices{}, nil
+	}
+
+	prefix := "relayforge-" + filepath.Base(dirs.root)
+	s := &jobServices{
+		cli:     newContainerCLI(r.ContainerCLI),
+		network: prefix,
+		onHost:  jobSpec.Container == nil,
+	}
+
+	names := make([]string, 0, len(jobSpec.Services))
+	for name := range jobSpec.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := jobSpec.Services[name]
+		image, err := expr.Interpolate(spec.Image, exprCtx)
+		if err != nil {
+			return nil, fmt.Errorf("service %s image: %v", name, err)
+		}
+		env, err := expr.InterpolateMap(spec.Env, exprCtx)
+		if err != nil {
+			return nil, fmt.Errorf("service %s env: %v", name, err)
+		}
+		s.services = append(s.services, &service{
+			name:      name,
+			container: prefix + "-" + name,
+			image:     image,
+			env:       env,
+			ports:     spec.Ports,
+			health:    spec.HealthCheck,
+			addresses: make(map[string]string),
+		})
+	}
+	return s, nil
+}
+
+// Start starts the services and waits until all of them are ready
+func (s *jobServices) Start(ctx context.Context) error {
+	if len(s.services) == 0 {
+		return nil
+	}
+
+	if _, err := s.cli.run(ctx, nil, "network", "create", s.network); err != nil {
+		return fmt.Errorf("failed to create network for services: %v", err)
+	}
+	s.created = true
+
+	for _, svc := range s.services {
+		if err := s.startService(ctx, svc); err != nil {
+			return err
+		}
+	}
+	for _, svc := range s.services {
+		if err := s.waitReady(ctx, svc); err != nil {
+			return err
+		}
+		if err := s.resolvePorts(ctx, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jobServices) startService(ctx context.Context, svc *service) error {
+	args := []string{"run", "--detach", "--name", svc.container, "--network", s.network, "--network-alias", svc.name}
+	if s.onHost {
+		for _, port := range svc.ports {
+			host, container, err := types.ParsePort(port)
+			if err != nil {
+				return fmt.Errorf("service %s: %v", svc.name, err)
+			}
+			args = append(args, "--publish", serviceHost+":"+host+":"+container)
+		}
+	}
+	args = append(args, envArgs(svc.env)...)
+	args = append(args, svc.image)
+
+	s.started = append(s.started, svc.container)
+	if _, err := s.cli.run(ctx, svc.env, args...); err != nil {
+		return fmt.Errorf("failed to start service %s from %s: %v", svc.name, svc.image, err)
+	}
+	return nil
+}
+
+// waitReady waits until a service is ready: until its health check command
+// succeeds, or else until the health check of its image passes. A service
+// without either is ready once it runs.
+func (s *jobServices) waitReady(ctx context.Context, svc *service) error {
+	interval := defaultHealthInterval
+	retries := defaultHealthRetries
+	if svc.health != nil {
+		if d, err := time.ParseDuration(svc.health.Interval); err == nil && d > 0 {
+			interval = d
+		}
+		if svc.health.Retries > 0 {
+			retries = svc.health.Retries
+		}
+	}
+
+	var lastErr error
+	for failures := 0; ; {
+		state, err := s.cli.run(ctx, nil, "inspect", "--format", "{{.State.Status}} {{if .State.Health}}{{.State.Health.Status}}{{end}}", svc.container)
+		if err != nil {
+			return fmt.Errorf("failed to inspect service %s: %v", svc.name, err)
+		}
+		status, health, _ := strings.Cut(state, " ")
+		if status != "running" {
+			logs, _ := s.cli.run(ctx, nil, "logs", "--tail", "20", svc.container)
+			return fmt.Errorf("service %s is %s: %s", svc.name, status, logs)
+		}
+
+		switch {
+		case svc.health != nil:
+			if _, lastErr = s.cli.run(ctx, nil, "exec", svc.container, "sh", "-c", svc.health.Command); lastErr == nil {
+				return nil
+			}
+			failures++
+			if failures >= retries {
+				return fmt.Errorf("service %s did not become healthy: %v", svc.name, lastErr)
+			}
+		case health == "" || health == "healthy":
+			return nil
+		case health == "unhealthy":
+			return fmt.Errorf("service %s is unhealthy", svc.name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("service %s did not become healthy: %v", svc.name, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// resolvePorts finds where steps reach each port of a service: on the
+// published host port for steps on the host, on the port itself for steps
+// on the service network
+func (s *jobServices) resolvePorts(ctx context.Context, svc *service) error {
+	for _, port := range svc.ports {
+		_, container, err := types.ParsePort(port)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", svc.name, err)
+		}
+		number := strings.TrimSuffix(strings.TrimSuffix(container, "/tcp"), "/udp")
+		if !s.onHost {
+			svc.addresses[number] = number
+			continue
+		}
+
+		out, err := s.cli.run(ctx, nil, "port", svc.container, container)
+		if err != nil {
+			return fmt.Errorf("failed to find port %s of service %s: %v", container, svc.name, err)
+		}
+		// One line per address, such as 127.0.0.1:49153
+		line, _, _ := strings.Cut(out, "\n")
+		svc.addresses[number] = line[strings.LastIndex(line, ":")+1:]
+	}
+	return nil
+}
+
+// Context returns the services context: the host and ports steps reach each
+// service on, e.g. services.postgres.ports['5432']
+func (s *jobServices) Context() map[string]interface{} {
+	services := make(map[string]interface{}, len(s.services))
+	for _, svc := range s.services {
+		host := svc.name
+		if s.onHost {
+			host = serviceHost
+		}
+		ports := make(map[string]interface{}, len(svc.addresses))
+		for port, address := range svc.addresses {
+			ports[port] = address
+		}
+		services[svc.name] = map[string]interface{}{
+			"host":  host,
+			"ports": ports,
+		}
+	}
+	return services
+}
+
+// Stop removes the services and their network, however the job went
+func (s *jobServices) Stop() {
+	for _, container := range s.started {
+		s.cli.remove("rm", "--force", "--volumes", container)
+	}
+	if s.created {
+		s.cli.remove("network", "rm", s.network)
+	}
+}
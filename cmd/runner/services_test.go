@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// countCalls returns a health check command that fails until it has been run
+// n times
+func countCalls(t *testing.T, n int) string {
+	count := filepath.Join(t.TempDir(), "count")
+	return "echo >> " + count + `; [ "$(wc -l < ` + count + `)" -ge ` + strconv.Itoa(n) + " ]"
+}
+
+func TestServiceWaitReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		health  string // of the image
+		logs    string
+		check   func(t *testing.T) *types.HealthCheckSpec
+		timeout time.Duration
+		wantErr string
+		// wantExecs is how often the health check command ran
+		wantExecs int
+	}{
+		{name: "running"},
+		{name: "image healthy", health: "healthy"},
+		{name: "image unhealthy", health: "unhealthy", wantErr: "service db is unhealthy"},
+		{
+			name:    "image starting",
+			health:  "starting",
+			timeout: 100 * time.Millisecond,
+			wantErr: "service db did not become healthy: context deadline exceeded",
+		},
+		{name: "exited", state: "exited", logs: "FATAL: role missing", wantErr: "service db is exited: FATAL: role missing"},
+		{
+			name: "health check passes",
+			check: func(t *testing.T) *types.HealthCheckSpec {
+				return &types.HealthCheckSpec{Command: countCalls(t, 3), Interval: "10ms", Retries: 5}
+			},
+			wantExecs: 3,
+		},
+		{
+			name: "health check before the image's",
+			// The health check command decides, not the image
+			health: "unhealthy",
+			check: func(t *testing.T) *types.HealthCheckSpec {
+				return &types.HealthCheckSpec{Command: "true"}
+			},
+			wantExecs: 1,
+		},
+		{
+			name: "health check out of retries",
+			check: func(t *testing.T) *types.HealthCheckSpec {
+				return &types.HealthCheckSpec{Command: "echo not ready; exit 1", Interval: "10ms", Retries: 2}
+			},
+			wantErr:   "service db did not become healthy: ",
+			wantExecs: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, stubDir, _ := newStubRunner(t)
+			t.Setenv("STUB_STATE", test.state)
+			t.Setenv("STUB_HEALTH", test.health)
+			t.Setenv("STUB_LOGS", test.logs)
+			s := &jobServices{cli: newContainerCLI(r.ContainerCLI)}
+			svc := &service{name: "db", container: "relayforge-7-db"}
+			if test.check != nil {
+				svc.health = test.check(t)
+			}
+
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			err := s.waitReady(ctx, svc)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("waitReady failed: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)):
+				t.Fatalf("waitReady error = %v, want %q", err, test.wantErr)
+			}
+
+			execs := 0
+			for _, call := range readInvocations(t, stubDir) {
+				if call.args[0] == "exec" {
+					execs++
+					if want := []string{"exec", svc.container, "sh", "-c", svc.health.Command}; !reflect.DeepEqual(call.args, want) {
+						t.Errorf("exec args = %q, want %q", call.args, want)
+					}
+				}
+			}
+			if execs != test.wantExecs {
+				t.Errorf("health check ran %d times, want %d", execs, test.wantExecs)
+			}
+		})
+	}
+}
+
+func TestServiceResolvePorts(t *testing.T) {
+	ports := []string{"5432", "8080:80", "53/udp"}
+
+	tests := []struct {
+		name      string
+		onHost    bool
+		want      map[string]interface{}
+		wantCalls [][]string
+	}{
+		{
+			name:   "steps on the host",
+			onHost: true,
+			want: map[string]interface{}{
+				"host":  "127.0.0.1",
+				"ports": map[string]interface{}{"5432": "15432", "80": "180", "53": "153"},
+			},
+			wantCalls: [][]string{
+				{"port", "relayforge-7-db", "5432"},
+				{"port", "relayforge-7-db", "80"},
+				{"port", "relayforge-7-db", "53/udp"},
+			},
+		},
+		{
+			name: "steps on the service network",
+			want: map[string]interface{}{
+				"host":  "db",
+				"ports": map[string]interface{}{"5432": "5432", "80": "80", "53": "53"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, stubDir, _ := newStubRunner(t)
+			svc := &service{name: "db", container: "relayforge-7-db", ports: ports, addresses: map[string]string{}}
+			s := &jobServices{cli: newContainerCLI(r.ContainerCLI), onHost: test.onHost, services: []*service{svc}}
+
+			if err := s.resolvePorts(context.Background(), svc); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Context()["db"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("services.db = %v, want %v", got, test.want)
+			}
+
+			var calls [][]string
+			for _, call := range readInvocations(t, stubDir) {
+				calls = append(calls, call.args)
+			}
+			if !reflect.DeepEqual(calls, test.wantCalls) {
+				t.Errorf("CLI calls = %q, want %q", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestServiceResolvePortsInvalid(t *testing.T) {
+	r, _, _ := newStubRunner(t)
+	svc := &service{name: "db", container: "relayforge-7-db", ports: []string{"postgres"}, addresses: map[string]string{}}
+	s := &jobServices{cli: newContainerCLI(r.ContainerCLI), onHost: true, services: []*service{svc}}
+
+	err := s.resolvePorts(context.Background(), svc)
+	if err == nil || !strings.HasPrefix(err.Error(), "service db: invalid port") {
+		t.Errorf("resolvePorts error = %v, want an invalid port error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Variables naming the files a step writes to
+const (
+	outputEnv = "RELAYFORGE_OUTPUT" // name=value outputs of the step
+	envEnv    = "RELAYFORGE_ENV"    // name=value variables for later steps
+	pathEnv   = "RELAYFORGE_PATH"   // directories to prepend to PATH for later steps
+)
+
+// maxStepFileSize bounds how much of a step file is read
+const maxStepFileSize = 1 << 20
+
+// stepFiles are the files a step uses to pass values on, along with the
+// script it runs
+type stepFiles struct {
+	dir    string
+	output string
+	env    string
+	path   string
+	script string
+}
+
+// createStepFiles creates empty step files in a directory of their own
+// under parent
+func createStepFiles(parent string) (*stepFiles, error) {
+	dir, err := os.MkdirTemp(parent, "step-")
+	if err != nil {
+		return nil, err
+	}
+
+	files := &stepFiles{
+		dir:    dir,
+		output: filepath.Join(dir, "output"),
+		env:    filepath.Join(dir, "env"),
+		path:   filepath.Join(dir, "path"),
+		script: filepath.Join(dir, "script"),
+	}
+	for _, name := range []string{files.output, files.env, files.path, files.script} {
+		if err := os.WriteFile(name, nil, 0o600); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// environ returns the variables that point the step to its files
+func (f *stepFiles) environ() []string {
+	return []string{outputEnv + "=" + f.output, envEnv + "=" + f.env, pathEnv + "=" + f.path}
+}
+
+func (f *stepFiles) remove() {
+	os.RemoveAll(f.dir)
+}
+
+// readStepFile reads a step file, refusing files that grew too large
+func readStepFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxStepFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxStepFileSize {
+		return "", fmt.Errorf("file is larger than %d bytes", maxStepFileSize)
+	}
+	return string(data), nil
+}
+
+// readKeyValues parses a file of values written by a step. Each value is
+// either a name=value line or, for values spanning several lines,
+//
+//	name<<DELIMITER
+//	...
+//	DELIMITER
+//
+// Later values of the same name replace earlier ones.
+func readKeyValues(path string) (map[string]string, error) {
+	data, err := readStepFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStepFileSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if name, delimiter, ok := strings.Cut(text, "<<"); ok && !strings.Contains(name, "=") {
+			start := line
+			var value []string
+			closed := false
+			for scanner.Scan() {
+				line++
+				valueLine := strings.TrimSuffix(scanner.Text(), "\r")
+				if valueLine == delimiter {
+					closed = true
+					break
+				}
+				value = append(value, valueLine)
+			}
+			if !closed {
+				return nil, fmt.Errorf("line %d: missing delimiter %q for %q", start, delimiter, name)
+			}
+			if name == "" || delimiter == "" {
+				return nil, fmt.Errorf("line %d: expected name<<DELIMITER", start)
+			}
+			values[name] = strings.Join(value, "\n")
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected name=value or name<<DELIMITER", line)
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// readPaths parses a file of directories, one per line
+func readPaths(path string) ([]string, error) {
+	data, err := readStepFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(data, "\n") {
+		if dir := strings.TrimSpace(line); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeStepFile writes content to a file in a new temporary directory
+func writeStepFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadKeyValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "empty file", content: "", want: map[string]string{}},
+		{name: "blank lines", content: "\n  \n\r\n", want: map[string]string{}},
+		{name: "values", content: "a=1\nb=two words\n", want: map[string]string{"a": "1", "b": "two words"}},
+		{name: "no trailing newline", content: "a=1", want: map[string]string{"a": "1"}},
+		{name: "crlf", content: "a=1\r\nb=2\r\n", want: map[string]string{"a": "1", "b": "2"}},
+		{name: "empty value", content: "a=\n", want: map[string]string{"a": ""}},
+		{name: "value with =", content: "url=https://x?a=b\n", want: map[string]string{"url": "https://x?a=b"}},
+		{name: "value with <<", content: "cmd=cat <<EOF\n", want: map[string]string{"cmd": "cat <<EOF"}},
+		{name: "later value wins", content: "a=1\na=2\n", want: map[string]string{"a": "2"}},
+		{
+			name:    "heredoc",
+			content: "notes<<EOF\nfirst line\n\nlast=line\nEOF\nafter=1\n",
+			want:    map[string]string{"notes": "first line\n\nlast=line", "after": "1"},
+		},
+		{name: "empty heredoc", content: "notes<<END\nEND\n", want: map[string]string{"notes": ""}},
+		{name: "heredoc with crlf", content: "notes<<EOF\r\na\r\nEOF\r\n", want: map[string]string{"notes": "a"}},
+		{name: "delimiter must match the whole line", content: "notes<<EOF\n EOF\nEOFX\nEOF\n", want: map[string]string{"notes": " EOF\nEOFX"}},
+		{name: "missing delimiter", content: "a=1\nnotes<<EOF\nnever closed\n", wantErr: `line 2: missing delimiter "EOF" for "notes"`},
+		{name: "missing delimiter at the end", content: "notes<<EOF", wantErr: `line 1: missing delimiter "EOF" for "notes"`},
+		{name: "heredoc without a name", content: "<<EOF\nx\nEOF\n", wantErr: "line 1: expected name<<DELIMITER"},
+		{name: "heredoc without a delimiter", content: "notes<<\nx\n\n", wantErr: "line 1: expected name<<DELIMITER"},
+		{name: "no =", content: "a=1\njust text\n", wantErr: "line 2: expected name=value or name<<DELIMITER"},
+		{name: "no name", content: "=value\n", wantErr: "line 1: expected name=value or name<<DELIMITER"},
+		{name: "line after a heredoc", content: "n<<EOF\nx\nEOF\nbad\n", wantErr: "line 4: expected name=value or name<<DELIMITER"},
+		{name: "too large", content: "a=" + strings.Repeat("x", maxStepFileSize), wantErr: "file is larger than 1048576 bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readKeyValues(writeStepFile(t, test.content))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadKeyValuesMissingFile(t *testing.T) {
+	if _, err := readKeyValues(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty file", "", nil},
+		{"one per line", "/opt/a/bin\n/opt/b/bin\n", []string{"/opt/a/bin", "/opt/b/bin"}},
+		{"blank lines and spaces", "\n  /opt/a/bin  \r\n\n", []string{"/opt/a/bin"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readPaths(writeStepFile(t, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateStepFiles(t *testing.T) {
+	parent := t.TempDir()
+	files, err := createStepFiles(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(files.dir) != parent {
+		t.Errorf("step files are in %s, want a directory in %s", files.dir, parent)
+	}
+	for _, path := range []string{files.output, files.env, files.path, files.script} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 || info.Mode().Perm() != 0o600 || filepath.Dir(path) != files.dir {
+			t.Errorf("%s has mode %v and size %d, want an empty private file", path, info.Mode(), info.Size())
+		}
+	}
+	want := []string{
+		outputEnv + "=" + files.output,
+		envEnv + "=" + files.env,
+		pathEnv + "=" + files.path,
+	}
+	if got := files.environ(); !reflect.DeepEqual(got, want) {
+		t.Errorf("environ() = %q, want %q", got, want)
+	}
+
+	files.remove()
+	if _, err := os.Stat(files.dir); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed: %v", files.dir, err)
+	}
+}
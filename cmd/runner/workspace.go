@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// workspaceEnv names the job's workspace directory in the step environment
+const workspaceEnv = "RELAYFORGE_WORKSPACE"
+
+func defaultWorkDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "relayforge", "work")
+}
+
+// jobDirs are the directories of a job under the runner's work root
+type jobDirs struct {
+	root      string // holds the others and is removed with them
+	hostRoot  string // root on the host that runs job containers
+	workspace string // where the steps run
+	temp      string // step files
+}
+
+// createJobDirs creates a fresh, empty workspace for a job under the
+// runner's work root. The paths have their symbolic links resolved.
+func (r *Runner) createJobDirs(jobID uint) (*jobDirs, error) {
+	if err := os.MkdirAll(r.WorkDir, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := os.MkdirTemp(r.WorkDir, fmt.Sprintf("job-%d-", jobID))
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	dirs := &jobDirs{
+		root:      root,
+		hostRoot:  root,
+		workspace: filepath.Join(root, "workspace"),
+		temp:      filepath.Join(root, "temp"),
+	}
+	if r.HostWorkDir != "" {
+		dirs.hostRoot = filepath.Join(r.HostWorkDir, filepath.Base(root))
+	}
+	for _, dir := range []string{dirs.workspace, dirs.temp} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			os.RemoveAll(root)
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+func (d *jobDirs) remove() error {
+	return os.RemoveAll(d.root)
+}
+
+// workingDir resolves a step's working-directory. Relative paths are taken
+// from the workspace; paths that lead outside of it, also by way of symbolic
+// links, are refused.
+func workingDir(workspace, dir string) (string, error) {
+	path := dir
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workspace, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("working-directory %q: %v", dir, err)
+	}
+	rel, err := filepath.Rel(workspace, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("working-directory %q is outside the job's workspace", dir)
+	}
+	return resolved, nil
+}
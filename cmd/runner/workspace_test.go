@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkingDir(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace := filepath.Join(root, "workspace")
+	for _, dir := range []string{"sub/dir", "../outside"} {
+		if err := os.MkdirAll(filepath.Join(workspace, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "outside"), filepath.Join(workspace, "escape")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	if err := os.Symlink("sub/dir", filepath.Join(workspace, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir  string
+		want string // path relative to the workspace
+		err  string
+	}{
+		{dir: ".", want: "."},
+		{dir: "sub", want: "sub"},
+		{dir: "sub/dir", want: "sub/dir"},
+		{dir: "sub/dir/..", want: "sub"},
+		{dir: "link", want: "sub/dir"},
+		{dir: filepath.Join(workspace, "sub"), want: "sub"},
+		{dir: "..", err: "outside the job's workspace"},
+		{dir: "sub/../..", err: "outside the job's workspace"},
+		{dir: "../outside", err: "outside the job's workspace"},
+		{dir: "/etc", err: "outside the job's workspace"},
+		{dir: "escape", err: "outside the job's workspace"},
+		{dir: "missing", err: "no such file or directory"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.dir, func(t *testing.T) {
+			got, err := workingDir(workspace, test.dir)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("workingDir(%q) = %q, %v; want an error containing %q", test.dir, got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("workingDir(%q): %v", test.dir, err)
+			}
+			if want := filepath.Join(workspace, test.want); got != want {
+				t.Errorf("workingDir(%q) = %q, want %q", test.dir, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/lockb0x-llc/relayforge/internal/logstream"
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+const (
+	// logBacklogBatch is how many stored entries are loaded at a time when a
+	// client catches up
+	logBacklogBatch = 500
+	// pongWait is how long a log stream client may stay silent; it is pinged
+	// well within that time
+	pongWait     = 60 * time.Second
+	pingInterval = pongWait * 9 / 10
+	writeWait    = 10 * time.Second
+	// sseKeepAlive is how often an idle event stream gets a comment, so that
+	// proxies do not close it
+	sseKeepAlive = 15 * time.Second
+	// logReorderWindow is how much later than entries with higher IDs an
+	// entry may still be stored: the jobs of a run store their logs in
+	// transactions of their own, which commit out of ID order
+	logReorderWindow = 10 * time.Second
+	// logSeenEntries is how many delivered entry IDs a follower remembers, so
+	// that catching up on a gap does not send entries twice
+	logSeenEntries = 4096
+	// defaultLogPage and maxLogPage bound the entries returned per page
+	defaultLogPage = 500
+	maxLogPage     = 5000
+)
+
+// logFilter selects the log entries a client follows. Zero values match
+// everything.
+type logFilter struct {
+	JobID  uint
+	StepID uint
+	Levels map[string]bool
+}
+
+// parseLogFilter reads the job, step and level query parameters. level may
+// list several levels separated by commas.
+func parseLogFilter(c *gin.Context) logFilter {
+	jobID, _ := strconv.ParseUint(c.Query("job"), 10, 64)
+	stepID, _ := strconv.ParseUint(c.Query("step"), 10, 64)
+
+	filter := logFilter{JobID: uint(jobID), StepID: uint(stepID)}
+	if level := c.Query("level"); level != "" {
+		filter.Levels = make(map[string]bool)
+		for _, l := range strings.Split(level, ",") {
+			filter.Levels[strings.TrimSpace(l)] = true
+		}
+	}
+	return filter
+}
+
+func (f logFilter) matches(entry types.LogEntry) bool {
+	return (f.JobID == 0 || entry.JobID == f.JobID) &&
+		(f.StepID == 0 || entry.StepID == f.StepID) &&
+		(f.Levels == nil || f.Levels[entry.Level])
+}
+
+// logFollower delivers the logs of a run to one client: first the stored
+// entries after a given ID, then new entries as they are stored. Entries may
+// be stored out of ID order, so the follower remembers which entries it sent
+// rather than only the highest ID.
+type logFollower struct {
+	store  logstream.Store
+	hub    *logstream.Hub
+	runID  uint
+	lastID uint // highest ID delivered
+	filter logFilter
+	send   func(types.LogEntry) error
+
+	seen   map[uint]bool
+	order  []uint           // seen IDs, oldest first
+	recent []deliveredEntry // entries delivered within logReorderWindow
+}
+
+type deliveredEntry struct {
+	id uint
+	at time.Time
+}
+
+// deliver sends an entry the client has not seen yet if it passes the filter.
+// An entry older than one already delivered means others in that gap may
+// have been missed too, so the gap is caught up on from the database.
+func (f *logFollower) deliver(entry types.LogEntry) error {
+	if f.seen[entry.ID] {
+		return nil
+	}
+	if entry.ID < f.lastID {
+		return f.catchUp(entry.ID - 1)
+	}
+	return f.deliverNew(entry)
+}
+
+func (f *logFollower) deliverNew(entry types.LogEntry) error {
+	if f.seen[entry.ID] {
+		return nil
+	}
+	if f.filter.matches(entry) {
+		if err := f.send(entry); err != nil {
+			return err
+		}
+	}
+
+	if f.seen == nil {
+		f.seen = make(map[uint]bool)
+	}
+	f.seen[entry.ID] = true
+	f.order = append(f.order, entry.ID)
+	if len(f.order) > logSeenEntries {
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+
+	now := time.Now()
+	for len(f.recent) > 0 && now.Sub(f.recent[0].at) > logReorderWindow {
+		f.recent = f.recent[1:]
+	}
+	f.recent = append(f.recent, deliveredEntry{id: entry.ID, at: now})
+
+	if entry.ID > f.lastID {
+		f.lastID = entry.ID
+	}
+	return nil
+}
+
+// catchUp delivers the stored entries after afterID that were not sent yet
+func (f *logFollower) catchUp(afterID uint) error {
+	for {
+		entries, err := f.store.RunLogs(f.runID, afterID, logBacklogBatch)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := f.deliverNew(entry); err != nil {
+				return err
+			}
+			afterID = entry.ID
+		}
+		if len(entries) < logBacklogBatch {
+			return nil
+		}
+	}
+}
+
+// cursor returns an ID to resume from without missing entries: the entries
+// delivered within logReorderWindow may still be followed by older ones, so
+// the cursor stays behind them. Resuming from it may repeat those entries.
+func (f *logFollower) cursor() uint {
+	cursor := f.lastID
+	now := time.Now()
+	for _, delivered := range f.recent {
+		if now.Sub(delivered.at) <= logReorderWindow && delivered.id-1 < cursor {
+			cursor = delivered.id - 1
+		}
+	}
+	return cursor
+}
+
+// subscribe subscribes to new entries and then catches up from the database,
+// so that nothing stored in between is missed
+func (f *logFollower) subscribe() (*logstream.Subscription, error) {
+	sub := f.hub.Subscribe(f.runID)
+	if err := f.catchUp(f.lastID); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// follow delivers entries until done is closed or sending fails. keepAlive is
+// called every interval.
+func (f *logFollower) follow(done <-chan struct{}, interval time.Duration, keepAlive func() error) error {
+	sub, err := f.subscribe()
+	if err != nil {
+		return err
+	}
+	defer func() { sub.Close() }()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case entry, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind; catch up from the database
+				if sub, err = f.subscribe(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := f.deliver(entry); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := keepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// runForUser checks that the current user owns a run, answering 404 otherwise
+func (s *Server) runForUser(c *gin.Context, runID int) bool {
+	user := c.MustGet("user").(*models.User)
+
+	var run models.Run
+	if err := s.db.Where("id = ? AND user_id = ?", runID, user.ID).First(&run).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return false
+	}
+	return true
+}
+
+// streamLogs follows the logs of a run over a WebSocket. The stored entries
+// after the ID given by ?since= are sent first, then new entries as they are
+// stored.
+func (s *Server) streamLogs(c *gin.Context) {
+	runID, _ := strconv.Atoi(c.Param("runId"))
+	since, _ := strconv.ParseUint(c.Query("since"), 10, 64)
+
+	// Verify user has access to this run
+	if !s.runForUser(c, runID) {
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// The client sends nothing but control frames; reading processes them and
+	// notices when it goes away
+	closed := make(chan struct{})
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	follower := &logFollower{
+		store:  s.workflow,
+		hub:    s.logs.Hub,
+		runID:  uint(runID),
+		lastID: uint(since),
+		filter: parseLogFilter(c),
+		send: func(entry types.LogEntry) error {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			return conn.WriteJSON(entry)
+		},
+	}
+	err = follower.follow(closed, pingInterval, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+	})
+	if err != nil {
+		log.Printf("Log stream for run %d ended: %v", runID, err)
+	}
+}
+
+// streamRunLogs follows the logs of a run as Server-Sent Events, for clients
+// that cannot use WebSockets. Each event carries a resume cursor as its ID, so
+// a client resumes with the Last-Event-ID header (or ?since=) after
+// reconnecting.
+func (s *Server) streamRunLogs(c *gin.Context) {
+	runID, _ := strconv.Atoi(c.Param("id"))
+	sinceParam := c.GetHeader("Last-Event-ID")
+	if sinceParam == "" {
+		sinceParam = c.Query("since")
+	}
+	since, _ := strconv.ParseUint(sinceParam, 10, 64)
+
+	if !s.runForUser(c, runID) {
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // keep nginx from buffering events
+	c.Status(http.StatusOK)
+	flusher.Flush()
+
+	var follower *logFollower
+	follower = &logFollower{
+		store:  s.workflow,
+		hub:    s.logs.Hub,
+		runID:  uint(runID),
+		lastID: uint(since),
+		filter: parseLogFilter(c),
+		send: func(entry types.LogEntry) error {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			// The entry is not delivered yet, so the cursor cannot pass it
+			cursor := follower.cursor()
+			if entry.ID-1 < cursor {
+				cursor = entry.ID - 1
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: log\ndata: %s\n\n", cursor, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		},
+	}
+	err := follower.follow(c.Request.Context().Done(), sseKeepAlive, func() error {
+		if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Log event stream for run %d ended: %v", runID, err)
+	}
+}
+
+// getJobLogs returns the logs of a job. As JSON (the default) they are paged:
+// ?cursor= takes the next_cursor of the previous page and ?limit= sets the page
+// size. ?format=text or ?format=gzip downloads the whole log as a plain-text
+// file, compressed for gzip. ?step= selects the logs of one step.
+func (s *Server) getJobLogs(c *gin.Context) {
+	runID, _ := strconv.Atoi(c.Param("id"))
+	jobID, _ := strconv.Atoi(c.Param("jobId"))
+	stepID, _ := strconv.ParseUint(c.Query("step"), 10, 64)
+	user := c.MustGet("user").(*models.User)
+
+	job, err := s.workflow.GetRunJob(uint(runID), uint(jobID), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLogPage)))
+		if err != nil || limit < 1 || limit > maxLogPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxLogPage)})
+			return
+		}
+
+		// Fetch one entry more than asked to know whether there is a next page
+		entries, err := s.workflow.JobLogs(job, uint(stepID), uint(cursor), limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		nextCursor := ""
+		if len(entries) > limit {
+			entries = entries[:limit]
+			nextCursor = strconv.FormatUint(uint64(entries[limit-1].ID), 10)
+		}
+		c.JSON(http.StatusOK, gin.H{"logs": entries, "next_cursor": nextCursor})
+
+	case "text", "gzip":
+		filename := fmt.Sprintf("run-%d-job-%d.log", runID, jobID)
+		var w io.Writer = c.Writer
+		if format == "gzip" {
+			filename += ".gz"
+			c.Header("Content-Type", "application/gzip")
+			gz := gzip.NewWriter(c.Writer)
+			defer gz.Close()
+			w = gz
+		} else {
+			c.Header("Content-Type", "text/plain; charset=utf-8")
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+
+		// Stream the log in pages rather than loading it all at once
+		buf := bufio.NewWriter(w)
+		defer buf.Flush()
+		afterID := uint(0)
+		for {
+			entries, err := s.workflow.JobLogs(job, uint(stepID), afterID, maxLogPage)
+			if err != nil {
+				// Headers are already sent; all that is left is to cut the download short
+				log.Printf("Log download for job %d failed: %v", jobID, err)
+				return
+			}
+			for _, entry := range entries {
+				fmt.Fprintf(buf, "%s %s\n", entry.Timestamp, strings.TrimSuffix(entry.Content, "\n"))
+				afterID = entry.ID
+			}
+			if len(entries) < maxLogPage {
+				return
+			}
+		}
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, text or gzip"})
+	}
+}
@@ -0,0 +1,584 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/lockb0x-llc/relayforge/internal/logstream"
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/internal/workflow"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// memoryLogStore holds the committed log entries of run 1
+type memoryLogStore struct {
+	mu      sync.Mutex
+	entries []types.LogEntry
+}
+
+// commit stores entries and returns them, as a transaction committing them does
+func (s *memoryLogStore) commit(ids ...uint) []types.LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var committed []types.LogEntry
+	for _, id := range ids {
+		entry := types.LogEntry{ID: id, RunID: 1, JobID: 1, StepID: 1, Level: "info"}
+		s.entries = append(s.entries, entry)
+		committed = append(committed, entry)
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].ID < s.entries[j].ID })
+	return committed
+}
+
+func (s *memoryLogStore) RunLogs(runID, afterID uint, limit int) ([]types.LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []types.LogEntry
+	for _, entry := range s.entries {
+		if entry.RunID == runID && entry.ID > afterID && len(entries) < limit {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// newTestFollower returns a follower of run 1 from lastID and the IDs it sent
+func newTestFollower(store logstream.Store, lastID uint) (*logFollower, *[]uint) {
+	var sent []uint
+	return &logFollower{
+		store:  store,
+		hub:    logstream.NewHub(),
+		runID:  1,
+		lastID: lastID,
+		send: func(entry types.LogEntry) error {
+			sent = append(sent, entry.ID)
+			return nil
+		},
+	}, &sent
+}
+
+func TestLogFollowerOutOfOrder(t *testing.T) {
+	store := &memoryLogStore{}
+	store.commit(1, 2, 3)
+
+	f, sent := newTestFollower(store, 0)
+	if err := f.catchUp(f.lastID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 commits before 4, and both are published more than once, e.g. by the
+	// hub and again after a NOTIFY from another replica
+	five := store.commit(5)[0]
+	four := store.commit(4)[0]
+	for _, entry := range []types.LogEntry{five, four, five, four} {
+		if err := f.deliver(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []uint{1, 2, 3, 5, 4}; !reflect.DeepEqual(*sent, want) {
+		t.Fatalf("sent %v, want %v", *sent, want)
+	}
+
+	// Entries delivered a while ago can no longer be followed by older ones;
+	// the cursor stays behind the recent ones
+	for i := range f.recent {
+		if f.recent[i].id <= 3 {
+			f.recent[i].at = f.recent[i].at.Add(-2 * logReorderWindow)
+		}
+	}
+	cursor := f.cursor()
+	if cursor != 3 {
+		t.Fatalf("cursor = %d, want 3", cursor)
+	}
+
+	// A client resuming from the cursor gets everything after it, including
+	// what was stored in the meantime
+	store.commit(6)
+	resumed, resent := newTestFollower(store, cursor)
+	if err := resumed.catchUp(resumed.lastID); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{4, 5, 6}; !reflect.DeepEqual(*resent, want) {
+		t.Errorf("resumed follower sent %v, want %v", *resent, want)
+	}
+}
+
+func TestLogFollowerFollow(t *testing.T) {
+	store := &memoryLogStore{}
+	store.commit(1, 2)
+
+	var (
+		mu   sync.Mutex
+		sent []uint
+	)
+	f := &logFollower{
+		store: store,
+		hub:   logstream.NewHub(),
+		runID: 1,
+		send: func(entry types.LogEntry) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, entry.ID)
+			return nil
+		},
+	}
+	sentIDs := func() []uint {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint(nil), sent...)
+	}
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(sentIDs()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("sent %v, waiting for %d entries", sentIDs(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- f.follow(done, time.Hour, func() error { return nil })
+	}()
+	waitFor(2)
+
+	f.hub.Publish(store.commit(4))
+	waitFor(3)
+	f.hub.Publish(store.commit(3))
+	f.hub.Publish([]types.LogEntry{{ID: 4, RunID: 1}})
+	f.hub.Publish(store.commit(5))
+	waitFor(5)
+
+	close(done)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{1, 2, 4, 3, 5}; !reflect.DeepEqual(sentIDs(), want) {
+		t.Errorf("sent %v, want %v", sentIDs(), want)
+	}
+}
+
+// testDB connects to the Postgres database named by
+// RELAYFORGE_TEST_DATABASE_URL, skipping the test when it is not set
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("RELAYFORGE_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("RELAYFORGE_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Workflow{}, &models.Run{},
+		&models.Job{}, &models.Step{}, &models.Log{}, &models.Runner{}, &models.RunnerToken{}, &models.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// logFixture is a running job with two steps, leased to a runner, and a
+// server whose log routes act on behalf of the job's owner
+type logFixture struct {
+	server   *Server
+	url      string
+	user     *models.User
+	run      *models.Run
+	job      *models.Job
+	steps    []models.Step
+	runnerID string
+}
+
+func newLogFixture(t *testing.T) *logFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := testDB(t)
+
+	id := time.Now().UnixNano()
+	f := &logFixture{runnerID: fmt.Sprintf("runner-%d", id)}
+	f.user = &models.User{GitHubID: id, Username: fmt.Sprintf("test-%d", id)}
+	if err := db.Create(f.user).Error; err != nil {
+		t.Fatal(err)
+	}
+	wf := &models.Workflow{UserID: f.user.ID, Name: t.Name(), IsActive: true}
+	if err := db.Create(wf).Error; err != nil {
+		t.Fatal(err)
+	}
+	f.run = &models.Run{WorkflowID: wf.ID, UserID: f.user.ID, Status: "running"}
+	if err := db.Create(f.run).Error; err != nil {
+		t.Fatal(err)
+	}
+	leaseExpiresAt := time.Now().Add(time.Hour)
+	f.job = &models.Job{RunID: f.run.ID, Name: "build", Key: "build", Status: "running",
+		RunnerID: f.runnerID, LeaseExpiresAt: &leaseExpiresAt}
+	if err := db.Create(f.job).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"compile", "test"} {
+		step := models.Step{JobID: f.job.ID, Name: name, Status: "running"}
+		if err := db.Create(&step).Error; err != nil {
+			t.Fatal(err)
+		}
+		f.steps = append(f.steps, step)
+	}
+	// Nothing of the run is left for the reaper or runners of later tests
+	t.Cleanup(func() {
+		db.Model(&models.Job{}).Where("id = ?", f.job.ID).Update("status", "cancelled")
+		db.Model(&models.Run{}).Where("id = ?", f.run.ID).Update("status", "cancelled")
+	})
+
+	workflowService := workflow.NewService(db)
+	broker := logstream.NewBroker(db, workflowService)
+	workflowService.SetLogPublisher(broker)
+	f.server = &Server{db: db, workflow: workflowService, logs: broker}
+
+	router := gin.New()
+	api := router.Group("/api", func(c *gin.Context) { c.Set("user", f.user) })
+	api.GET("/runs/:id/logs/stream", f.server.streamRunLogs)
+	api.GET("/runs/:id/jobs/:jobId/logs", f.server.getJobLogs)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	f.url = server.URL + "/api"
+	return f
+}
+
+// appendLogs stores lines first to last of a step as the runner streams them
+func (f *logFixture) appendLogs(t *testing.T, step int, stream string, first, last int64) {
+	t.Helper()
+	var lines []types.LogLine
+	for sequence := first; sequence <= last; sequence++ {
+		lines = append(lines, types.LogLine{
+			Sequence:  sequence,
+			Stream:    stream,
+			Content:   fmt.Sprintf("%s %s %d", f.steps[step].Name, stream, sequence),
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+		})
+	}
+	if err := f.server.workflow.AppendStepLogs(f.runnerID, f.job.ID, f.steps[step].ID, lines); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// logEvent is a Server-Sent Event of the log stream
+type logEvent struct {
+	id    uint
+	event string
+	entry types.LogEntry
+}
+
+// openLogStream requests the log event stream of the fixture's run with query
+// and headers, and returns a function reading its next event. Keep-alive
+// comments are skipped.
+func (f *logFixture) openLogStream(t *testing.T, query string, header http.Header) func() logEvent {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/runs/%d/logs/stream?%s", f.url, f.run.ID, query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %s with content type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	return func() logEvent {
+		t.Helper()
+		var event logEvent
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading the event stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "":
+				if event.event != "" {
+					return event
+				}
+			case "id":
+				id, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					t.Fatalf("event id %q: %v", value, err)
+				}
+				event.id = uint(id)
+			case "event":
+				event.event = value
+			case "data":
+				if err := json.Unmarshal([]byte(value), &event.entry); err != nil {
+					t.Fatalf("event data %q: %v", value, err)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamRunLogs(t *testing.T) {
+	f := newLogFixture(t)
+	f.appendLogs(t, 0, "stdout", 1, 3)
+
+	next := f.openLogStream(t, "", nil)
+	var events []logEvent
+	for i := 0; i < 3; i++ {
+		events = append(events, next())
+	}
+	// Lines stored while the client is connected follow
+	f.appendLogs(t, 1, "stderr", 1, 1)
+	events = append(events, next())
+
+	wantContents := []string{"compile stdout 1", "compile stdout 2", "compile stdout 3", "test stderr 1"}
+	var contents []string
+	var cursor uint
+	for i, event := range events {
+		contents = append(contents, event.entry.Content)
+		if event.event != "log" || event.entry.RunID != f.run.ID || event.entry.JobID != f.job.ID {
+			t.Errorf("event %d is %+v", i, event)
+		}
+		// Resuming from an event's ID never skips the entry it carries
+		if event.id >= event.entry.ID || event.id < cursor {
+			t.Errorf("event %d for entry %d has ID %d after %d", i, event.entry.ID, event.id, cursor)
+		}
+		cursor = event.id
+	}
+	if !reflect.DeepEqual(contents, wantContents) {
+		t.Errorf("got %q, want %q", contents, wantContents)
+	}
+	if events[3].entry.Level != "error" || events[3].entry.StepID != f.steps[1].ID {
+		t.Errorf("got stderr entry %+v", events[3].entry)
+	}
+
+	// A client reconnecting with Last-Event-ID gets the entries after it,
+	// and ?since= is only used without it
+	second := events[1].entry.ID
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		want   []string
+	}{
+		{"Last-Event-ID", "", http.Header{"Last-Event-ID": {fmt.Sprint(second)}}, wantContents[2:]},
+		{"since", fmt.Sprintf("since=%d", second), nil, wantContents[2:]},
+		{"Last-Event-ID over since", "since=0", http.Header{"Last-Event-ID": {fmt.Sprint(second)}}, wantContents[2:]},
+		{"level filter", "level=error", nil, wantContents[3:]},
+		{"step filter", fmt.Sprintf("step=%d", f.steps[0].ID), nil, wantContents[:3]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := f.openLogStream(t, test.query, test.header)
+			var got []string
+			for range test.want {
+				got = append(got, next().entry.Content)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamRunLogsOtherUser(t *testing.T) {
+	f := newLogFixture(t)
+	f.user = &models.User{ID: f.user.ID + 1}
+
+	resp, err := http.Get(fmt.Sprintf("%s/runs/%d/logs/stream", f.url, f.run.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s, want 404", resp.Status)
+	}
+}
+
+// getJobLogs requests the logs of the fixture's job with query, and returns
+// the response and its body
+func (f *logFixture) getJobLogs(t *testing.T, query string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("%s/runs/%d/jobs/%d/logs?%s", f.url, f.run.ID, f.job.ID, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestGetJobLogsPages(t *testing.T) {
+	f := newLogFixture(t)
+	f.appendLogs(t, 0, "stdout", 1, 3)
+	f.appendLogs(t, 1, "stderr", 1, 2)
+	all := []string{"compile stdout 1", "compile stdout 2", "compile stdout 3", "test stderr 1", "test stderr 2"}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantPages [][]string
+	}{
+		{"one page", "", [][]string{all}},
+		{"pages of two", "limit=2", [][]string{all[:2], all[2:4], all[4:]}},
+		{"limit of the page size", "limit=5", [][]string{all}},
+		{"one step", fmt.Sprintf("step=%d&limit=2", f.steps[1].ID), [][]string{all[3:]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pages [][]string
+			query := test.query
+			for {
+				resp, body := f.getJobLogs(t, query)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("got %s: %s", resp.Status, body)
+				}
+				var page struct {
+					Logs       []types.LogEntry `json:"logs"`
+					NextCursor string           `json:"next_cursor"`
+				}
+				if err := json.Unmarshal(body, &page); err != nil {
+					t.Fatal(err)
+				}
+				var contents []string
+				for _, entry := range page.Logs {
+					contents = append(contents, entry.Content)
+				}
+				pages = append(pages, contents)
+
+				if page.NextCursor == "" {
+					break
+				}
+				if len(pages) > len(test.wantPages) {
+					t.Fatalf("got more than %d pages: %q", len(test.wantPages), pages)
+				}
+				// The cursor is the ID of the last entry of the page
+				if want := fmt.Sprint(page.Logs[len(page.Logs)-1].ID); page.NextCursor != want {
+					t.Errorf("next cursor = %q, want %q", page.NextCursor, want)
+				}
+				query = test.query + "&cursor=" + page.NextCursor
+			}
+			if !reflect.DeepEqual(pages, test.wantPages) {
+				t.Errorf("got pages %q, want %q", pages, test.wantPages)
+			}
+		})
+	}
+}
+
+func TestGetJobLogsDownload(t *testing.T) {
+	f := newLogFixture(t)
+	f.appendLogs(t, 0, "stdout", 1, 2)
+	f.appendLogs(t, 1, "stderr", 1, 1)
+	want := []string{"compile stdout 1", "compile stdout 2", "test stderr 1"}
+
+	filename := fmt.Sprintf("run-%d-job-%d.log", f.run.ID, f.job.ID)
+	resp, text := f.getJobLogs(t, "format=text")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %s", resp.Status, text)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("text content type = %q", got)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%q", filename); got != want {
+		t.Errorf("text content disposition = %q, want %q", got, want)
+	}
+
+	// Each line is the entry's timestamp and content
+	lines := strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got lines %q, want %d", lines, len(want))
+	}
+	for i, line := range lines {
+		timestamp, content, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil || content != want[i] {
+			t.Errorf("line %d is %q, want a timestamp and %q", i, line, want[i])
+		}
+	}
+
+	resp, compressed := f.getJobLogs(t, "format=gzip")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %s", resp.Status, compressed)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/gzip" {
+		t.Errorf("gzip content type = %q", got)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%q", filename+".gz"); got != want {
+		t.Errorf("gzip content disposition = %q, want %q", got, want)
+	}
+	gz, err := gzip.NewReader(strings.NewReader(string(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != string(text) {
+		t.Errorf("gzip download is %q, want the text download %q", decompressed, text)
+	}
+}
+
+func TestGetJobLogsInvalid(t *testing.T) {
+	f := newLogFixture(t)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"invalid cursor", "cursor=abc", http.StatusBadRequest},
+		{"negative cursor", "cursor=-1", http.StatusBadRequest},
+		{"zero limit", "limit=0", http.StatusBadRequest},
+		{"limit too large", fmt.Sprintf("limit=%d", maxLogPage+1), http.StatusBadRequest},
+		{"unknown format", "format=xml", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if resp, body := f.getJobLogs(t, test.query); resp.StatusCode != test.wantStatus {
+				t.Errorf("got %s: %s, want %d", resp.Status, body, test.wantStatus)
+			}
+		})
+	}
+
+	// The job of another user's run is not found
+	f.user = &models.User{ID: f.user.ID + 1}
+	if resp, body := f.getJobLogs(t, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s: %s for another user, want 404", resp.Status, body)
+	}
+}
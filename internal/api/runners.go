@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/internal/workflow"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// Runner job protocol handlers
+
+func (s *Server) acquireJob(c *gin.Context) {
+	runner := c.MustGet("runner").(*models.Runner)
+
+	assignment, err := s.workflow.AcquireJob(runner)
+	if errors.Is(err, workflow.ErrNoJobAvailable) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"assignment": assignment})
+}
+
+func (s *Server) renewJobLease(c *gin.Context) {
+	runnerID := c.Param("id")
+	jobID, _ := strconv.Atoi(c.Param("jobId"))
+
+	lease, err := s.workflow.RenewLease(runnerID, uint(jobID))
+	if err != nil {
+		s.runnerProtocolError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"lease": lease})
+}
+
+func (s *Server) reportJobResult(c *gin.Context) {
+	runnerID := c.Param("id")
+	jobID, _ := strconv.Atoi(c.Param("jobId"))
+
+	var result types.JobResult
+	if err := c.ShouldBindJSON(&result); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result.JobID = uint(jobID)
+
+	if err := s.workflow.RecordJobResult(runnerID, result); err != nil {
+		s.runnerProtocolError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job result recorded"})
+}
+
+func (s *Server) reportStepResult(c *gin.Context) {
+	runnerID := c.Param("id")
+	jobID, _ := strconv.Atoi(c.Param("jobId"))
+	stepID, _ := strconv.Atoi(c.Param("stepId"))
+
+	var result types.StepResult
+	if err := c.ShouldBindJSON(&result); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result.StepID = uint(stepID)
+
+	if err := s.workflow.RecordStepResult(runnerID, uint(jobID), result); err != nil {
+		s.runnerProtocolError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Step result recorded"})
+}
+
+func (s *Server) appendStepLogs(c *gin.Context) {
+	runnerID := c.Param("id")
+	jobID, _ := strconv.Atoi(c.Param("jobId"))
+	stepID, _ := strconv.Atoi(c.Param("stepId"))
+
+	var chunk types.LogChunk
+	if err := c.ShouldBindJSON(&chunk); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.workflow.AppendStepLogs(runnerID, uint(jobID), uint(stepID), chunk.Lines); err != nil {
+		s.runnerProtocolError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logs recorded"})
+}
+
+// runnerProtocolError maps workflow service errors to HTTP responses
+func (s *Server) runnerProtocolError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, workflow.ErrLeaseNotHeld):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, workflow.ErrInvalidStatus), errors.Is(err, workflow.ErrInvalidLogs):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, workflow.ErrRunnerNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) runnerHeartbeat(c *gin.Context) {
+	runnerID := c.Param("id")
+
+	var heartbeat types.RunnerHeartbeat
+	if err := c.ShouldBindJSON(&heartbeat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := s.workflow.Heartbeat(runnerID, heartbeat)
+	if err != nil {
+		s.runnerProtocolError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
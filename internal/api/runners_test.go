@@ -0,0 +1,44 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/workflow"
+)
+
+func TestRunnerProtocolError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "lease not held", err: workflow.ErrLeaseNotHeld, want: http.StatusConflict},
+		{name: "wrapped lease not held", err: fmt.Errorf("job 7: %w", workflow.ErrLeaseNotHeld), want: http.StatusConflict},
+		{name: "invalid status", err: fmt.Errorf("%w: %q", workflow.ErrInvalidStatus, "done"), want: http.StatusBadRequest},
+		{name: "invalid logs", err: workflow.ErrInvalidLogs, want: http.StatusBadRequest},
+		{name: "unknown runner", err: workflow.ErrRunnerNotFound, want: http.StatusNotFound},
+		{name: "unknown step", err: gorm.ErrRecordNotFound, want: http.StatusNotFound},
+		{name: "other", err: errors.New("connection refused"), want: http.StatusInternalServerError},
+	}
+
+	s := &Server{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			s.runnerProtocolError(c, test.err)
+			if w.Code != test.want {
+				t.Errorf("got status %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
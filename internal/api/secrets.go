@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/internal/secrets"
+)
+
+// Secret handlers serve both scopes: /api/secrets for the user's own secrets
+// and /api/workflows/:id/secrets for those of one workflow. Values can be
+// written but are never returned.
+
+func (s *Server) listSecrets(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	workflowID, ok := s.secretScope(c)
+	if !ok {
+		return
+	}
+
+	list, err := s.secrets.List(user.ID, workflowID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secrets": list})
+}
+
+func (s *Server) setSecret(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	workflowID, ok := s.secretScope(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Value string `json:"value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, err := s.secrets.Set(user.ID, workflowID, c.Param("name"), req.Value)
+	if errors.Is(err, secrets.ErrInvalidName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret})
+}
+
+func (s *Server) deleteSecret(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	workflowID, ok := s.secretScope(c)
+	if !ok {
+		return
+	}
+
+	if err := s.secrets.Delete(user.ID, workflowID, c.Param("name")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Secret not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Secret deleted"})
+}
+
+// secretScope returns the workflow whose secrets a request is about, 0 for
+// the user's own secrets. It answers the request itself and returns false
+// when secrets are disabled or the workflow is not the user's.
+func (s *Server) secretScope(c *gin.Context) (uint, bool) {
+	if s.secrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Secrets are disabled: SECRETS_MASTER_KEY is not set"})
+		return 0, false
+	}
+
+	if c.Param("id") == "" {
+		return 0, true
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	user := c.MustGet("user").(*models.User)
+	var workflow models.Workflow
+	if err := s.db.Where("id = ? AND user_id = ?", id, user.ID).First(&workflow).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return 0, false
+	}
+	return workflow.ID, true
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,7 +18,9 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/lockb0x-llc/relayforge/internal/auth"
+	"github.com/lockb0x-llc/relayforge/internal/logstream"
 	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/internal/secrets"
 	"github.com/lockb0x-llc/relayforge/internal/workflow"
 	"github.com/lockb0x-llc/relayforge/pkg/types"
 )
@@ -25,6 +30,10 @@ type Server struct {
 	router   *gin.Engine
 	auth     *auth.AuthService
 	workflow *workflow.Service
+	logs     *logstream.Broker
+	secrets  *secrets.Store // nil when no master key is configured
+	reaper   workflow.ReaperConfig
+	admins   map[string]bool
 	upgrader websocket.Upgrader
 }
 
@@ -46,7 +55,7 @@ func NewServer() *Server {
 
 	// Auto-migrate models
 	err = db.AutoMigrate(&models.User{}, &models.Workflow{}, &models.Run{}, 
-		&models.Job{}, &models.Step{}, &models.Log{}, &models.Runner{})
+		&models.Job{}, &models.Step{}, &models.Log{}, &models.Runner{}, &models.RunnerToken{}, &models.Secret{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
@@ -59,6 +68,24 @@ func NewServer() *Server {
 	)
 
 	workflowService := workflow.NewService(db)
+	logBroker := logstream.NewBroker(db, workflowService)
+	workflowService.SetLogPublisher(logBroker)
+	go logBroker.Listen(dsn)
+
+	var secretStore *secrets.Store
+	if masterKey := getEnv("SECRETS_MASTER_KEY", ""); masterKey != "" {
+		secretStore, err = secrets.NewStore(db, masterKey)
+		if err != nil {
+			log.Fatal("Invalid SECRETS_MASTER_KEY: ", err)
+		}
+		workflowService.SetSecrets(secretStore)
+	} else {
+		log.Println("SECRETS_MASTER_KEY is not set: secrets are disabled")
+	}
+	if getEnv("WORKFLOW_EXECUTOR", "runner") == "simulation" {
+		log.Println("Using simulation executor: jobs will not be sent to runners")
+		workflowService.SetExecutor(workflow.NewSimulationExecutor(workflowService, 2*time.Second))
+	}
 
 	router := gin.Default()
 	
@@ -81,6 +108,10 @@ func NewServer() *Server {
 		router:   router,
 		auth:     authService,
 		workflow: workflowService,
+		logs:     logBroker,
+		secrets:  secretStore,
+		reaper:   reaperConfig(),
+		admins:   adminUsers(),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for demo
@@ -113,19 +144,54 @@ func (s *Server) setupRoutes() {
 		// Workflows
 		api.GET("/workflows", s.getWorkflows)
 		api.POST("/workflows", s.createWorkflow)
+		api.POST("/workflows/validate", s.validateWorkflow)
 		api.GET("/workflows/:id", s.getWorkflow)
 		api.PUT("/workflows/:id", s.updateWorkflow)
 		api.DELETE("/workflows/:id", s.deleteWorkflow)
 
+		// Secrets
+		api.GET("/secrets", s.listSecrets)
+		api.PUT("/secrets/:name", s.setSecret)
+		api.DELETE("/secrets/:name", s.deleteSecret)
+		api.GET("/workflows/:id/secrets", s.listSecrets)
+		api.PUT("/workflows/:id/secrets/:name", s.setSecret)
+		api.DELETE("/workflows/:id/secrets/:name", s.deleteSecret)
+
 		// Runs
 		api.GET("/workflows/:id/runs", s.getWorkflowRuns)
 		api.POST("/workflows/:id/runs", s.createRun)
 		api.GET("/runs/:id", s.getRun)
 		api.POST("/runs/:id/cancel", s.cancelRun)
+		api.GET("/runs/:id/logs/stream", s.streamRunLogs)
+		api.GET("/runs/:id/jobs/:jobId/logs", s.getJobLogs)
 
 		// Runners
 		api.GET("/runners", s.getRunners)
-		api.POST("/runners/register", s.registerRunner)
+	}
+
+	// Admin routes
+	admin := s.router.Group("/api/admin")
+	admin.Use(s.authMiddleware(), s.adminMiddleware())
+	{
+		admin.GET("/runner-tokens", s.getRunnerTokens)
+		admin.POST("/runner-tokens", s.createRunnerToken)
+		admin.DELETE("/runner-tokens/:id", s.revokeRunnerToken)
+		admin.DELETE("/runners/:id", s.revokeRunner)
+	}
+
+	// Runner registration is authenticated by a one-time registration token
+	s.router.POST("/api/runners/register", s.registerRunner)
+
+	// Runner job protocol, authenticated by the runner's own credentials
+	runner := s.router.Group("/api/runners/:id")
+	runner.Use(s.runnerAuthMiddleware())
+	{
+		runner.POST("/heartbeat", s.runnerHeartbeat)
+		runner.POST("/jobs/acquire", s.acquireJob)
+		runner.POST("/jobs/:jobId/lease", s.renewJobLease)
+		runner.POST("/jobs/:jobId/result", s.reportJobResult)
+		runner.POST("/jobs/:jobId/steps/:stepId/result", s.reportStepResult)
+		runner.POST("/jobs/:jobId/steps/:stepId/logs", s.appendStepLogs)
 	}
 
 	// WebSocket for logs
@@ -133,6 +199,7 @@ func (s *Server) setupRoutes() {
 }
 
 func (s *Server) Run(addr string) error {
+	go s.workflow.RunReaper(context.Background(), s.reaper)
 	return s.router.Run(addr)
 }
 
@@ -143,6 +210,34 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// adminUsers reads the GitHub usernames allowed to administer runners
+func adminUsers() map[string]bool {
+	admins := make(map[string]bool)
+	for _, username := range strings.Split(getEnv("ADMIN_USERS", ""), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			admins[username] = true
+		}
+	}
+	return admins
+}
+
+// reaperConfig reads the runner reaper settings from the environment
+func reaperConfig() workflow.ReaperConfig {
+	config := workflow.DefaultReaperConfig()
+
+	if value, err := time.ParseDuration(getEnv("REAPER_INTERVAL", "")); err == nil && value > 0 {
+		config.Interval = value
+	}
+	if value, err := time.ParseDuration(getEnv("RUNNER_STALE_AFTER", "")); err == nil && value > 0 {
+		config.StaleAfter = value
+	}
+	if value, err := strconv.Atoi(getEnv("JOB_MAX_RETRIES", "")); err == nil && value >= 0 {
+		config.MaxRetries = value
+	}
+
+	return config
+}
+
 // Auth handlers
 func (s *Server) githubAuth(c *gin.Context) {
 	url := s.auth.GetGitHubAuthURL()
@@ -173,20 +268,26 @@ func (s *Server) getUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+// bearerToken returns the Authorization header without its "Bearer " prefix
+func bearerToken(c *gin.Context) string {
+	token := c.GetHeader("Authorization")
+
+	// Remove "Bearer " prefix if present
+	if len(token) > 7 && token[:7] == "Bearer " {
+		token = token[7:]
+	}
+	return token
+}
+
 func (s *Server) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
+		token := bearerToken(c)
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization token"})
 			c.Abort()
 			return
 		}
 
-		// Remove "Bearer " prefix if present
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
-		}
-
 		user, err := s.auth.ValidateToken(token, s.db)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -199,6 +300,43 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminMiddleware only lets through users listed in ADMIN_USERS. It must run
+// after authMiddleware.
+func (s *Server) adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+		if !s.admins[user.Username] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// runnerAuthMiddleware authenticates a runner by the secret it received on
+// registration. The runner ID comes from the :id route parameter.
+func (s *Server) runnerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := bearerToken(c)
+		if secret == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing runner credentials"})
+			c.Abort()
+			return
+		}
+
+		runner, err := s.auth.AuthenticateRunner(s.db, c.Param("id"), secret)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid runner credentials"})
+			c.Abort()
+			return
+		}
+
+		c.Set("runner", runner)
+		c.Next()
+	}
+}
+
 // Workflow handlers
 func (s *Server) getWorkflows(c *gin.Context) {
 	user := c.MustGet("user").(*models.User)
@@ -232,13 +370,45 @@ func (s *Server) createWorkflow(c *gin.Context) {
 	}
 
 	if err := s.workflow.CreateWorkflow(workflow); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		workflowError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"workflow": workflow})
 }
 
+func (s *Server) validateWorkflow(c *gin.Context) {
+	var req struct {
+		YAMLContent string `json:"yaml_content" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	diagnostics := s.workflow.ValidateWorkflow(req.YAMLContent)
+	if diagnostics == nil {
+		diagnostics = []types.Diagnostic{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": len(diagnostics) == 0, "diagnostics": diagnostics})
+}
+
+// workflowError responds with the error of a workflow operation. Invalid
+// workflows and inputs are the client's fault and come with diagnostics.
+func workflowError(c *gin.Context, err error) {
+	var validationErr *workflow.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "diagnostics": validationErr.Diagnostics})
+	case errors.Is(err, workflow.ErrInvalidInputs):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (s *Server) getWorkflow(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 	user := c.MustGet("user").(*models.User)
@@ -270,7 +440,7 @@ func (s *Server) updateWorkflow(c *gin.Context) {
 
 	workflow, err := s.workflow.UpdateWorkflow(uint(id), user.ID, req.Name, req.Description, req.YAMLContent, req.IsActive)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		workflowError(c, err)
 		return
 	}
 
@@ -315,7 +485,7 @@ func (s *Server) createRun(c *gin.Context) {
 
 	run, err := s.workflow.CreateRun(uint(workflowID), user.ID, req.Inputs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		workflowError(c, err)
 		return
 	}
 
@@ -340,6 +510,10 @@ func (s *Server) cancelRun(c *gin.Context) {
 	user := c.MustGet("user").(*models.User)
 
 	if err := s.workflow.CancelRun(uint(id), user.ID); err != nil {
+		if errors.Is(err, workflow.ErrRunFinished) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -358,82 +532,100 @@ func (s *Server) getRunners(c *gin.Context) {
 }
 
 func (s *Server) registerRunner(c *gin.Context) {
+	token := bearerToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing registration token"})
+		return
+	}
+
 	var req types.RunnerRegistration
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	runner := &models.Runner{
-		ID:      fmt.Sprintf("runner-%d", time.Now().Unix()),
-		Name:    req.Name,
-		Version: req.Version,
-		Status:  "online",
+	runner, credentials, err := s.auth.RegisterRunner(s.db, token, req)
+	if errors.Is(err, auth.ErrInvalidRegistrationToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Jobs waiting for these labels may now have a runner
+	if err := s.workflow.UpdateWaitingReasons(); err != nil {
+		log.Printf("Failed to update waiting reasons: %v", err)
 	}
 
-	if err := s.db.Create(runner).Error; err != nil {
+	c.JSON(http.StatusCreated, gin.H{"runner": runner, "credentials": credentials})
+}
+
+func (s *Server) revokeRunner(c *gin.Context) {
+	if err := s.auth.RevokeRunner(s.db, c.Param("id")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Runner not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"runner": runner})
+	c.JSON(http.StatusOK, gin.H{"message": "Runner revoked"})
+}
+
+// Runner registration token handlers
+func (s *Server) getRunnerTokens(c *gin.Context) {
+	var tokens []models.RunnerToken
+	if err := s.db.Order("created_at DESC").Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runner_tokens": tokens})
 }
 
-// WebSocket log streaming
-func (s *Server) streamLogs(c *gin.Context) {
-	runID, _ := strconv.Atoi(c.Param("runId"))
+func (s *Server) createRunnerToken(c *gin.Context) {
 	user := c.MustGet("user").(*models.User)
 
-	// Verify user has access to this run
-	var run models.Run
-	if err := s.db.Where("id = ? AND user_id = ?", runID, user.ID).First(&run).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+	var req struct {
+		Description string `json:"description"`
+		ExpiresIn   string `json:"expires_in"` // Go duration, defaults to 24h
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	ttl := 24 * time.Hour
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_in duration"})
+			return
+		}
+	}
+
+	record, token, err := s.auth.IssueRegistrationToken(s.db, user.ID, req.Description, ttl)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer conn.Close()
-
-	// Stream logs for this run
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-
-	lastLogID := uint(0)
-
-	for {
-		select {
-		case <-ticker.C:
-			var logs []models.Log
-			err := s.db.Joins("JOIN steps ON logs.step_id = steps.id").
-				Joins("JOIN jobs ON steps.job_id = jobs.id").
-				Where("jobs.run_id = ? AND logs.id > ?", runID, lastLogID).
-				Order("logs.id ASC").
-				Find(&logs).Error
-
-			if err != nil {
-				log.Printf("Error fetching logs: %v", err)
-				continue
-			}
-
-			for _, logEntry := range logs {
-				entry := types.LogEntry{
-					RunID:     uint(runID),
-					Content:   logEntry.Content,
-					Level:     logEntry.Level,
-					Timestamp: logEntry.Timestamp.Format(time.RFC3339),
-				}
-
-				if err := conn.WriteJSON(entry); err != nil {
-					log.Printf("WebSocket write failed: %v", err)
-					return
-				}
-
-				lastLogID = logEntry.ID
-			}
+
+	c.JSON(http.StatusCreated, gin.H{"runner_token": record, "token": token})
+}
+
+func (s *Server) revokeRunnerToken(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := s.auth.RevokeRegistrationToken(s.db, uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unused registration token not found"})
+			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-}
\ No newline at end of file
+
+	c.JSON(http.StatusOK, gin.H{"message": "Registration token revoked"})
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/workflow"
+)
+
+func TestReaperConfig(t *testing.T) {
+	defaults := workflow.DefaultReaperConfig()
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want workflow.ReaperConfig
+	}{
+		{"defaults", nil, defaults},
+		{
+			name: "overrides",
+			env:  map[string]string{"REAPER_INTERVAL": "5s", "RUNNER_STALE_AFTER": "2m", "JOB_MAX_RETRIES": "0"},
+			want: workflow.ReaperConfig{Interval: 5 * time.Second, StaleAfter: 2 * time.Minute, MaxRetries: 0},
+		},
+		{
+			name: "invalid values keep the defaults",
+			env:  map[string]string{"REAPER_INTERVAL": "0s", "RUNNER_STALE_AFTER": "soon", "JOB_MAX_RETRIES": "-1"},
+			want: defaults,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{"REAPER_INTERVAL", "RUNNER_STALE_AFTER", "JOB_MAX_RETRIES"} {
+				t.Setenv(key, test.env[key])
+			}
+			if got := reaperConfig(); got != test.want {
+				t.Errorf("reaperConfig() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+const (
+	registrationTokenPrefix = "rfreg_"
+	runnerSecretPrefix      = "rfrun_"
+)
+
+var (
+	// ErrInvalidRegistrationToken is returned for unknown, used, expired or revoked tokens.
+	ErrInvalidRegistrationToken = errors.New("invalid registration token")
+	// ErrInvalidRunnerCredentials is returned when a runner cannot be authenticated.
+	ErrInvalidRunnerCredentials = errors.New("invalid runner credentials")
+)
+
+// IssueRegistrationToken creates a one-time token that a runner exchanges for
+// its credentials. The plaintext token is only returned here; just its hash
+// is stored.
+func (a *AuthService) IssueRegistrationToken(db *gorm.DB, userID uint, description string, ttl time.Duration) (*models.RunnerToken, string, error) {
+	token, err := randomSecret(registrationTokenPrefix, 32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	record := &models.RunnerToken{
+		TokenHash:   hashSecret(token),
+		Description: description,
+		CreatedBy:   userID,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := db.Create(record).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to create registration token: %v", err)
+	}
+
+	return record, token, nil
+}
+
+// RevokeRegistrationToken invalidates a registration token that has not been used yet.
+func (a *AuthService) RevokeRegistrationToken(db *gorm.DB, tokenID uint) error {
+	result := db.Model(&models.RunnerToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", tokenID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// RegisterRunner consumes a registration token and creates a runner with a
+// unique ID and a long-lived secret. The plaintext secret is only returned here.
+func (a *AuthService) RegisterRunner(db *gorm.DB, token string, registration types.RunnerRegistration) (*models.Runner, *types.RunnerCredentials, error) {
+	runnerID, err := randomSecret("runner-", 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := randomSecret(runnerSecretPrefix, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags, _ := json.Marshal(types.Labels(registration.Tags).Required())
+	now := time.Now()
+	runner := &models.Runner{
+		ID:         runnerID,
+		Name:       registration.Name,
+		Version:    registration.Version,
+		Tags:       string(tags),
+		Status:     "online",
+		LastSeen:   now,
+		SecretHash: hashSecret(secret),
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Claim the token atomically so it can only ever be used once
+		result := tx.Model(&models.RunnerToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", hashSecret(token), now).
+			Updates(map[string]interface{}{"used_at": now, "runner_id": runner.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidRegistrationToken
+		}
+
+		return tx.Create(runner).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return runner, &types.RunnerCredentials{RunnerID: runner.ID, Secret: secret}, nil
+}
+
+// AuthenticateRunner verifies a runner's secret and returns the runner.
+func (a *AuthService) AuthenticateRunner(db *gorm.DB, runnerID, secret string) (*models.Runner, error) {
+	var runner models.Runner
+	if err := db.Where("id = ? AND revoked_at IS NULL", runnerID).First(&runner).Error; err != nil {
+		return nil, ErrInvalidRunnerCredentials
+	}
+
+	if runner.SecretHash == "" ||
+		subtle.ConstantTimeCompare([]byte(runner.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidRunnerCredentials
+	}
+
+	return &runner, nil
+}
+
+// RevokeRunner invalidates a runner's credentials. Jobs it holds have their
+// lease expired immediately so the reaper can recover them.
+func (a *AuthService) RevokeRunner(db *gorm.DB, runnerID string) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Runner{}).
+			Where("id = ? AND revoked_at IS NULL", runnerID).
+			Updates(map[string]interface{}{"revoked_at": now, "status": "offline"})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return tx.Model(&models.Job{}).
+			Where("runner_id = ? AND status = ?", runnerID, "running").
+			Update("lease_expires_at", now).Error
+	})
+}
+
+// randomSecret returns prefix followed by n random bytes in hex
+func randomSecret(prefix string, n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return prefix + hex.EncodeToString(buf), nil
+}
+
+// hashSecret returns the hex SHA-256 of a token or secret. Tokens are random
+// and high-entropy, so a fast hash is sufficient.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
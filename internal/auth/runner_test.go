@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// testDB connects to the Postgres database named by
+// RELAYFORGE_TEST_DATABASE_URL, skipping the test when it is not set
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("RELAYFORGE_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("RELAYFORGE_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Runner{}, &models.RunnerToken{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// issueTestToken issues a registration token on behalf of a new user
+func issueTestToken(t *testing.T, a *AuthService, db *gorm.DB, ttl time.Duration) (*models.RunnerToken, string) {
+	t.Helper()
+	id := time.Now().UnixNano()
+	user := &models.User{GitHubID: id, Username: fmt.Sprintf("test-%d", id)}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	record, token, err := a.IssueRegistrationToken(db, user.ID, t.Name(), ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record, token
+}
+
+func TestRandomSecret(t *testing.T) {
+	first, err := randomSecret(runnerSecretPrefix, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := randomSecret(runnerSecretPrefix, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(first, runnerSecretPrefix) || len(first) != len(runnerSecretPrefix)+64 {
+		t.Errorf("randomSecret() = %q, want %s followed by 64 hex digits", first, runnerSecretPrefix)
+	}
+	if first == second {
+		t.Errorf("randomSecret() returned %q twice", first)
+	}
+	if hash := hashSecret(first); len(hash) != 64 || hash == hashSecret(second) {
+		t.Errorf("hashSecret(%q) = %q, want a distinct hex SHA-256", first, hash)
+	}
+}
+
+func TestRegisterRunner(t *testing.T) {
+	db := testDB(t)
+	a := &AuthService{}
+	record, token := issueTestToken(t, a, db, time.Hour)
+
+	var stored models.RunnerToken
+	if err := db.First(&stored, record.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.TokenHash == token || stored.TokenHash != hashSecret(token) {
+		t.Errorf("stored token hash %q, want the hash of the token", stored.TokenHash)
+	}
+
+	runner, credentials, err := a.RegisterRunner(db, token, types.RunnerRegistration{
+		Name: "builder", Version: "1.0.0", Tags: []string{" linux ", "any", "gpu", "linux"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.RunnerID != runner.ID || !strings.HasPrefix(credentials.Secret, runnerSecretPrefix) {
+		t.Errorf("got credentials %+v for runner %s", credentials, runner.ID)
+	}
+	if runner.SecretHash == credentials.Secret {
+		t.Error("runner secret is stored in plaintext")
+	}
+	if runner.Tags != `["linux","gpu"]` {
+		t.Errorf("runner tags = %s, want the required labels", runner.Tags)
+	}
+
+	if err := db.First(&stored, record.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.UsedAt == nil || stored.RunnerID != runner.ID {
+		t.Errorf("token is not marked as used by %s: %+v", runner.ID, stored)
+	}
+
+	if _, err := a.AuthenticateRunner(db, credentials.RunnerID, credentials.Secret); err != nil {
+		t.Errorf("authenticating with the issued credentials: %v", err)
+	}
+
+	// The token is spent
+	if _, _, err := a.RegisterRunner(db, token, types.RunnerRegistration{Name: "again"}); !errors.Is(err, ErrInvalidRegistrationToken) {
+		t.Errorf("reusing a registration token: got %v, want ErrInvalidRegistrationToken", err)
+	}
+}
+
+func TestRegisterRunnerInvalidToken(t *testing.T) {
+	db := testDB(t)
+	a := &AuthService{}
+
+	_, expired := issueTestToken(t, a, db, -time.Minute)
+	revokedRecord, revoked := issueTestToken(t, a, db, time.Hour)
+	if err := a.RevokeRegistrationToken(db, revokedRecord.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, valid := issueTestToken(t, a, db, time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", expired},
+		{"revoked", revoked},
+		{"unknown", "rfreg_unknown"},
+		{"hash of a valid token", hashSecret(valid)},
+		{"empty", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner, _, err := a.RegisterRunner(db, test.token, types.RunnerRegistration{Name: test.name})
+			if !errors.Is(err, ErrInvalidRegistrationToken) {
+				t.Errorf("got %v, want ErrInvalidRegistrationToken", err)
+			}
+			if runner != nil {
+				t.Errorf("registered runner %s", runner.ID)
+			}
+		})
+	}
+
+	// A used token can no longer be revoked
+	usedRecord, used := issueTestToken(t, a, db, time.Hour)
+	if _, _, err := a.RegisterRunner(db, used, types.RunnerRegistration{Name: "used"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RevokeRegistrationToken(db, usedRecord.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("revoking a used token: got %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestAuthenticateRunner(t *testing.T) {
+	db := testDB(t)
+	a := &AuthService{}
+
+	register := func() *types.RunnerCredentials {
+		_, token := issueTestToken(t, a, db, time.Hour)
+		_, credentials, err := a.RegisterRunner(db, token, types.RunnerRegistration{Name: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return credentials
+	}
+	first, second, revoked := register(), register(), register()
+	if err := a.RevokeRunner(db, revoked.RunnerID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		runnerID string
+		secret   string
+		wantErr  bool
+	}{
+		{"valid", first.RunnerID, first.Secret, false},
+		{"other runner's secret", first.RunnerID, second.Secret, true},
+		{"secret for another runner ID", second.RunnerID, first.Secret, true},
+		{"wrong secret", first.RunnerID, first.Secret + "0", true},
+		{"hash as secret", first.RunnerID, hashSecret(first.Secret), true},
+		{"empty secret", first.RunnerID, "", true},
+		{"unknown runner", "runner-unknown", first.Secret, true},
+		{"revoked runner", revoked.RunnerID, revoked.Secret, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner, err := a.AuthenticateRunner(db, test.runnerID, test.secret)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidRunnerCredentials) || runner != nil {
+					t.Errorf("got runner %v and error %v, want ErrInvalidRunnerCredentials", runner, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if runner.ID != test.runnerID {
+				t.Errorf("authenticated as %s, want %s", runner.ID, test.runnerID)
+			}
+		})
+	}
+
+	var status string
+	if err := db.Model(&models.Runner{}).Where("id = ?", revoked.RunnerID).Pluck("status", &status).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status != "offline" {
+		t.Errorf("revoked runner is %s, want offline", status)
+	}
+	if err := a.RevokeRunner(db, revoked.RunnerID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("revoking a runner twice: got %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestRevokeRunnerExpiresLeases(t *testing.T) {
+	db := testDB(t)
+	if err := db.AutoMigrate(&models.Workflow{}, &models.Run{}, &models.Job{}); err != nil {
+		t.Fatal(err)
+	}
+	a := &AuthService{}
+	record, token := issueTestToken(t, a, db, time.Hour)
+	runner, _, err := a.RegisterRunner(db, token, types.RunnerRegistration{Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := &models.Workflow{UserID: record.CreatedBy, Name: t.Name(), IsActive: true}
+	if err := db.Create(workflow).Error; err != nil {
+		t.Fatal(err)
+	}
+	run := &models.Run{WorkflowID: workflow.ID, UserID: record.CreatedBy, Status: "cancelled"}
+	if err := db.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Cancelled, so that the reaper of other tests only ends it once its lease expires
+	now, leaseExpiresAt := time.Now(), time.Now().Add(time.Hour)
+	job := &models.Job{RunID: run.ID, Name: "build", Status: "running", RunnerID: runner.ID,
+		LeaseExpiresAt: &leaseExpiresAt, CancelRequestedAt: &now}
+	if err := db.Create(job).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.RevokeRunner(db, runner.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.First(job, job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.LeaseExpiresAt == nil || job.LeaseExpiresAt.After(time.Now()) {
+		t.Errorf("lease expires at %v, want it expired", job.LeaseExpiresAt)
+	}
+	if job.Status != "running" {
+		t.Errorf("job is %s, want it left for the reaper", job.Status)
+	}
+}
@@ -0,0 +1,107 @@
+package logstream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// notifyChannel is the Postgres channel replicas announce new log entries on
+const notifyChannel = "relayforge_logs"
+
+// Store loads stored log entries of a run, in ID order
+type Store interface {
+	RunLogs(runID, afterID uint, limit int) ([]types.LogEntry, error)
+}
+
+// notification announces entries stored by one replica to the others. The
+// entries themselves may not fit in a NOTIFY payload, so only their range is
+// sent and the receivers load them.
+type notification struct {
+	Origin  string `json:"origin"`
+	RunID   uint   `json:"run_id"`
+	FirstID uint   `json:"first_id"`
+	LastID  uint   `json:"last_id"`
+}
+
+// Broker publishes log entries to the subscribers in this process and, with
+// Postgres LISTEN/NOTIFY, to those of the other API replicas.
+type Broker struct {
+	*Hub
+	db     *gorm.DB
+	store  Store
+	origin string
+}
+
+func NewBroker(db *gorm.DB, store Store) *Broker {
+	origin := make([]byte, 8)
+	rand.Read(origin)
+	return &Broker{Hub: NewHub(), db: db, store: store, origin: hex.EncodeToString(origin)}
+}
+
+// PublishLogs delivers newly stored entries of a run, ordered by ID.
+func (b *Broker) PublishLogs(entries []types.LogEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	b.Publish(entries)
+
+	payload, _ := json.Marshal(notification{
+		Origin:  b.origin,
+		RunID:   entries[0].RunID,
+		FirstID: entries[0].ID,
+		LastID:  entries[len(entries)-1].ID,
+	})
+	if err := b.db.Exec("SELECT pg_notify(?, ?)", notifyChannel, string(payload)).Error; err != nil {
+		log.Printf("Failed to notify other replicas of new logs: %v", err)
+	}
+}
+
+// Listen receives the entries stored by other replicas. It runs for the
+// lifetime of the process; the listener reconnects to Postgres by itself
+// whenever the connection drops.
+func (b *Broker) Listen(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Log notifications interrupted: %v", err)
+		}
+	})
+	if err := listener.Listen(notifyChannel); err != nil {
+		log.Printf("Failed to listen for log notifications: %v", err)
+		return
+	}
+
+	for n := range listener.Notify {
+		// A nil notification follows a reconnect; entries announced
+		// meanwhile are caught up by clients when they reconnect
+		if n == nil {
+			continue
+		}
+
+		var msg notification
+		if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil || msg.Origin == b.origin {
+			continue
+		}
+		if !b.HasSubscribers(msg.RunID) {
+			continue
+		}
+
+		entries, err := b.store.RunLogs(msg.RunID, msg.FirstID-1, int(msg.LastID-msg.FirstID)+1)
+		if err != nil {
+			log.Printf("Failed to load logs of run %d: %v", msg.RunID, err)
+			continue
+		}
+		// Entries of other runs may share the range
+		for len(entries) > 0 && entries[len(entries)-1].ID > msg.LastID {
+			entries = entries[:len(entries)-1]
+		}
+		b.Publish(entries)
+	}
+}
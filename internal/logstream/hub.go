@@ -0,0 +1,92 @@
+// Package logstream delivers log entries to the clients following a run as
+// they are stored, across all API replicas.
+package logstream
+
+import (
+	"sync"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// subscriptionBuffer is how many entries a subscriber may fall behind before
+// it is dropped.
+const subscriptionBuffer = 256
+
+// Hub fans log entries out to the subscribers of their run within this
+// process.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[*Subscription]struct{}
+}
+
+// Subscription receives the log entries of one run. C is closed when the
+// subscriber fell too far behind; it should catch up from the database and
+// subscribe again.
+type Subscription struct {
+	C     <-chan types.LogEntry
+	c     chan types.LogEntry
+	hub   *Hub
+	runID uint
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[uint]map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving the entries published for a run
+func (h *Hub) Subscribe(runID uint) *Subscription {
+	c := make(chan types.LogEntry, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, hub: h, runID: runID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[runID] == nil {
+		h.subscribers[runID] = make(map[*Subscription]struct{})
+	}
+	h.subscribers[runID][sub] = struct{}{}
+	return sub
+}
+
+// Close stops the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// remove drops a subscription and closes its channel. The caller holds h.mu.
+func (h *Hub) remove(sub *Subscription) {
+	subs := h.subscribers[sub.runID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.runID)
+	}
+	close(sub.c)
+}
+
+// HasSubscribers reports whether anyone in this process follows a run
+func (h *Hub) HasSubscribers(runID uint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[runID]) > 0
+}
+
+// Publish delivers entries to the subscribers of their runs. It never
+// blocks: a subscriber whose buffer is full is dropped.
+func (h *Hub) Publish(entries []types.LogEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, entry := range entries {
+		for sub := range h.subscribers[entry.RunID] {
+			select {
+			case sub.c <- entry:
+			default:
+				h.remove(sub)
+			}
+		}
+	}
+}
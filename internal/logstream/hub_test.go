@@ -0,0 +1,84 @@
+package logstream
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// received drains the entries buffered for a subscription
+func received(sub *Subscription) (ids []uint, closed bool) {
+	for {
+		select {
+		case entry, ok := <-sub.C:
+			if !ok {
+				return ids, true
+			}
+			ids = append(ids, entry.ID)
+		default:
+			return ids, false
+		}
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	first := hub.Subscribe(1)
+	second := hub.Subscribe(1)
+	other := hub.Subscribe(2)
+
+	hub.Publish([]types.LogEntry{{ID: 1, RunID: 1}, {ID: 2, RunID: 2}, {ID: 3, RunID: 1}})
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		want []uint
+	}{
+		{"first", first, []uint{1, 3}},
+		{"second", second, []uint{1, 3}},
+		{"other run", other, []uint{2}},
+	}
+	for _, test := range tests {
+		if ids, closed := received(test.sub); closed || !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s subscription received %v (closed %v), want %v", test.name, ids, closed, test.want)
+		}
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(1)
+	if !hub.HasSubscribers(1) {
+		t.Fatal("run 1 has no subscribers")
+	}
+
+	sub.Close()
+	sub.Close()
+	if hub.HasSubscribers(1) {
+		t.Error("run 1 has subscribers after its only subscription closed")
+	}
+	if _, closed := received(sub); !closed {
+		t.Error("channel of a closed subscription is open")
+	}
+	hub.Publish([]types.LogEntry{{ID: 1, RunID: 1}})
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(1)
+
+	entries := make([]types.LogEntry, subscriptionBuffer+1)
+	for i := range entries {
+		entries[i] = types.LogEntry{ID: uint(i + 1), RunID: 1}
+	}
+	hub.Publish(entries)
+
+	ids, closed := received(slow)
+	if !closed || len(ids) != subscriptionBuffer {
+		t.Errorf("got %d entries (closed %v), want the first %d and a closed channel", len(ids), closed, subscriptionBuffer)
+	}
+	if hub.HasSubscribers(1) {
+		t.Error("a dropped subscriber is still subscribed")
+	}
+}
@@ -36,6 +36,8 @@ type Run struct {
 	WorkflowID uint      `json:"workflow_id"`
 	UserID     uint      `json:"user_id"`
 	Status     string    `json:"status"` // pending, running, success, failed, cancelled
+	Inputs     string    `json:"inputs"` // JSON object of workflow inputs
+	YAMLContent string   `json:"yaml_content"` // workflow file the run was started from
 	StartedAt  *time.Time `json:"started_at"`
 	FinishedAt *time.Time `json:"finished_at"`
 	CreatedAt  time.Time `json:"created_at"`
@@ -50,8 +52,23 @@ type Job struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	RunID     uint      `json:"run_id"`
 	Name      string    `json:"name"`
-	Status    string    `json:"status"` // pending, running, success, failed, skipped
+	Key       string    `json:"key"` // job key in the workflow; matrix jobs share it
+	Matrix    string    `json:"matrix,omitempty"` // JSON object of matrix values
+	MaxParallel int     `json:"max_parallel,omitempty"` // matrix jobs of the same key running at once
+	FailFast  bool      `json:"fail_fast,omitempty"`
+	Status    string    `json:"status"` // pending, queued, running, success, failed, skipped, cancelled, timed_out
+	StatusReason string `json:"status_reason,omitempty"`
+	Needs     string    `json:"needs"` // JSON array of job names
+	RunsOn    string    `json:"runs_on"` // JSON array of required runner labels
+	Condition string    `json:"if,omitempty"`
+	Error     string    `json:"error,omitempty"`
 	RunnerID  string    `json:"runner_id"`
+	Attempts  int       `json:"attempts"` // times the job was requeued after its lease expired
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	TimeoutSeconds int  `json:"timeout_seconds,omitempty"` // 0 means no timeout
+	TimeoutAt *time.Time `json:"timeout_at,omitempty"` // set when the job starts running
+	CancelRequestedAt *time.Time `json:"cancel_requested_at,omitempty"` // run was cancelled while the job was running
+	Outputs   string    `json:"outputs,omitempty"` // JSON object of the job's declared outputs
 	StartedAt *time.Time `json:"started_at"`
 	FinishedAt *time.Time `json:"finished_at"`
 	CreatedAt time.Time `json:"created_at"`
@@ -66,25 +83,46 @@ type Step struct {
 	JobID     uint       `json:"job_id"`
 	Name      string     `json:"name"`
 	Command   string     `json:"command"`
-	Status    string     `json:"status"` // pending, running, success, failed, skipped
+	Status    string     `json:"status"` // pending, running, success, failed, skipped, timed_out, cancelled
+	Outcome   string     `json:"outcome,omitempty"`    // result of the step itself
+	Conclusion string    `json:"conclusion,omitempty"` // result as it counts for the job, after continue-on-error
+	Outputs   string     `json:"outputs,omitempty"`    // JSON object of the values written to $RELAYFORGE_OUTPUT, secrets masked
+	ExitCode  *int       `json:"exit_code"`
 	StartedAt *time.Time `json:"started_at"`
 	FinishedAt *time.Time `json:"finished_at"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	Job       Job        `json:"job" gorm:"foreignKey:JobID"`
 	Logs      []Log      `json:"logs,omitempty" gorm:"foreignKey:StepID"`
+	LogLines  int64      `json:"log_lines" gorm:"-"` // number of log entries, filled in by GetRun
 }
 
-// Log represents log entries for steps
+// Log represents log entries for steps. Lines streamed by a runner carry a
+// sequence number that is unique per step attempt.
 type Log struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
-	StepID    uint      `json:"step_id"`
+	StepID    uint      `json:"step_id" gorm:"uniqueIndex:idx_logs_step_line,where:sequence > 0"`
+	Attempt   int       `json:"attempt" gorm:"uniqueIndex:idx_logs_step_line"` // job attempt that produced the entry
+	Sequence  int64     `json:"sequence,omitempty" gorm:"uniqueIndex:idx_logs_step_line"`
+	Stream    string    `json:"stream,omitempty"` // stdout or stderr for streamed lines
 	Content   string    `json:"content"`
 	Level     string    `json:"level"` // info, warn, error, debug
 	Timestamp time.Time `json:"timestamp"`
 	Step      Step      `json:"step" gorm:"foreignKey:StepID"`
 }
 
+// Secret is an encrypted secret available to a user's workflows, or to one
+// workflow only when WorkflowID is set. Its value is never returned by the API.
+type Secret struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"user_id" gorm:"uniqueIndex:idx_secrets_scope_name"`
+	WorkflowID uint      `json:"workflow_id,omitempty" gorm:"uniqueIndex:idx_secrets_scope_name"` // 0 for user secrets
+	Name       string    `json:"name" gorm:"uniqueIndex:idx_secrets_scope_name"`
+	Value      string    `json:"-"` // base64 AES-GCM nonce and ciphertext
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
 // Runner represents a workflow runner instance
 type Runner struct {
 	ID        string    `json:"id" gorm:"primaryKey"`
@@ -93,6 +131,22 @@ type Runner struct {
 	LastSeen  time.Time `json:"last_seen"`
 	Version   string    `json:"version"`
 	Tags      string    `json:"tags"` // JSON array of tags
+	SecretHash string   `json:"-"`
+	RevokedAt *time.Time `json:"revoked_at"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RunnerToken represents a one-time runner registration token
+type RunnerToken struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TokenHash   string     `json:"-" gorm:"uniqueIndex"`
+	Description string     `json:"description"`
+	CreatedBy   uint       `json:"created_by"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at"`
+	RunnerID    string     `json:"runner_id"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
\ No newline at end of file
@@ -0,0 +1,162 @@
+// Package secrets stores the secrets workflows reference as
+// ${{ secrets.NAME }}, encrypted at rest with AES-GCM.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+)
+
+var (
+	// ErrInvalidName is returned for secret names that cannot be referenced
+	// from expressions.
+	ErrInvalidName = errors.New("secret names may only contain letters, digits and underscores, and must not start with a digit")
+	// ErrInvalidMasterKey is returned when the master key is not a base64
+	// encoded 32-byte key.
+	ErrInvalidMasterKey = errors.New("master key must be 32 bytes, base64 encoded")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Store keeps secrets of two scopes: user secrets are available to all of a
+// user's workflows, workflow secrets to one workflow only and take precedence
+// over user secrets of the same name.
+type Store struct {
+	db   *gorm.DB
+	aead cipher.AEAD
+}
+
+// NewStore returns a store that encrypts secrets with masterKey, a base64
+// encoded 32-byte AES-256 key.
+func NewStore(db *gorm.DB, masterKey string) (*Store, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(masterKey))
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidMasterKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db, aead: aead}, nil
+}
+
+// List returns the secrets of a scope without their values. workflowID 0
+// selects the user's own secrets.
+func (s *Store) List(userID, workflowID uint) ([]models.Secret, error) {
+	var secrets []models.Secret
+	err := s.db.Where("user_id = ? AND workflow_id = ?", userID, workflowID).
+		Order("name ASC").Find(&secrets).Error
+	return secrets, err
+}
+
+// Set creates or replaces a secret. Names are case-insensitive and stored in
+// upper case.
+func (s *Store) Set(userID, workflowID uint, name, value string) (*models.Secret, error) {
+	if !namePattern.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	name = strings.ToUpper(name)
+
+	secret := &models.Secret{UserID: userID, WorkflowID: workflowID, Name: name}
+	ciphertext, err := s.seal(secret, value)
+	if err != nil {
+		return nil, err
+	}
+	secret.Value = ciphertext
+
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "workflow_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(secret).Error
+	return secret, err
+}
+
+// Delete removes a secret. It returns gorm.ErrRecordNotFound if there is none.
+func (s *Store) Delete(userID, workflowID uint, name string) error {
+	result := s.db.Where("user_id = ? AND workflow_id = ? AND name = ?", userID, workflowID, strings.ToUpper(name)).
+		Delete(&models.Secret{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Resolve decrypts the secrets available to a workflow, keyed by name.
+func (s *Store) Resolve(userID, workflowID uint) (map[string]string, error) {
+	var secrets []models.Secret
+	if err := s.db.Where("user_id = ? AND workflow_id IN ?", userID, []uint{0, workflowID}).
+		Find(&secrets).Error; err != nil {
+		return nil, err
+	}
+	return s.openAll(secrets)
+}
+
+// openAll decrypts secrets of a user and one of their workflows, keyed by
+// name. Workflow secrets override user secrets whatever their order.
+func (s *Store) openAll(secrets []models.Secret) (map[string]string, error) {
+	values := make(map[string]string, len(secrets))
+	fromWorkflow := make(map[string]bool, len(secrets))
+	for i := range secrets {
+		secret := &secrets[i]
+		if fromWorkflow[secret.Name] {
+			continue
+		}
+		value, err := s.open(secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s: %v", secret.Name, err)
+		}
+		values[secret.Name] = value
+		fromWorkflow[secret.Name] = secret.WorkflowID != 0
+	}
+	return values, nil
+}
+
+// seal encrypts a secret value. The ciphertext is bound to the secret's
+// owner, scope and name, so it cannot be moved to another secret.
+func (s *Store) seal(secret *models.Secret, value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), additionalData(secret))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) open(secret *models.Secret) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(secret.Value)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	value, err := s.aead.Open(nil, nonce, ciphertext, additionalData(secret))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func additionalData(secret *models.Secret) []byte {
+	return []byte(fmt.Sprintf("%d/%d/%s", secret.UserID, secret.WorkflowID, secret.Name))
+}
@@ -0,0 +1,253 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+)
+
+var testKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestNewStoreMasterKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		err  error
+	}{
+		{name: "valid", key: testKey},
+		{name: "surrounding whitespace", key: " " + testKey + "\n"},
+		{name: "not base64", key: "not a key!", err: ErrInvalidMasterKey},
+		{name: "too short", key: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")), err: ErrInvalidMasterKey},
+		{name: "empty", key: "", err: ErrInvalidMasterKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewStore(nil, test.key); err != test.err {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	s, err := NewStore(nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"", "hunter2", "multi\nline\nvalue", strings.Repeat("x", 4096)} {
+		secret := &models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN"}
+		sealed, err := s.seal(secret, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "" && strings.Contains(sealed, value) {
+			t.Errorf("ciphertext %q holds the value", sealed)
+		}
+		secret.Value = sealed
+		got, err := s.open(secret)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if got != value {
+			t.Errorf("got %q, want %q", got, value)
+		}
+	}
+
+	// Every seal uses a fresh nonce
+	secret := &models.Secret{UserID: 1, Name: "TOKEN"}
+	first, _ := s.seal(secret, "hunter2")
+	second, _ := s.seal(secret, "hunter2")
+	if first == second {
+		t.Error("sealing a value twice gave the same ciphertext")
+	}
+}
+
+func TestOpenRejected(t *testing.T) {
+	s, err := NewStore(nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewStore(nil, base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN"}
+	sealed, err := s.seal(&original, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	flip := func(i int) string {
+		tampered := append([]byte(nil), raw...)
+		tampered[i] ^= 1
+		return base64.StdEncoding.EncodeToString(tampered)
+	}
+
+	tests := []struct {
+		name   string
+		store  *Store
+		secret models.Secret
+	}{
+		{name: "tampered nonce", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: flip(0)}},
+		{name: "tampered ciphertext", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: flip(len(raw) / 2)}},
+		{name: "tampered tag", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: flip(len(raw) - 1)}},
+		{name: "truncated", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: base64.StdEncoding.EncodeToString(raw[:8])}},
+		{name: "not base64", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: "%%%"}},
+		{name: "other user", store: s, secret: models.Secret{UserID: 3, WorkflowID: 2, Name: "TOKEN", Value: sealed}},
+		{name: "other scope", store: s, secret: models.Secret{UserID: 1, WorkflowID: 0, Name: "TOKEN", Value: sealed}},
+		{name: "other name", store: s, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "PASSWORD", Value: sealed}},
+		{name: "other master key", store: other, secret: models.Secret{UserID: 1, WorkflowID: 2, Name: "TOKEN", Value: sealed}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if value, err := test.store.open(&test.secret); err == nil {
+				t.Errorf("opened %q, want an error", value)
+			}
+		})
+	}
+}
+
+func TestOpenAllPrecedence(t *testing.T) {
+	s, err := NewStore(nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := func(workflowID uint, name, value string) models.Secret {
+		t.Helper()
+		secret := models.Secret{UserID: 1, WorkflowID: workflowID, Name: name}
+		ciphertext, err := s.seal(&secret, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret.Value = ciphertext
+		return secret
+	}
+	user := sealed(0, "TOKEN", "user token")
+	workflow := sealed(2, "TOKEN", "workflow token")
+	registry := sealed(0, "REGISTRY", "user registry")
+
+	tests := []struct {
+		name    string
+		secrets []models.Secret
+		want    map[string]string
+	}{
+		{name: "user first", secrets: []models.Secret{user, registry, workflow}, want: map[string]string{"TOKEN": "workflow token", "REGISTRY": "user registry"}},
+		{name: "workflow first", secrets: []models.Secret{workflow, registry, user}, want: map[string]string{"TOKEN": "workflow token", "REGISTRY": "user registry"}},
+		{name: "user only", secrets: []models.Secret{user, registry}, want: map[string]string{"TOKEN": "user token", "REGISTRY": "user registry"}},
+		{name: "none", want: map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := s.openAll(test.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	tampered := workflow
+	tampered.Name = "REGISTRY"
+	if _, err := s.openAll([]models.Secret{user, tampered}); err == nil || !strings.Contains(err.Error(), "secret REGISTRY") {
+		t.Errorf("got error %v, want one naming secret REGISTRY", err)
+	}
+}
+
+// testDB connects to the Postgres database named by
+// RELAYFORGE_TEST_DATABASE_URL, skipping the test without one
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("RELAYFORGE_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("RELAYFORGE_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Workflow{}, &models.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	db := testDB(t)
+	s, err := NewStore(db, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := time.Now().UnixNano()
+	user := &models.User{GitHubID: id, Username: fmt.Sprintf("test-%d", id)}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	var workflows [2]models.Workflow
+	for i := range workflows {
+		workflows[i] = models.Workflow{UserID: user.ID, Name: fmt.Sprintf("%s %d", t.Name(), i), IsActive: true}
+		if err := db.Create(&workflows[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := func(workflowID uint, name, value string) {
+		t.Helper()
+		if _, err := s.Set(user.ID, workflowID, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The workflow secret is set before the user secret it overrides, so
+	// precedence does not follow insertion order
+	set(workflows[0].ID, "token", "workflow token")
+	set(0, "TOKEN", "user token")
+	set(0, "REGISTRY", "user registry")
+	set(workflows[1].ID, "DEPLOY_KEY", "other workflow key")
+
+	tests := []struct {
+		name       string
+		workflowID uint
+		want       map[string]string
+	}{
+		{
+			name:       "workflow overrides user",
+			workflowID: workflows[0].ID,
+			want:       map[string]string{"TOKEN": "workflow token", "REGISTRY": "user registry"},
+		},
+		{
+			name:       "no collision",
+			workflowID: workflows[1].ID,
+			want:       map[string]string{"TOKEN": "user token", "REGISTRY": "user registry", "DEPLOY_KEY": "other workflow key"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := s.Resolve(user.ID, test.workflowID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package workflow
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+)
+
+// expressionContexts builds the contexts available to the expressions of a
+// job: run metadata, workflow inputs, the workflow and job env, its matrix values and the
+// results and outputs of the jobs it needs. The same contexts are evaluated server-side for job conditions
+// and handed to the runner for step conditions and interpolation.
+func (s *Service) expressionContexts(run *models.Run, job *models.Job, jobs []models.Job) map[string]interface{} {
+	statusByKey := statusesByKey(jobs)
+	outputsByKey := outputsByKey(jobs)
+
+	needs := make(map[string]interface{})
+	for _, need := range jobNeeds(job) {
+		outputs := outputsByKey[need]
+		if outputs == nil {
+			outputs = map[string]interface{}{}
+		}
+		needs[need] = map[string]interface{}{
+			"result":  statusByKey[need],
+			"outputs": outputs,
+		}
+	}
+
+	inputs := make(map[string]interface{})
+	if run.Inputs != "" {
+		json.Unmarshal([]byte(run.Inputs), &inputs)
+	}
+
+	env := make(map[string]interface{})
+	if spec, err := runSpec(run); err == nil {
+		// The job env overrides the workflow env
+		for _, layer := range []map[string]string{spec.Env, spec.Jobs[jobKey(job)].Env} {
+			for key, value := range layer {
+				env[key] = value
+			}
+		}
+	}
+
+	matrix := make(map[string]interface{})
+	if job.Matrix != "" {
+		json.Unmarshal([]byte(job.Matrix), &matrix)
+	}
+
+	return map[string]interface{}{
+		"run": map[string]interface{}{
+			"id":          run.ID,
+			"workflow_id": run.WorkflowID,
+			"workflow":    run.Workflow.Name,
+			"created_at":  run.CreatedAt.Format(time.RFC3339),
+		},
+		"inputs": inputs,
+		"env":    env,
+		"needs":  needs,
+		"matrix": matrix,
+	}
+}
+
+// evaluateJobCondition decides whether a job whose needs have all finished
+// should run. status reflects how the needed jobs went.
+func (s *Service) evaluateJobCondition(run *models.Run, job *models.Job, jobs []models.Job, status expr.Status) (bool, error) {
+	ctx := &expr.Context{
+		Values: s.expressionContexts(run, job, jobs),
+		Status: status,
+	}
+	return expr.EvaluateCondition(job.Condition, ctx)
+}
+
+// outputsByKey maps each job key to the outputs of its jobs. The jobs of a
+// matrix share their outputs; where they set the same output, the job created
+// last wins.
+func outputsByKey(jobs []models.Job) map[string]map[string]interface{} {
+	ordered := make([]*models.Job, len(jobs))
+	for i := range jobs {
+		ordered[i] = &jobs[i]
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+
+	outputs := make(map[string]map[string]interface{})
+	for _, job := range ordered {
+		if job.Outputs == "" {
+			continue
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(job.Outputs), &values); err != nil {
+			continue
+		}
+		key := jobKey(job)
+		if outputs[key] == nil {
+			outputs[key] = make(map[string]interface{})
+		}
+		for name, value := range values {
+			outputs[key][name] = value
+		}
+	}
+	return outputs
+}
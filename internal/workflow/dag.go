@@ -0,0 +1,130 @@
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// findCycle returns a cycle in the needs relations between jobs, starting
+// and ending with the same job, or nil if there is none. Every need must
+// name an existing job.
+func findCycle(spec *types.WorkflowSpec) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(spec.Jobs))
+	var path []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			// Report the cycle starting from the first occurrence of name
+			for i, n := range path {
+				if n == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, need := range spec.Jobs[name].Needs {
+			if cycle := visit(need); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, name := range sortedKeys(spec.Jobs) {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// jobNeeds decodes the names of the jobs a job depends on
+func jobNeeds(job *models.Job) []string {
+	var needs []string
+	if job.Needs != "" {
+		json.Unmarshal([]byte(job.Needs), &needs)
+	}
+	return needs
+}
+
+// needsOutcome evaluates the needs of a pending job against the status of the
+// other jobs in the run, keyed by job key. It reports whether all needed jobs have finished and,
+// if so, the status the job's condition is evaluated with: success when every
+// needed job succeeded, failure otherwise. failedNeed names a needed job that
+// did not succeed.
+func needsOutcome(job *models.Job, statusByKey map[string]string) (finished bool, status expr.Status, failedNeed string) {
+	status = expr.StatusSuccess
+	for _, need := range jobNeeds(job) {
+		switch statusByKey[need] {
+		case "success":
+		case "failed", "skipped", "cancelled", "timed_out":
+			status = expr.StatusFailure
+			if failedNeed == "" {
+				failedNeed = need
+			}
+		default:
+			return false, status, ""
+		}
+	}
+	return true, status, failedNeed
+}
+
+// jobKey returns the key of a job in the workflow. The jobs of a matrix
+// share their key; their names also list the matrix values.
+func jobKey(job *models.Job) string {
+	if job.Key != "" {
+		return job.Key
+	}
+	return job.Name
+}
+
+// statusesByKey maps each job key to the combined status of its jobs. A
+// matrix job has only finished when all of its combinations have, and it
+// only succeeded if none of them failed or was cancelled.
+func statusesByKey(jobs []models.Job) map[string]string {
+	statuses := make(map[string]string, len(jobs))
+	for i := range jobs {
+		key := jobKey(&jobs[i])
+		current, ok := statuses[key]
+		if !ok || statusPrecedence(jobs[i].Status) > statusPrecedence(current) {
+			statuses[key] = jobs[i].Status
+		}
+	}
+	return statuses
+}
+
+// statusPrecedence orders job statuses for combining them: unfinished jobs
+// win over failures, and failures over successes. Skipped ranks below
+// success on purpose: a combination whose if: was false chose not to run, so
+// it does not hold back the others, and a matrix is only skipped as a whole
+// when every combination was.
+func statusPrecedence(status string) int {
+	switch status {
+	case "skipped":
+		return 0
+	case "success":
+		return 1
+	case "cancelled":
+		return 2
+	case "failed", "timed_out":
+		return 3
+	default:
+		return 4
+	}
+}
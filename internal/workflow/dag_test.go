@@ -0,0 +1,223 @@
+package workflow
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestNeedsOutcome(t *testing.T) {
+	statuses := map[string]string{
+		"build":   "success",
+		"lint":    "success",
+		"test":    "failed",
+		"docs":    "skipped",
+		"deploy":  "cancelled",
+		"e2e":     "timed_out",
+		"package": "pending",
+		"publish": "queued",
+		"scan":    "running",
+	}
+
+	tests := []struct {
+		name         string
+		needs        string
+		wantFinished bool
+		wantStatus   expr.Status
+		wantFailed   string
+	}{
+		{name: "no needs", needs: "", wantFinished: true, wantStatus: expr.StatusSuccess},
+		{name: "empty needs", needs: `[]`, wantFinished: true, wantStatus: expr.StatusSuccess},
+		{name: "all succeeded", needs: `["build","lint"]`, wantFinished: true, wantStatus: expr.StatusSuccess},
+		{name: "failed", needs: `["build","test"]`, wantFinished: true, wantStatus: expr.StatusFailure, wantFailed: "test"},
+		{name: "skipped need skips dependents", needs: `["docs"]`, wantFinished: true, wantStatus: expr.StatusFailure, wantFailed: "docs"},
+		{name: "cancelled", needs: `["deploy"]`, wantFinished: true, wantStatus: expr.StatusFailure, wantFailed: "deploy"},
+		{name: "timed out", needs: `["e2e"]`, wantFinished: true, wantStatus: expr.StatusFailure, wantFailed: "e2e"},
+		{name: "first failure named", needs: `["lint","docs","test"]`, wantFinished: true, wantStatus: expr.StatusFailure, wantFailed: "docs"},
+		{name: "pending", needs: `["build","package"]`},
+		{name: "queued", needs: `["publish"]`},
+		{name: "running", needs: `["scan"]`},
+		{name: "failed and running", needs: `["test","scan"]`},
+		{name: "job not created", needs: `["missing"]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			finished, status, failed := needsOutcome(&models.Job{Needs: test.needs}, statuses)
+			if finished != test.wantFinished {
+				t.Fatalf("finished = %v, want %v", finished, test.wantFinished)
+			}
+			if !finished {
+				return
+			}
+			if status != test.wantStatus || failed != test.wantFailed {
+				t.Errorf("got status %s, failed need %q; want %s, %q", status, failed, test.wantStatus, test.wantFailed)
+			}
+		})
+	}
+}
+
+func TestNeedsCondition(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		status    expr.Status
+		want      bool
+	}{
+		{name: "needs succeeded", status: expr.StatusSuccess, want: true},
+		{name: "need failed", status: expr.StatusFailure, want: false},
+		{name: "always after a failure", condition: "always()", status: expr.StatusFailure, want: true},
+		{name: "always expression", condition: "${{ always() }}", status: expr.StatusFailure, want: true},
+		{name: "failure after a failure", condition: "failure()", status: expr.StatusFailure, want: true},
+		{name: "failure after success", condition: "failure()", status: expr.StatusSuccess, want: false},
+		{name: "plain condition after a failure", condition: "true", status: expr.StatusFailure, want: false},
+	}
+
+	s := &Service{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := &models.Job{Key: "report", Needs: `["build"]`, Condition: test.condition}
+			got, err := s.evaluateJobCondition(&models.Run{}, job, nil, test.status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStatusesByKey(t *testing.T) {
+	jobs := []models.Job{
+		{Key: "build", Status: "success"},
+		{Key: "test", Name: "test (1)", Status: "success"},
+		{Key: "test", Name: "test (2)", Status: "failed"},
+		{Key: "test", Name: "test (3)", Status: "success"},
+		{Key: "lint", Status: "success"},
+		{Key: "lint", Status: "running"},
+		{Key: "lint", Status: "failed"},
+		{Name: "legacy", Status: "cancelled"},
+	}
+	want := map[string]string{
+		"build":  "success",
+		"test":   "failed",
+		"lint":   "running",
+		"legacy": "cancelled",
+	}
+
+	got := statusesByKey(jobs)
+	for key, status := range want {
+		if got[key] != status {
+			t.Errorf("%s is %q, want %q", key, got[key], status)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStatusesByKeySkippedCombinations(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []string
+		want       string
+		wantStatus expr.Status
+	}{
+		{"some skipped", []string{"success", "skipped", "success"}, "success", expr.StatusSuccess},
+		{"all skipped", []string{"skipped", "skipped"}, "skipped", expr.StatusFailure},
+		{"skipped and failed", []string{"skipped", "failed"}, "failed", expr.StatusFailure},
+		{"skipped and cancelled", []string{"cancelled", "skipped"}, "cancelled", expr.StatusFailure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var jobs []models.Job
+			for i, status := range test.statuses {
+				jobs = append(jobs, models.Job{Key: "test", Name: fmt.Sprintf("test (%d)", i), Status: status})
+			}
+
+			statuses := statusesByKey(jobs)
+			if statuses["test"] != test.want {
+				t.Errorf("matrix is %q, want %q", statuses["test"], test.want)
+			}
+			// Dependents run only when no combination failed
+			if _, status, _ := needsOutcome(&models.Job{Needs: `["test"]`}, statuses); status != test.wantStatus {
+				t.Errorf("dependents see %s, want %s", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdvanceRunCascade(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	run := startTestRun(t, s, fmt.Sprintf(`
+name: cascade
+jobs:
+  build:
+    runs-on: %[1]s
+    steps:
+      - run: make
+  test:
+    needs: [build]
+    runs-on: %[1]s
+    steps:
+      - run: make test
+  deploy:
+    needs: [test]
+    runs-on: %[1]s
+    steps:
+      - run: make deploy
+  report:
+    needs: [deploy]
+    if: always()
+    runs-on: %[1]s
+    steps:
+      - run: make report
+`, runner.ID))
+
+	assignment, err := s.AcquireJob(runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: assignment.JobID, Status: "failed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var jobs []models.Job
+	if err := db.Where("run_id = ?", run.ID).Find(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	reasons := make(map[string]string)
+	for _, job := range jobs {
+		got[job.Name] = job.Status
+		reasons[job.Name] = job.StatusReason
+	}
+	want := map[string]string{"build": "failed", "test": "skipped", "deploy": "skipped", "report": "queued"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got job statuses %v, want %v", got, want)
+	}
+	if reason := `needed job "build" did not succeed`; reasons["test"] != reason {
+		t.Errorf("test was skipped with reason %q, want %q", reasons["test"], reason)
+	}
+	if reason := `needed job "test" did not succeed`; reasons["deploy"] != reason {
+		t.Errorf("deploy was skipped with reason %q, want %q", reasons["deploy"], reason)
+	}
+
+	var skippedSteps int64
+	if err := db.Model(&models.Step{}).Joins("JOIN jobs ON jobs.id = steps.job_id").
+		Where("jobs.run_id = ? AND jobs.name IN ? AND steps.status = ?", run.ID, []string{"test", "deploy"}, "skipped").
+		Count(&skippedSteps).Error; err != nil {
+		t.Fatal(err)
+	}
+	if skippedSteps != 2 {
+		t.Errorf("%d steps of the skipped jobs were skipped, want 2", skippedSteps)
+	}
+}
@@ -0,0 +1,255 @@
+package workflow
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+)
+
+// Executor carries queued jobs through to a result. Whatever executes the job
+// reports back through RecordStepResult and RecordJobResult, which is what
+// drives the run forward. Enqueue is handed the jobs a run released at once.
+type Executor interface {
+	Enqueue(jobs []*models.Job) error
+}
+
+// RunnerExecutor hands jobs to federated runners. Queued jobs stay in the
+// database until a runner leases one through AcquireJob.
+type RunnerExecutor struct {
+	db *gorm.DB
+}
+
+func NewRunnerExecutor(db *gorm.DB) *RunnerExecutor {
+	return &RunnerExecutor{db: db}
+}
+
+func (e *RunnerExecutor) Enqueue(jobs []*models.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	runners, err := onlineRunners(e.db)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		log.Printf("Job %d (%s) of run %d queued for runners", job.ID, job.Name, job.RunID)
+		if err := updateWaitingReason(e.db, job, runners); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceRun releases every pending job of the run whose needs have all
+// finished and whose if: condition holds, skips the jobs whose condition does
+// not, and then derives the run status from the outcome of its jobs. Without
+// an explicit condition a job only runs when all of its needs succeeded.
+// Released jobs are enqueued together, so independent jobs run in parallel,
+// up to the max-parallel limit of a matrix.
+//
+// The jobs are settled with the run locked, so that concurrent calls for the
+// same run, e.g. for two jobs finishing at once, do not both find room under
+// max-parallel. Released jobs go to the executor once the lock is given up.
+func (s *Service) advanceRun(runID uint) error {
+	var released []*models.Job
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.Run{}, runID).Error; err != nil {
+			return err
+		}
+		var run models.Run
+		if err := tx.Preload("Workflow").First(&run, runID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		released, err = s.withDB(tx).settleJobs(&run)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.executor.Enqueue(released); err != nil {
+		return err
+	}
+
+	return s.updateRunStatus(runID)
+}
+
+// withDB returns a copy of the service that works through db, such as a
+// transaction
+func (s *Service) withDB(db *gorm.DB) *Service {
+	scoped := *s
+	scoped.db = db
+	return &scoped
+}
+
+// settleJobs does the work of advanceRun for a locked run. It moves the
+// released jobs to the queue and returns them.
+func (s *Service) settleJobs(run *models.Run) ([]*models.Job, error) {
+	var jobs []models.Job
+	if err := s.db.Where("run_id = ?", run.ID).Order("id ASC").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	// A failed matrix job cancels the other combinations: those that have not
+	// started yet right away, running ones through their runners
+	for i := range jobs {
+		job := &jobs[i]
+		if !job.FailFast {
+			continue
+		}
+		failed := failedSibling(job, jobs)
+		if failed == nil {
+			continue
+		}
+
+		switch {
+		case job.Status == "pending" || job.Status == "queued":
+			if err := s.cancelJob(job, fmt.Sprintf("cancelled because %q failed", failed.Name)); err != nil {
+				return nil, err
+			}
+			job.Status = "cancelled"
+		case job.Status == "running" && job.CancelRequestedAt == nil:
+			now := time.Now()
+			if err := s.db.Model(job).Where("status = ?", "running").
+				Update("cancel_requested_at", now).Error; err != nil {
+				return nil, err
+			}
+			job.CancelRequestedAt = &now
+		}
+	}
+
+	// Skipping a job can settle the jobs that need it, so repeat until nothing changes
+	var released []*models.Job
+	for changed := true; changed; {
+		changed = false
+		for i := range jobs {
+			job := &jobs[i]
+			if job.Status != "pending" {
+				continue
+			}
+
+			finished, status, failedNeed := needsOutcome(job, statusesByKey(jobs))
+			if !finished {
+				continue
+			}
+
+			ok, err := s.evaluateJobCondition(run, job, jobs, status)
+			switch {
+			case err != nil:
+				if err := s.failPendingJob(job, err.Error()); err != nil {
+					return nil, err
+				}
+				job.Status = "failed"
+				changed = true
+			case ok:
+				if job.MaxParallel > 0 && activeSiblings(job, jobs) >= job.MaxParallel {
+					// Released once one of the running combinations finishes
+					continue
+				}
+				job.Status = "queued"
+				released = append(released, job)
+			default:
+				reason := fmt.Sprintf("condition %q evaluated to false", job.Condition)
+				if job.Condition == "" {
+					reason = fmt.Sprintf("needed job %q did not succeed", failedNeed)
+				}
+				if err := s.skipJob(job, reason); err != nil {
+					return nil, err
+				}
+				job.Status = "skipped"
+				changed = true
+			}
+		}
+	}
+
+	queued := released[:0]
+	for _, job := range released {
+		ok, err := s.queueJob(job)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			queued = append(queued, job)
+		}
+	}
+	return queued, nil
+}
+
+// failPendingJob fails a job that cannot be started, e.g. because its
+// condition is invalid, and skips its steps
+func (s *Service) failPendingJob(job *models.Job, message string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).Where("status = ?", "pending").
+			Updates(map[string]interface{}{"status": "failed", "error": message, "finished_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		return tx.Model(&models.Step{}).Where("job_id = ?", job.ID).Update("status", "skipped").Error
+	})
+}
+
+// cancelJob cancels a job that has not been leased yet and skips its steps
+func (s *Service) cancelJob(job *models.Job, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).Where("status IN ?", []string{"pending", "queued"}).
+			Updates(map[string]interface{}{"status": "cancelled", "status_reason": reason, "finished_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		return tx.Model(&models.Step{}).Where("job_id = ?", job.ID).Update("status", "skipped").Error
+	})
+}
+
+// failedSibling returns a failed job of the same matrix, if any
+func failedSibling(job *models.Job, jobs []models.Job) *models.Job {
+	for i := range jobs {
+		other := &jobs[i]
+		if other.ID != job.ID && jobKey(other) == jobKey(job) && (other.Status == "failed" || other.Status == "timed_out") {
+			return other
+		}
+	}
+	return nil
+}
+
+// activeSiblings counts the queued and running jobs of the same matrix
+func activeSiblings(job *models.Job, jobs []models.Job) int {
+	active := 0
+	for i := range jobs {
+		other := &jobs[i]
+		if jobKey(other) == jobKey(job) && (other.Status == "queued" || other.Status == "running") {
+			active++
+		}
+	}
+	return active
+}
+
+// skipJob marks a pending job and all of its steps as skipped
+func (s *Service) skipJob(job *models.Job, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).Where("status = ?", "pending").
+			Updates(map[string]interface{}{"status": "skipped", "status_reason": reason})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		return tx.Model(&models.Step{}).Where("job_id = ?", job.ID).Update("status", "skipped").Error
+	})
+}
+
+// queueJob moves a pending job to the queue. It reports whether the job was
+// still pending; only the caller that wins the pending -> queued transition
+// hands the job to the executor.
+func (s *Service) queueJob(job *models.Job) (bool, error) {
+	result := s.db.Model(job).Where("status = ?", "pending").Update("status", "queued")
+	return result.RowsAffected > 0, result.Error
+}
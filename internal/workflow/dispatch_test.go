@@ -0,0 +1,505 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// testDB connects to the Postgres database named by
+// RELAYFORGE_TEST_DATABASE_URL, skipping the test without one. Row locking
+// cannot be tested against anything else.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("RELAYFORGE_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("RELAYFORGE_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Workflow{}, &models.Run{},
+		&models.Job{}, &models.Step{}, &models.Log{}, &models.Runner{}, &models.RunnerToken{}, &models.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestWorkflow creates an active workflow with yamlContent for a new
+// user
+func createTestWorkflow(t *testing.T, db *gorm.DB, yamlContent string) *models.Workflow {
+	t.Helper()
+	id := time.Now().UnixNano()
+	user := &models.User{GitHubID: id, Username: fmt.Sprintf("test-%d", id)}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	workflow := &models.Workflow{UserID: user.ID, Name: t.Name(), YAMLContent: yamlContent, IsActive: true}
+	if err := db.Create(workflow).Error; err != nil {
+		t.Fatal(err)
+	}
+	return workflow
+}
+
+// finishRunOnCleanup ends a run once the test is over, so that the jobs it
+// left queued are not leased by later tests
+func finishRunOnCleanup(t *testing.T, db *gorm.DB, runID uint) {
+	t.Cleanup(func() {
+		db.Model(&models.Run{}).Where("id = ? AND status IN ?", runID, []string{"pending", "running"}).
+			Update("status", "cancelled")
+	})
+}
+
+// createTestRun creates a running run of a workflow with yamlContent
+func createTestRun(t *testing.T, db *gorm.DB, yamlContent string) *models.Run {
+	t.Helper()
+	workflow := createTestWorkflow(t, db, yamlContent)
+	run := &models.Run{WorkflowID: workflow.ID, UserID: workflow.UserID, Status: "running", YAMLContent: yamlContent}
+	if err := db.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	finishRunOnCleanup(t, db, run.ID)
+	return run
+}
+
+// startTestRun starts a run of a new workflow with yamlContent through
+// CreateRun
+func startTestRun(t *testing.T, s *Service, yamlContent string) *models.Run {
+	t.Helper()
+	workflow := createTestWorkflow(t, s.db, yamlContent)
+	run, err := s.CreateRun(workflow.ID, workflow.UserID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finishRunOnCleanup(t, s.db, run.ID)
+	return run
+}
+
+// createTestRunner creates an online runner carrying labels. Its ID is
+// unique, and so is its first label, so that a test can require it.
+func createTestRunner(t *testing.T, db *gorm.DB, labels ...string) *models.Runner {
+	t.Helper()
+	id := fmt.Sprintf("runner-%d", time.Now().UnixNano())
+	tags, _ := json.Marshal(append([]string{id}, labels...))
+	runner := &models.Runner{ID: id, Name: id, Status: "online", LastSeen: time.Now(), Tags: string(tags)}
+	if err := db.Create(runner).Error; err != nil {
+		t.Fatal(err)
+	}
+	return runner
+}
+
+// nopExecutor leaves queued jobs in the queue
+type nopExecutor struct{}
+
+func (nopExecutor) Enqueue(jobs []*models.Job) error { return nil }
+
+func TestAdvanceRunMaxParallelConcurrent(t *testing.T) {
+	const (
+		combinations = 12
+		maxParallel  = 2
+	)
+
+	db := testDB(t)
+	run := createTestRun(t, db, "name: matrix\non: workflow_dispatch\njobs: {}\n")
+	for i := 0; i < combinations; i++ {
+		job := &models.Job{
+			RunID:       run.ID,
+			Name:        fmt.Sprintf("build (%d)", i),
+			Key:         "build",
+			MaxParallel: maxParallel,
+			Status:      "pending",
+			Needs:       "[]",
+			RunsOn:      "[]",
+		}
+		if err := db.Create(job).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Service{db: db, executor: nopExecutor{}}
+
+	active := func() []models.Job {
+		var jobs []models.Job
+		if err := db.Where("run_id = ? AND status IN ?", run.ID, []string{"queued", "running"}).Find(&jobs).Error; err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) > maxParallel {
+			t.Fatalf("%d jobs are queued or running at once, max-parallel is %d", len(jobs), maxParallel)
+		}
+		return jobs
+	}
+
+	if err := s.advanceRun(run.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The active jobs finish at once and each result advances the run, as
+	// concurrent RecordJobResult calls do
+	for round := 0; ; round++ {
+		jobs := active()
+		if len(jobs) == 0 {
+			break
+		}
+		if round > combinations {
+			t.Fatal("the run does not progress")
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, len(jobs))
+		for i := range jobs {
+			wg.Add(1)
+			go func(job *models.Job) {
+				defer wg.Done()
+				if err := db.Model(job).Update("status", "success").Error; err != nil {
+					errs <- err
+					return
+				}
+				errs <- s.advanceRun(run.ID)
+			}(&jobs[i])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var finished int64
+	if err := db.Model(&models.Job{}).Where("run_id = ? AND status = ?", run.ID, "success").Count(&finished).Error; err != nil {
+		t.Fatal(err)
+	}
+	if finished != combinations {
+		t.Errorf("%d of %d jobs succeeded", finished, combinations)
+	}
+	var status string
+	if err := db.Model(&models.Run{}).Where("id = ?", run.ID).Pluck("status", &status).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status != "success" {
+		t.Errorf("run status = %q, want success", status)
+	}
+}
+
+func TestBuildAssignmentUsesRunWorkflowFile(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+
+	run := startTestRun(t, s, fmt.Sprintf(`
+name: deploy
+env:
+  STAGE: started
+jobs:
+  build:
+    runs-on: %s
+    steps:
+      - run: echo one
+      - run: echo two
+`, runner.ID))
+
+	// The workflow changes while the run's job is queued
+	edited := fmt.Sprintf(`
+name: deploy
+env:
+  STAGE: edited
+jobs:
+  compile:
+    runs-on: %s
+    steps:
+      - run: echo edited
+`, runner.ID)
+	if err := db.Model(&models.Workflow{}).Where("id = ?", run.WorkflowID).Update("yaml_content", edited).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	assignment, err := s.AcquireJob(runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.RunID != run.ID {
+		t.Fatalf("leased a job of run %d, want run %d", assignment.RunID, run.ID)
+	}
+	var commands []string
+	for _, step := range assignment.JobSpec.Steps {
+		commands = append(commands, step.Run)
+	}
+	if want := []string{"echo one", "echo two"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("assigned steps %q, want %q", commands, want)
+	}
+	if stage := assignment.Workflow.Env["STAGE"]; stage != "started" {
+		t.Errorf("workflow env STAGE = %q, want started", stage)
+	}
+	if stage := assignment.Contexts["env"].(map[string]interface{})["STAGE"]; stage != "started" {
+		t.Errorf("env context STAGE = %v, want started", stage)
+	}
+}
+
+// failingSecrets fails to resolve secrets, like a database that is briefly
+// unavailable
+type failingSecrets struct{}
+
+func (failingSecrets) Resolve(userID, workflowID uint) (map[string]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+// leasedTestJob starts a run with one job that only runner can lease, and
+// leases it
+func leasedTestJob(t *testing.T, s *Service, runner *models.Runner) *models.Job {
+	t.Helper()
+	startTestRun(t, s, fmt.Sprintf("name: lease\njobs:\n  build:\n    runs-on: %s\n    steps:\n      - run: make\n", runner.ID))
+	assignment, err := s.AcquireJob(runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job models.Job
+	if err := s.db.First(&job, assignment.JobID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &job
+}
+
+func TestAcquireJobConcurrent(t *testing.T) {
+	const jobs = 8
+
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	pool := fmt.Sprintf("pool-%d", time.Now().UnixNano())
+	var runners []*models.Runner
+	for i := 0; i < 4; i++ {
+		runners = append(runners, createTestRunner(t, db, pool))
+	}
+
+	yamlContent := "name: fan-out\njobs:\n"
+	for i := 0; i < jobs; i++ {
+		yamlContent += fmt.Sprintf("  job%d:\n    runs-on: %s\n    steps:\n      - run: make\n", i, pool)
+	}
+	run := startTestRun(t, s, yamlContent)
+
+	var (
+		mu     sync.Mutex
+		leased = make(map[uint][]string) // job ID to the runners it was leased to
+		wg     sync.WaitGroup
+	)
+	errs := make(chan error, len(runners))
+	for _, runner := range runners {
+		wg.Add(1)
+		go func(runner *models.Runner) {
+			defer wg.Done()
+			for {
+				assignment, err := s.AcquireJob(runner)
+				if errors.Is(err, ErrNoJobAvailable) {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				mu.Lock()
+				leased[assignment.JobID] = append(leased[assignment.JobID], runner.ID)
+				mu.Unlock()
+			}
+		}(runner)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if len(leased) != jobs {
+		t.Errorf("%d jobs were leased, want %d", len(leased), jobs)
+	}
+	for jobID, holders := range leased {
+		if len(holders) != 1 {
+			t.Errorf("job %d was leased to %v", jobID, holders)
+			continue
+		}
+		var job models.Job
+		if err := db.First(&job, jobID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if job.RunID != run.ID || job.Status != "running" || job.RunnerID != holders[0] || job.LeaseExpiresAt == nil {
+			t.Errorf("job %d of run %d is %s on %q, want running on %s with a lease", jobID, job.RunID, job.Status, job.RunnerID, holders[0])
+		}
+	}
+}
+
+func TestAcquireJobLabels(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: NewRunnerExecutor(db)}
+	label := fmt.Sprintf("gpu-%d", time.Now().UnixNano())
+	partial := createTestRunner(t, db, label)
+	full := createTestRunner(t, db, label, "linux")
+
+	run := startTestRun(t, s, fmt.Sprintf(`
+name: labels
+jobs:
+  train:
+    runs-on: [%[1]s, linux]
+    steps:
+      - run: make
+  render:
+    runs-on: [%[1]s, windows]
+    steps:
+      - run: make
+`, label))
+
+	var jobs []models.Job
+	if err := db.Where("run_id = ?", run.ID).Find(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, job := range jobs {
+		reasons[job.Name] = job.StatusReason
+	}
+	want := map[string]string{
+		"train":  "",
+		"render": fmt.Sprintf("Waiting for runner: no online runner has labels %s, windows", label),
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("got waiting reasons %q, want %q", reasons, want)
+	}
+
+	if _, err := s.AcquireJob(partial); !errors.Is(err, ErrNoJobAvailable) {
+		t.Fatalf("runner without every label: got %v, want ErrNoJobAvailable", err)
+	}
+	assignment, err := s.AcquireJob(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job models.Job
+	if err := db.First(&job, assignment.JobID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.RunID != run.ID || job.Name != "train" {
+		t.Errorf("leased job %q of run %d, want train of run %d", job.Name, job.RunID, run.ID)
+	}
+	if _, err := s.AcquireJob(full); !errors.Is(err, ErrNoJobAvailable) {
+		t.Errorf("runner without the windows label: got %v, want ErrNoJobAvailable", err)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	other := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+
+	// Let the lease almost run out
+	if err := db.Model(job).Update("lease_expires_at", time.Now().Add(time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	lease, err := s.RenewLease(runner.ID, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, lease.LeaseExpiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiresAt) < LeaseDuration-time.Minute {
+		t.Errorf("renewed lease expires at %v, want about %v from now", expiresAt, LeaseDuration)
+	}
+	if lease.Cancelled {
+		t.Error("lease reports a cancellation nobody requested")
+	}
+
+	if _, err := s.RenewLease(other.ID, job.ID); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("renewing another runner's lease: got %v, want ErrLeaseNotHeld", err)
+	}
+
+	if err := db.Model(job).Update("cancel_requested_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if lease, err := s.RenewLease(runner.ID, job.ID); err != nil || !lease.Cancelled {
+		t.Errorf("got lease %+v, %v; want one reporting the cancellation", lease, err)
+	}
+
+	if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: job.ID, Status: "success"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RenewLease(runner.ID, job.ID); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("renewing the lease of a finished job: got %v, want ErrLeaseNotHeld", err)
+	}
+}
+
+func TestAcquireJobReleasesOnTransientError(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}, secrets: failingSecrets{}}
+	runner := createTestRunner(t, db)
+	run := startTestRun(t, s, fmt.Sprintf("name: release\njobs:\n  build:\n    runs-on: %s\n    steps:\n      - run: make\n", runner.ID))
+
+	if _, err := s.AcquireJob(runner); err == nil || errors.Is(err, ErrNoJobAvailable) {
+		t.Fatalf("got %v, want the secrets error", err)
+	}
+
+	var job models.Job
+	if err := db.Where("run_id = ?", run.ID).First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != "queued" || job.RunnerID != "" || job.StartedAt != nil || job.LeaseExpiresAt != nil {
+		t.Fatalf("job is %s on %q (started %v, lease %v), want it queued again", job.Status, job.RunnerID, job.StartedAt, job.LeaseExpiresAt)
+	}
+
+	// Releasing on behalf of a runner that does not hold the job does nothing
+	s.secrets = nil
+	assignment, err := s.AcquireJob(runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := createTestRunner(t, db)
+	if err := releaseJob(db, &job, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RenewLease(runner.ID, assignment.JobID); err != nil {
+		t.Errorf("lease lost after another runner released the job: %v", err)
+	}
+}
+
+func TestAcquireJobFailsInvalidJob(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	run := startTestRun(t, s, fmt.Sprintf("name: invalid\njobs:\n  build:\n    runs-on: %s\n    steps:\n      - run: make\n", runner.ID))
+
+	// The run's own file no longer defines the job, which retrying cannot fix
+	renamed := fmt.Sprintf("name: invalid\njobs:\n  compile:\n    runs-on: %s\n    steps:\n      - run: make\n", runner.ID)
+	if err := db.Model(run).Update("yaml_content", renamed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AcquireJob(runner); !errors.Is(err, ErrNoJobAvailable) {
+		t.Fatalf("got %v, want ErrNoJobAvailable", err)
+	}
+	var job models.Job
+	if err := db.Where("run_id = ?", run.ID).First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != "failed" || !strings.Contains(job.Error, `job "build" not found`) {
+		t.Errorf("job is %s with error %q, want it failed as not found", job.Status, job.Error)
+	}
+	var status string
+	if err := db.Model(&models.Run{}).Where("id = ?", run.ID).Pluck("status", &status).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status != "failed" {
+		t.Errorf("run status = %q, want failed", status)
+	}
+}
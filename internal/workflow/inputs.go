@@ -0,0 +1,141 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// ErrInvalidInputs is returned when a run is started with inputs that do not
+// match the inputs the workflow declares.
+var ErrInvalidInputs = errors.New("invalid inputs")
+
+// declaredInputs returns the workflow_dispatch inputs of a workflow
+func declaredInputs(spec *types.WorkflowSpec) map[string]types.InputSpec {
+	if spec.On.WorkflowDispatch == nil {
+		return nil
+	}
+	return spec.On.WorkflowDispatch.Inputs
+}
+
+// validateInputSpec checks an input declaration: a known type, options for
+// choice inputs and a default that fits the type.
+func validateInputSpec(input types.InputSpec) error {
+	switch input.Type {
+	case "", types.InputTypeString, types.InputTypeBoolean, types.InputTypeNumber:
+	case types.InputTypeChoice:
+		if len(input.Options) == 0 {
+			return fmt.Errorf("choice inputs need options")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", input.Type)
+	}
+
+	if input.Default != nil {
+		if _, err := coerceInput(input, input.Default); err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+	}
+	return nil
+}
+
+// resolveInputs validates the inputs a run was started with against the
+// workflow's declarations, coerces them to their declared types and fills in
+// defaults. Optional inputs without a value or default are left out.
+func resolveInputs(spec *types.WorkflowSpec, supplied map[string]interface{}) (map[string]interface{}, error) {
+	declared := declaredInputs(spec)
+	resolved := make(map[string]interface{}, len(declared))
+
+	for name := range supplied {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("%w: unknown input %q", ErrInvalidInputs, name)
+		}
+	}
+
+	for name, input := range declared {
+		value, ok := supplied[name]
+		if !ok || value == nil {
+			value = input.Default
+		}
+		if value == nil {
+			if input.Required {
+				return nil, fmt.Errorf("%w: input %q is required", ErrInvalidInputs, name)
+			}
+			continue
+		}
+
+		coerced, err := coerceInput(input, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: input %q: %v", ErrInvalidInputs, name, err)
+		}
+		resolved[name] = coerced
+	}
+	return resolved, nil
+}
+
+// coerceInput converts a value to the declared type of an input. Strings are
+// accepted for every type, so inputs can come from a form or the CLI.
+func coerceInput(input types.InputSpec, value interface{}) (interface{}, error) {
+	switch input.Type {
+	case types.InputTypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a boolean", v)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("%v is not a boolean", value)
+
+	case types.InputTypeNumber:
+		var n float64
+		switch v := value.(type) {
+		case float64:
+			n = v
+		case int:
+			n = float64(v)
+		case string:
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			n = parsed
+		default:
+			return nil, fmt.Errorf("%v is not a number", value)
+		}
+		// Inputs are stored as JSON, which has no NaN or infinities
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%v is not a finite number", n)
+		}
+		return n, nil
+
+	case types.InputTypeChoice:
+		s := inputString(value)
+		for _, option := range input.Options {
+			if s == option {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not one of %s", s, strings.Join(input.Options, ", "))
+	}
+
+	return inputString(value), nil
+}
+
+// inputString formats a scalar input value as a string
+func inputString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,179 @@
+package workflow
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestResolveInputs(t *testing.T) {
+	declared := map[string]types.InputSpec{
+		"environment": {Type: types.InputTypeChoice, Options: []string{"staging", "production"}, Default: "staging"},
+		"dry-run":     {Type: types.InputTypeBoolean, Default: true},
+		"replicas":    {Type: types.InputTypeNumber, Default: 1},
+		"version":     {Required: true},
+		"note":        {},
+	}
+
+	tests := []struct {
+		name     string
+		supplied map[string]interface{}
+		want     map[string]interface{}
+		err      string
+	}{
+		{
+			name:     "defaults",
+			supplied: map[string]interface{}{"version": "1.2.0"},
+			want:     map[string]interface{}{"environment": "staging", "dry-run": true, "replicas": 1.0, "version": "1.2.0"},
+		},
+		{
+			name: "typed values",
+			supplied: map[string]interface{}{
+				"environment": "production", "dry-run": false, "replicas": 3.0, "version": "1.2.0", "note": "hotfix",
+			},
+			want: map[string]interface{}{"environment": "production", "dry-run": false, "replicas": 3.0, "version": "1.2.0", "note": "hotfix"},
+		},
+		{
+			name:     "strings from a form",
+			supplied: map[string]interface{}{"dry-run": " false ", "replicas": "2.5", "version": "1.2.0"},
+			want:     map[string]interface{}{"environment": "staging", "dry-run": false, "replicas": 2.5, "version": "1.2.0"},
+		},
+		{
+			name:     "numbers as strings",
+			supplied: map[string]interface{}{"version": 2.0, "note": 10},
+			want:     map[string]interface{}{"environment": "staging", "dry-run": true, "replicas": 1.0, "version": "2", "note": "10"},
+		},
+		{
+			name:     "null takes the default",
+			supplied: map[string]interface{}{"environment": nil, "version": "1.2.0"},
+			want:     map[string]interface{}{"environment": "staging", "dry-run": true, "replicas": 1.0, "version": "1.2.0"},
+		},
+		{
+			name:     "missing required",
+			supplied: map[string]interface{}{},
+			err:      `input "version" is required`,
+		},
+		{
+			name:     "null required",
+			supplied: map[string]interface{}{"version": nil},
+			err:      `input "version" is required`,
+		},
+		{
+			name:     "unknown input",
+			supplied: map[string]interface{}{"version": "1.2.0", "region": "eu"},
+			err:      `unknown input "region"`,
+		},
+		{
+			name:     "choice not an option",
+			supplied: map[string]interface{}{"version": "1.2.0", "environment": "dev"},
+			err:      `input "environment": "dev" is not one of staging, production`,
+		},
+		{
+			name:     "not a boolean",
+			supplied: map[string]interface{}{"version": "1.2.0", "dry-run": "maybe"},
+			err:      `input "dry-run": "maybe" is not a boolean`,
+		},
+		{
+			name:     "boolean of another type",
+			supplied: map[string]interface{}{"version": "1.2.0", "dry-run": 1.0},
+			err:      `input "dry-run": 1 is not a boolean`,
+		},
+		{
+			name:     "not a number",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": "three"},
+			err:      `input "replicas": "three" is not a number`,
+		},
+		{
+			name:     "NaN",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": "NaN"},
+			err:      `input "replicas": NaN is not a finite number`,
+		},
+		{
+			name:     "infinity",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": "+Inf"},
+			err:      `input "replicas": +Inf is not a finite number`,
+		},
+		{
+			name:     "negative infinity",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": " -inf "},
+			err:      `input "replicas": -Inf is not a finite number`,
+		},
+		{
+			name:     "infinite float",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": math.Inf(1)},
+			err:      `input "replicas": +Inf is not a finite number`,
+		},
+		{
+			name:     "number of another type",
+			supplied: map[string]interface{}{"version": "1.2.0", "replicas": true},
+			err:      `input "replicas": true is not a number`,
+		},
+	}
+
+	spec := &types.WorkflowSpec{On: types.TriggerSpec{WorkflowDispatch: &types.WorkflowDispatchSpec{Inputs: declared}}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveInputs(spec, test.supplied)
+			if test.err != "" {
+				if !errors.Is(err, ErrInvalidInputs) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want ErrInvalidInputs with %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveInputsUndeclared(t *testing.T) {
+	spec := &types.WorkflowSpec{}
+	if got, err := resolveInputs(spec, nil); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v; want no inputs", got, err)
+	}
+	if _, err := resolveInputs(spec, map[string]interface{}{"version": "1"}); !errors.Is(err, ErrInvalidInputs) {
+		t.Errorf("got error %v, want ErrInvalidInputs", err)
+	}
+}
+
+func TestValidateInputSpec(t *testing.T) {
+	tests := []struct {
+		name  string
+		input types.InputSpec
+		err   string
+	}{
+		{name: "untyped", input: types.InputSpec{Default: "x"}},
+		{name: "boolean", input: types.InputSpec{Type: types.InputTypeBoolean, Default: "true"}},
+		{name: "number", input: types.InputSpec{Type: types.InputTypeNumber, Default: 2}},
+		{name: "choice", input: types.InputSpec{Type: types.InputTypeChoice, Options: []string{"a", "b"}, Default: "b"}},
+		{name: "unknown type", input: types.InputSpec{Type: "list"}, err: `unknown type "list"`},
+		{name: "choice without options", input: types.InputSpec{Type: types.InputTypeChoice}, err: "choice inputs need options"},
+		{name: "default not an option", input: types.InputSpec{Type: types.InputTypeChoice, Options: []string{"a"}, Default: "c"}, err: `default: "c" is not one of a`},
+		{name: "default not a boolean", input: types.InputSpec{Type: types.InputTypeBoolean, Default: "yes"}, err: `default: "yes" is not a boolean`},
+		{name: "default NaN", input: types.InputSpec{Type: types.InputTypeNumber, Default: math.NaN()}, err: "default: NaN is not a finite number"},
+		{name: "default not a number", input: types.InputSpec{Type: types.InputTypeNumber, Default: "many"}, err: `default: "many" is not a number`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateInputSpec(test.input)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
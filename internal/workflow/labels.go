@@ -0,0 +1,91 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+)
+
+// decodeLabels decodes a JSON array of labels as stored on jobs and runners
+func decodeLabels(value string) []string {
+	var labels []string
+	if value != "" {
+		json.Unmarshal([]byte(value), &labels)
+	}
+	return labels
+}
+
+// labelsSatisfied reports whether carried contains every required label
+func labelsSatisfied(required, carried []string) bool {
+	have := make(map[string]bool, len(carried))
+	for _, label := range carried {
+		have[label] = true
+	}
+	for _, label := range required {
+		if !have[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// onlineRunners returns the runners that can still pick up jobs
+func onlineRunners(db *gorm.DB) ([]models.Runner, error) {
+	var runners []models.Runner
+	err := db.Where("status IN ?", []string{"online", "busy"}).Find(&runners).Error
+	return runners, err
+}
+
+// waitingReason explains why a queued job is waiting when none of the given
+// runners is able to lease it, and is empty otherwise
+func waitingReason(job *models.Job, runners []models.Runner) string {
+	required := decodeLabels(job.RunsOn)
+	for i := range runners {
+		if labelsSatisfied(required, decodeLabels(runners[i].Tags)) {
+			return ""
+		}
+	}
+	if len(required) == 0 {
+		return "Waiting for runner: no runner is online"
+	}
+	return fmt.Sprintf("Waiting for runner: no online runner has labels %s", strings.Join(required, ", "))
+}
+
+// updateWaitingReason records on a queued job whether any of the given
+// runners is able to lease it.
+func updateWaitingReason(db *gorm.DB, job *models.Job, runners []models.Runner) error {
+	reason := waitingReason(job, runners)
+	if reason == job.StatusReason {
+		return nil
+	}
+	job.StatusReason = reason
+	return db.Model(job).Where("status = ?", "queued").Update("status_reason", reason).Error
+}
+
+// UpdateWaitingReasons re-evaluates the waiting reason of every queued job.
+// It should be called whenever the set of online runners changes.
+func (s *Service) UpdateWaitingReasons() error {
+	var jobs []models.Job
+	if err := s.db.Where("status = ?", "queued").Find(&jobs).Error; err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	runners, err := onlineRunners(s.db)
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		if err := updateWaitingReason(s.db, &jobs[i], runners); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package workflow
+
+import (
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+)
+
+func TestLabelsSatisfied(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		carried  []string
+		want     bool
+	}{
+		{name: "nothing required", carried: []string{"linux"}, want: true},
+		{name: "nothing required or carried", want: true},
+		{name: "every label", required: []string{"linux", "docker"}, carried: []string{"docker", "gpu", "linux"}, want: true},
+		{name: "missing a label", required: []string{"linux", "docker"}, carried: []string{"linux"}},
+		{name: "no labels carried", required: []string{"linux"}},
+		{name: "case sensitive", required: []string{"Linux"}, carried: []string{"linux"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := labelsSatisfied(test.required, test.carried); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWaitingReason(t *testing.T) {
+	runners := []models.Runner{
+		{ID: "a", Tags: `["linux"]`},
+		{ID: "b", Tags: `["linux","docker"]`},
+		{ID: "c"},
+	}
+
+	tests := []struct {
+		name    string
+		runsOn  string
+		runners []models.Runner
+		want    string
+	}{
+		{name: "any runner", runsOn: `[]`, runners: runners},
+		{name: "runs-on not recorded", runsOn: "", runners: runners},
+		{name: "one runner has every label", runsOn: `["linux","docker"]`, runners: runners},
+		{name: "no runner has every label", runsOn: `["docker","gpu"]`, runners: runners, want: "Waiting for runner: no online runner has labels docker, gpu"},
+		{name: "no runner online", runsOn: `[]`, want: "Waiting for runner: no runner is online"},
+		{name: "no runner online for labels", runsOn: `["linux"]`, want: "Waiting for runner: no online runner has labels linux"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := waitingReason(&models.Job{RunsOn: test.runsOn}, test.runners); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
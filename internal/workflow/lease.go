@@ -0,0 +1,247 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// LeaseDuration is how long a runner may hold a job without renewing its lease.
+const LeaseDuration = 2 * time.Minute
+
+var (
+	// ErrNoJobAvailable is returned when there is no job a runner can acquire.
+	ErrNoJobAvailable = errors.New("no job available")
+	// ErrLeaseNotHeld is returned when a runner touches a job it does not hold.
+	ErrLeaseNotHeld = errors.New("job is not leased to this runner")
+)
+
+// AcquireJob atomically claims the oldest queued job whose runs-on labels are
+// all carried by the runner, and returns its assignment. Concurrent runners
+// never receive the same job: the candidate row is locked with
+// FOR UPDATE SKIP LOCKED.
+func (s *Service) AcquireJob(runner *models.Runner) (*types.JobAssignment, error) {
+	var job models.Job
+	now := time.Now()
+	runnerID := runner.ID
+	tags := runner.Tags
+	if tags == "" {
+		tags = "[]"
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		activeRuns := tx.Model(&models.Run{}).
+			Select("id").
+			Where("status IN ?", []string{"pending", "running"})
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND run_id IN (?)", "queued", activeRuns).
+			Where("COALESCE(NULLIF(runs_on, ''), '[]')::jsonb <@ ?::jsonb", tags).
+			Order("id ASC").
+			First(&job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNoJobAvailable
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := leaseJob(tx, &job, runnerID, now); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Runner{}).
+			Where("id = ?", runnerID).
+			Updates(map[string]interface{}{"status": "busy", "last_seen": now}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	assignment, err := s.buildAssignment(&job)
+	var invalid *invalidJobError
+	switch {
+	case errors.As(err, &invalid):
+		// The job can never be executed; fail it like a job that cannot start
+		if err := s.failLeasedJob(&job, runnerID, invalid.Error()); err != nil {
+			return nil, err
+		}
+		if err := s.advanceRun(job.RunID); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoJobAvailable
+	case err != nil:
+		// Give the job back so that it is leased again once the error is gone
+		if rollbackErr := releaseJob(s.db, &job, runnerID); rollbackErr != nil {
+			return nil, fmt.Errorf("%v (releasing job %d: %v)", err, job.ID, rollbackErr)
+		}
+		return nil, err
+	}
+
+	return assignment, nil
+}
+
+// invalidJobError reports a job that can never be executed, e.g. because its
+// workflow no longer defines it
+type invalidJobError struct {
+	message string
+}
+
+func (e *invalidJobError) Error() string {
+	return e.message
+}
+
+func invalidJob(format string, args ...interface{}) error {
+	return &invalidJobError{message: fmt.Sprintf(format, args...)}
+}
+
+// releaseJob undoes leaseJob for a job whose assignment could not be built,
+// queueing it again
+func releaseJob(db *gorm.DB, job *models.Job, runnerID string) error {
+	return db.Model(job).
+		Where("status = ? AND runner_id = ?", "running", runnerID).
+		Updates(map[string]interface{}{
+			"status":           "queued",
+			"runner_id":        "",
+			"started_at":       nil,
+			"lease_expires_at": nil,
+			"timeout_at":       nil,
+		}).Error
+}
+
+// failLeasedJob fails a job that was just leased but can never be executed,
+// and skips its steps
+func (s *Service) failLeasedJob(job *models.Job, runnerID, message string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).Where("status = ? AND runner_id = ?", "running", runnerID).
+			Updates(map[string]interface{}{"status": "failed", "error": message, "finished_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		return tx.Model(&models.Step{}).Where("job_id = ?", job.ID).Update("status", "skipped").Error
+	})
+}
+
+// leaseJob marks a queued job as running on the given runner and starts its
+// run if this is the first job to be picked up.
+func leaseJob(tx *gorm.DB, job *models.Job, runnerID string, now time.Time) error {
+	leaseExpiresAt := now.Add(LeaseDuration)
+	var timeoutAt *time.Time
+	if job.TimeoutSeconds > 0 {
+		t := now.Add(time.Duration(job.TimeoutSeconds) * time.Second)
+		timeoutAt = &t
+	}
+
+	result := tx.Model(job).
+		Where("status = ?", "queued").
+		Updates(map[string]interface{}{
+			"status":           "running",
+			"status_reason":    "",
+			"runner_id":        runnerID,
+			"started_at":       now,
+			"lease_expires_at": leaseExpiresAt,
+			"timeout_at":       timeoutAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoJobAvailable
+	}
+
+	job.Status = "running"
+	job.RunnerID = runnerID
+	job.StartedAt = &now
+	job.LeaseExpiresAt = &leaseExpiresAt
+	job.TimeoutAt = timeoutAt
+
+	return tx.Model(&models.Run{}).
+		Where("id = ? AND status = ?", job.RunID, "pending").
+		Updates(map[string]interface{}{"status": "running", "started_at": now}).Error
+}
+
+// RenewLease extends the lease the runner holds on a running job. The lease
+// tells the runner whether the job has been cancelled meanwhile.
+func (s *Service) RenewLease(runnerID string, jobID uint) (*types.JobLease, error) {
+	job, err := s.leasedJob(runnerID, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseExpiresAt := time.Now().Add(LeaseDuration)
+	result := s.db.Model(job).
+		Where("runner_id = ? AND status = ?", runnerID, "running").
+		Update("lease_expires_at", leaseExpiresAt)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrLeaseNotHeld
+	}
+
+	return &types.JobLease{
+		JobID:          jobID,
+		LeaseExpiresAt: leaseExpiresAt.Format(time.RFC3339),
+		Cancelled:      job.CancelRequestedAt != nil,
+	}, nil
+}
+
+// buildAssignment resolves the workflow spec of a leased job. Errors that
+// retrying cannot fix are invalidJobErrors.
+func (s *Service) buildAssignment(job *models.Job) (*types.JobAssignment, error) {
+	var run models.Run
+	if err := s.db.Preload("Workflow").First(&run, job.RunID).Error; err != nil {
+		return nil, err
+	}
+
+	spec, err := runSpec(&run)
+	if err != nil {
+		return nil, invalidJob("%v", err)
+	}
+
+	jobSpec, ok := spec.Jobs[jobKey(job)]
+	if !ok {
+		return nil, invalidJob("job %q not found in workflow %d", jobKey(job), run.WorkflowID)
+	}
+
+	var stepIDs []uint
+	if err := s.db.Model(&models.Step{}).Where("job_id = ?", job.ID).
+		Order("id ASC").Pluck("id", &stepIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(stepIDs) != len(jobSpec.Steps) {
+		return nil, invalidJob("job %q has %d steps but the workflow defines %d", job.Name, len(stepIDs), len(jobSpec.Steps))
+	}
+
+	var jobs []models.Job
+	if err := s.db.Where("run_id = ?", job.RunID).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	// Secrets are only ever decrypted for the runner leasing the job
+	contexts := s.expressionContexts(&run, job, jobs)
+	secrets := map[string]string{}
+	if s.secrets != nil {
+		if secrets, err = s.secrets.Resolve(run.UserID, run.WorkflowID); err != nil {
+			return nil, err
+		}
+	}
+	contexts["secrets"] = secrets
+
+	return &types.JobAssignment{
+		JobID:          job.ID,
+		RunID:          job.RunID,
+		JobSpec:        jobSpec,
+		Workflow:       *spec,
+		StepIDs:        stepIDs,
+		LeaseExpiresAt: job.LeaseExpiresAt.Format(time.RFC3339),
+		Contexts:       contexts,
+	}, nil
+}
@@ -0,0 +1,190 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// ErrInvalidLogs is returned when a runner streams malformed log lines.
+var ErrInvalidLogs = errors.New("invalid log lines")
+
+// maxLogBatch is the largest number of lines accepted in one request.
+const maxLogBatch = 1000
+
+var logStreamLevels = map[string]string{"stdout": "info", "stderr": "error"}
+
+// LogPublisher is told about the log entries of a run once they are stored.
+type LogPublisher interface {
+	PublishLogs(entries []types.LogEntry)
+}
+
+// AppendStepLogs stores lines of output streamed by the runner holding the
+// job's lease while a step runs. Lines are identified by their sequence
+// number within the current attempt of the job, so a batch that is sent
+// again after a failed request does not store its lines twice.
+func (s *Service) AppendStepLogs(runnerID string, jobID, stepID uint, lines []types.LogLine) error {
+	if len(lines) > maxLogBatch {
+		return fmt.Errorf("%w: more than %d lines", ErrInvalidLogs, maxLogBatch)
+	}
+
+	job, err := s.leasedJob(runnerID, jobID)
+	if err != nil {
+		return err
+	}
+
+	var step models.Step
+	if err := s.db.Where("id = ? AND job_id = ?", stepID, jobID).First(&step).Error; err != nil {
+		return err
+	}
+
+	logs := make([]models.Log, 0, len(lines))
+	for _, line := range lines {
+		level, ok := logStreamLevels[line.Stream]
+		if !ok {
+			return fmt.Errorf("%w: unknown stream %q", ErrInvalidLogs, line.Stream)
+		}
+		if line.Sequence <= 0 {
+			return fmt.Errorf("%w: sequence must be positive", ErrInvalidLogs)
+		}
+		logs = append(logs, models.Log{
+			StepID:    step.ID,
+			Attempt:   job.Attempts,
+			Sequence:  line.Sequence,
+			Stream:    line.Stream,
+			Content:   line.Content,
+			Level:     level,
+			Timestamp: parseTimestamp(line.Timestamp),
+		})
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+
+	// Leave out the lines of a resent batch that are already stored
+	sequences := make([]int64, len(logs))
+	for i, l := range logs {
+		sequences[i] = l.Sequence
+	}
+	var stored []int64
+	if err := s.db.Model(&models.Log{}).
+		Where("step_id = ? AND attempt = ? AND sequence IN ?", step.ID, job.Attempts, sequences).
+		Pluck("sequence", &stored).Error; err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		storedSet := make(map[int64]bool, len(stored))
+		for _, sequence := range stored {
+			storedSet[sequence] = true
+		}
+		fresh := logs[:0]
+		sequences = sequences[:0]
+		for _, l := range logs {
+			if !storedSet[l.Sequence] {
+				fresh = append(fresh, l)
+				sequences = append(sequences, l.Sequence)
+			}
+		}
+		if logs = fresh; len(logs) == 0 {
+			return nil
+		}
+	}
+
+	// The same batch may still be stored concurrently. Rows skipped on conflict
+	// return no ID, so the IDs assigned to logs cannot be trusted; the stored
+	// rows are read back by sequence instead.
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&logs).Error; err != nil {
+		return err
+	}
+	var inserted []models.Log
+	if err := s.db.Where("step_id = ? AND attempt = ? AND sequence IN ?", step.ID, job.Attempts, sequences).
+		Order("id ASC").Find(&inserted).Error; err != nil {
+		return err
+	}
+	s.publishLogs(job, inserted)
+	return nil
+}
+
+// RunLogs returns up to limit log entries of a run stored after the entry
+// with ID afterID, in the order they were stored.
+func (s *Service) RunLogs(runID, afterID uint, limit int) ([]types.LogEntry, error) {
+	var rows []struct {
+		models.Log
+		JobID uint
+	}
+	err := s.db.Model(&models.Log{}).
+		Select("logs.*, steps.job_id").
+		Joins("JOIN steps ON logs.step_id = steps.id").
+		Joins("JOIN jobs ON steps.job_id = jobs.id").
+		Where("jobs.run_id = ? AND logs.id > ?", runID, afterID).
+		Order("logs.id ASC").
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]types.LogEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = logEntry(runID, row.JobID, row.Log)
+	}
+	return entries, nil
+}
+
+// JobLogs returns up to limit log entries of a job stored after the entry
+// with ID afterID, optionally only those of one step, in the order they were
+// stored.
+func (s *Service) JobLogs(job *models.Job, stepID, afterID uint, limit int) ([]types.LogEntry, error) {
+	query := s.db.Model(&models.Log{}).
+		Joins("JOIN steps ON logs.step_id = steps.id").
+		Where("steps.job_id = ? AND logs.id > ?", job.ID, afterID)
+	if stepID != 0 {
+		query = query.Where("logs.step_id = ?", stepID)
+	}
+
+	var logs []models.Log
+	if err := query.Order("logs.id ASC").Limit(limit).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]types.LogEntry, len(logs))
+	for i, l := range logs {
+		entries[i] = logEntry(job.RunID, job.ID, l)
+	}
+	return entries, nil
+}
+
+// publishLogs hands newly stored logs of a job to the log publisher. Logs
+// without an ID are left out.
+func (s *Service) publishLogs(job *models.Job, logs []models.Log) {
+	if s.logs == nil {
+		return
+	}
+
+	entries := make([]types.LogEntry, 0, len(logs))
+	for _, l := range logs {
+		if l.ID != 0 {
+			entries = append(entries, logEntry(job.RunID, job.ID, l))
+		}
+	}
+	s.logs.PublishLogs(entries)
+}
+
+func logEntry(runID, jobID uint, l models.Log) types.LogEntry {
+	return types.LogEntry{
+		ID:        l.ID,
+		RunID:     runID,
+		JobID:     jobID,
+		StepID:    l.StepID,
+		Sequence:  l.Sequence,
+		Stream:    l.Stream,
+		Content:   l.Content,
+		Level:     l.Level,
+		Timestamp: l.Timestamp.Format(time.RFC3339Nano),
+	}
+}
@@ -0,0 +1,154 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// recordingPublisher records the contents of the log entries published
+type recordingPublisher struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *recordingPublisher) PublishLogs(entries []types.LogEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, entry := range entries {
+		p.published = append(p.published, entry.Content)
+	}
+}
+
+func (p *recordingPublisher) take() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	published := p.published
+	p.published = nil
+	return published
+}
+
+// logLines returns stdout lines with sequences from first to last
+func logLines(first, last int64) []types.LogLine {
+	var lines []types.LogLine
+	for sequence := first; sequence <= last; sequence++ {
+		lines = append(lines, types.LogLine{
+			Sequence:  sequence,
+			Stream:    "stdout",
+			Content:   fmt.Sprintf("line %d", sequence),
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+		})
+	}
+	return lines
+}
+
+func TestAppendStepLogs(t *testing.T) {
+	db := testDB(t)
+	publisher := &recordingPublisher{}
+	s := &Service{db: db, executor: nopExecutor{}, logs: publisher}
+	runner := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+	step := stepID(t, s, job)
+
+	stored := func(attempt int) []string {
+		t.Helper()
+		var contents []string
+		if err := db.Model(&models.Log{}).Where("step_id = ? AND attempt = ?", step, attempt).
+			Order("id ASC").Pluck("content", &contents).Error; err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+
+	batches := []struct {
+		name          string
+		lines         []types.LogLine
+		wantPublished []string
+	}{
+		{"first batch", logLines(1, 3), []string{"line 1", "line 2", "line 3"}},
+		{"batch sent twice", logLines(1, 3), nil},
+		{"overlapping batch", logLines(2, 5), []string{"line 4", "line 5"}},
+		// Entries are published in the order they were stored
+		{"out of order", []types.LogLine{logLines(7, 7)[0], logLines(6, 6)[0]}, []string{"line 7", "line 6"}},
+	}
+	for _, batch := range batches {
+		if err := s.AppendStepLogs(runner.ID, job.ID, step, batch.lines); err != nil {
+			t.Fatalf("%s: %v", batch.name, err)
+		}
+		if got := publisher.take(); !reflect.DeepEqual(got, batch.wantPublished) {
+			t.Errorf("%s: published %q, want %q", batch.name, got, batch.wantPublished)
+		}
+	}
+
+	want := []string{"line 1", "line 2", "line 3", "line 4", "line 5", "line 7", "line 6"}
+	if got := stored(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+
+	// The same sequences of the next attempt are different lines
+	if err := db.Model(job).Update("attempts", 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendStepLogs(runner.ID, job.ID, step, logLines(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stored(1), []string{"line 1", "line 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %q for the retry, want %q", got, want)
+	}
+	if got := len(stored(0)); got != 7 {
+		t.Errorf("the first attempt has %d lines after the retry, want 7", got)
+	}
+}
+
+func TestAppendStepLogsInvalid(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+	step := stepID(t, s, job)
+
+	tests := []struct {
+		name     string
+		runnerID string
+		stepID   uint
+		lines    []types.LogLine
+		wantErr  error
+	}{
+		{"unknown stream", runner.ID, step, []types.LogLine{{Sequence: 1, Stream: "stdin"}}, ErrInvalidLogs},
+		{"no sequence", runner.ID, step, []types.LogLine{{Stream: "stdout"}}, ErrInvalidLogs},
+		{"too many lines", runner.ID, step, logLines(1, maxLogBatch+1), ErrInvalidLogs},
+		{"other runner", "runner-other", step, logLines(1, 1), ErrLeaseNotHeld},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := s.AppendStepLogs(test.runnerID, job.ID, test.stepID, test.lines); !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+
+	var count int64
+	if err := db.Model(&models.Log{}).Where("step_id = ?", step).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("stored %d lines of rejected batches", count)
+	}
+}
+
+// stepID returns the ID of the first step of a job
+func stepID(t *testing.T, s *Service, job *models.Job) uint {
+	t.Helper()
+	var step models.Step
+	if err := s.db.Where("job_id = ?", job.ID).Order("id ASC").First(&step).Error; err != nil {
+		t.Fatal(err)
+	}
+	return step.ID
+}
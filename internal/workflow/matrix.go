@@ -0,0 +1,192 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// maxMatrixJobs caps the number of jobs a single matrix expands to
+const maxMatrixJobs = 256
+
+// matrixCombination is one set of matrix values a job runs with
+type matrixCombination map[string]interface{}
+
+// expandMatrix computes the combinations a job with a matrix strategy runs
+// with, in a stable order. The cartesian product of the dimensions is
+// filtered by the exclude entries. Each include entry is then merged into
+// every combination whose original values it does not change, or added as
+// a combination of its own if there is no such combination.
+func expandMatrix(matrix types.MatrixSpec) ([]matrixCombination, error) {
+	dimensions := sortedKeys(matrix.Dimensions)
+
+	var combinations []matrixCombination
+	if len(dimensions) > 0 {
+		combinations = []matrixCombination{{}}
+		for _, dimension := range dimensions {
+			values := matrix.Dimensions[dimension]
+			if len(values) == 0 {
+				return nil, fmt.Errorf("matrix dimension %q has no values", dimension)
+			}
+
+			var product []matrixCombination
+			for _, combination := range combinations {
+				for _, value := range values {
+					next := make(matrixCombination, len(combination)+1)
+					for k, v := range combination {
+						next[k] = v
+					}
+					next[dimension] = value
+					product = append(product, next)
+				}
+			}
+			combinations = product
+			if len(combinations) > maxMatrixJobs {
+				return nil, fmt.Errorf("matrix expands to more than %d jobs", maxMatrixJobs)
+			}
+		}
+	}
+
+	for _, exclude := range matrix.Exclude {
+		for key := range exclude {
+			if _, ok := matrix.Dimensions[key]; !ok {
+				return nil, fmt.Errorf("exclude refers to unknown matrix dimension %q", key)
+			}
+		}
+
+		kept := combinations[:0]
+		for _, combination := range combinations {
+			if !combination.matches(exclude, nil) {
+				kept = append(kept, combination)
+			}
+		}
+		combinations = kept
+	}
+
+	original := len(combinations)
+	for _, include := range matrix.Include {
+		merged := false
+		for i := 0; i < original; i++ {
+			if combinations[i].matches(include, matrix.Dimensions) {
+				for k, v := range include {
+					combinations[i][k] = v
+				}
+				merged = true
+			}
+		}
+		if !merged {
+			combination := make(matrixCombination, len(include))
+			for k, v := range include {
+				combination[k] = v
+			}
+			combinations = append(combinations, combination)
+		}
+	}
+
+	if len(combinations) == 0 {
+		return nil, fmt.Errorf("matrix has no combinations")
+	}
+	if len(combinations) > maxMatrixJobs {
+		return nil, fmt.Errorf("matrix expands to more than %d jobs", maxMatrixJobs)
+	}
+	return combinations, nil
+}
+
+// matches reports whether the combination has the values of entry. If only
+// is set, keys of entry that are not in only are ignored.
+func (c matrixCombination) matches(entry map[string]interface{}, only map[string][]interface{}) bool {
+	for k, v := range entry {
+		if only != nil {
+			if _, ok := only[k]; !ok {
+				continue
+			}
+		}
+		if expr.ToString(c[k]) != expr.ToString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// name derives the name of the job running a combination, e.g.
+// "build (1.21, linux)". The values of the matrix dimensions come first,
+// followed by values added by include entries, each in key order.
+func (c matrixCombination) name(jobName string, matrix types.MatrixSpec) string {
+	var dimensions, extra []string
+	for k := range c {
+		if _, ok := matrix.Dimensions[k]; ok {
+			dimensions = append(dimensions, k)
+		} else {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(dimensions)
+	sort.Strings(extra)
+
+	var values []string
+	for _, k := range append(dimensions, extra...) {
+		values = append(values, expr.ToString(c[k]))
+	}
+	return fmt.Sprintf("%s (%s)", jobName, strings.Join(values, ", "))
+}
+
+// jobCombinations returns the matrix combinations a job runs with, or a
+// single nil combination for a job without a matrix
+func jobCombinations(jobSpec types.JobSpec) ([]matrixCombination, error) {
+	if jobSpec.Strategy == nil {
+		return []matrixCombination{nil}, nil
+	}
+	return expandMatrix(jobSpec.Strategy.Matrix)
+}
+
+// newJob builds the job of a run for one matrix combination. Expressions in
+// runs-on are resolved against the matrix values and inputs, so the
+// combinations of a job can target different runners.
+func newJob(runID uint, key string, jobSpec types.JobSpec, combination matrixCombination, inputs map[string]interface{}) (*models.Job, error) {
+	ctx := expr.NewContext()
+	ctx.Values["matrix"] = map[string]interface{}(combination)
+	ctx.Values["inputs"] = inputs
+
+	labels := make(types.Labels, len(jobSpec.RunsOn))
+	for i, label := range jobSpec.RunsOn {
+		interpolated, err := expr.Interpolate(label, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("job %q: runs-on: %v", key, err)
+		}
+		labels[i] = interpolated
+	}
+
+	// Timeouts are checked when the workflow is validated
+	var timeout time.Duration
+	if jobSpec.Timeout != "" {
+		timeout, _ = time.ParseDuration(jobSpec.Timeout)
+	}
+
+	needs, _ := json.Marshal(jobSpec.Needs)
+	runsOn, _ := json.Marshal(labels.Required())
+	job := &models.Job{
+		RunID:          runID,
+		Name:           key,
+		Key:            key,
+		Status:         "pending",
+		Needs:          string(needs),
+		RunsOn:         string(runsOn),
+		Condition:      jobSpec.If,
+		TimeoutSeconds: int((timeout + time.Second - 1) / time.Second), // rounded up, so that 500ms is not "none"
+	}
+
+	if combination != nil {
+		matrix, _ := json.Marshal(combination)
+		job.Name = combination.name(key, jobSpec.Strategy.Matrix)
+		job.Matrix = string(matrix)
+		job.MaxParallel = jobSpec.Strategy.MaxParallel
+		job.FailFast = jobSpec.Strategy.FailsFast()
+	}
+	return job, nil
+}
@@ -0,0 +1,187 @@
+package workflow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix types.MatrixSpec
+		want   []matrixCombination
+		err    string
+	}{
+		{
+			name: "product in key order",
+			matrix: types.MatrixSpec{Dimensions: map[string][]interface{}{
+				"os": {"linux", "windows"},
+				"go": {"1.20", "1.21"},
+			}},
+			want: []matrixCombination{
+				{"go": "1.20", "os": "linux"},
+				{"go": "1.20", "os": "windows"},
+				{"go": "1.21", "os": "linux"},
+				{"go": "1.21", "os": "windows"},
+			},
+		},
+		{
+			name: "exclude",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{
+					"os": {"linux", "windows"},
+					"go": {"1.20", "1.21"},
+				},
+				Exclude: []map[string]interface{}{{"os": "windows", "go": "1.20"}},
+			},
+			want: []matrixCombination{
+				{"go": "1.20", "os": "linux"},
+				{"go": "1.21", "os": "linux"},
+				{"go": "1.21", "os": "windows"},
+			},
+		},
+		{
+			name: "exclude by one dimension",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{
+					"os": {"linux", "windows"},
+					"go": {"1.20", "1.21"},
+				},
+				Exclude: []map[string]interface{}{{"os": "windows"}},
+			},
+			want: []matrixCombination{
+				{"go": "1.20", "os": "linux"},
+				{"go": "1.21", "os": "linux"},
+			},
+		},
+		{
+			name: "values compared as strings",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{"node": {18, 20}},
+				Exclude:    []map[string]interface{}{{"node": "18"}},
+			},
+			want: []matrixCombination{{"node": 20}},
+		},
+		{
+			name: "include merges into matching combinations",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{
+					"os": {"linux", "windows"},
+					"go": {"1.20", "1.21"},
+				},
+				Include: []map[string]interface{}{{"os": "windows", "shell": "pwsh"}},
+			},
+			want: []matrixCombination{
+				{"go": "1.20", "os": "linux"},
+				{"go": "1.20", "os": "windows", "shell": "pwsh"},
+				{"go": "1.21", "os": "linux"},
+				{"go": "1.21", "os": "windows", "shell": "pwsh"},
+			},
+		},
+		{
+			name: "include without a match adds a combination",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{"os": {"linux"}},
+				Include:    []map[string]interface{}{{"os": "darwin", "experimental": true}},
+			},
+			want: []matrixCombination{
+				{"os": "linux"},
+				{"os": "darwin", "experimental": true},
+			},
+		},
+		{
+			name: "include does not match added combinations",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{"os": {"linux"}},
+				Include: []map[string]interface{}{
+					{"os": "darwin"},
+					{"os": "darwin", "arch": "arm64"},
+				},
+			},
+			want: []matrixCombination{
+				{"os": "linux"},
+				{"os": "darwin"},
+				{"os": "darwin", "arch": "arm64"},
+			},
+		},
+		{
+			name: "only include entries",
+			matrix: types.MatrixSpec{Include: []map[string]interface{}{
+				{"target": "amd64"},
+				{"target": "arm64"},
+			}},
+			want: []matrixCombination{
+				{"target": "amd64"},
+				{"target": "arm64"},
+			},
+		},
+		{
+			name:   "empty dimension",
+			matrix: types.MatrixSpec{Dimensions: map[string][]interface{}{"os": {}}},
+			err:    `matrix dimension "os" has no values`,
+		},
+		{
+			name: "exclude of an unknown dimension",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{"os": {"linux"}},
+				Exclude:    []map[string]interface{}{{"arch": "arm64"}},
+			},
+			err: `exclude refers to unknown matrix dimension "arch"`,
+		},
+		{
+			name: "everything excluded",
+			matrix: types.MatrixSpec{
+				Dimensions: map[string][]interface{}{"os": {"linux"}},
+				Exclude:    []map[string]interface{}{{"os": "linux"}},
+			},
+			err: "matrix has no combinations",
+		},
+		{
+			name:   "empty matrix",
+			matrix: types.MatrixSpec{},
+			err:    "matrix has no combinations",
+		},
+		{
+			name: "too many jobs",
+			matrix: types.MatrixSpec{Dimensions: map[string][]interface{}{
+				"a": make([]interface{}, 16),
+				"b": make([]interface{}, 16),
+				"c": make([]interface{}, 2),
+			}},
+			err: "matrix expands to more than 256 jobs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandMatrix(tt.matrix)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expandMatrix() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandMatrix() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandMatrix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatrixCombinationName(t *testing.T) {
+	matrix := types.MatrixSpec{Dimensions: map[string][]interface{}{
+		"os": {"linux"},
+		"go": {1.21},
+	}}
+	combination := matrixCombination{"os": "linux", "go": 1.21, "experimental": true}
+
+	if got, want := combination.name("build", matrix), "build (1.21, linux, true)"; got != want {
+		t.Errorf("name() = %q, want %q", got, want)
+	}
+}
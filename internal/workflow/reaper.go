@@ -0,0 +1,256 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// ErrRunnerNotFound is returned for heartbeats from unknown runners.
+var ErrRunnerNotFound = errors.New("runner not found")
+
+// TimeoutGrace is how long past its timeout a running job is given to be
+// reported by its runner before the reaper times it out.
+const TimeoutGrace = 30 * time.Second
+
+// ReaperConfig controls how the reaper detects dead runners and what it does
+// with the jobs they were holding.
+type ReaperConfig struct {
+	Interval   time.Duration // how often the reaper runs
+	StaleAfter time.Duration // runners without a heartbeat for this long are offline
+	MaxRetries int           // how often a job with an expired lease is requeued before it fails
+}
+
+// DefaultReaperConfig returns the reaper settings used when none are configured.
+func DefaultReaperConfig() ReaperConfig {
+	return ReaperConfig{
+		Interval:   15 * time.Second,
+		StaleAfter: 90 * time.Second,
+		MaxRetries: 1,
+	}
+}
+
+// Heartbeat records that a runner is alive and what it is working on.
+func (s *Service) Heartbeat(runnerID string, heartbeat types.RunnerHeartbeat) (*types.HeartbeatResponse, error) {
+	var runner models.Runner
+	if err := s.db.Where("id = ?", runnerID).First(&runner).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRunnerNotFound
+		}
+		return nil, err
+	}
+
+	status := "online"
+	if len(heartbeat.ActiveJobs) > 0 {
+		status = "busy"
+	}
+	wasOffline := runner.Status == "offline"
+
+	if err := s.db.Model(&runner).Updates(map[string]interface{}{
+		"status":    status,
+		"last_seen": time.Now(),
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if wasOffline {
+		log.Printf("Runner %s is back online", runnerID)
+		if err := s.UpdateWaitingReasons(); err != nil {
+			log.Printf("Failed to update waiting reasons: %v", err)
+		}
+	}
+
+	// Tell the runner which of its jobs belong to cancelled runs
+	var cancel []uint
+	if err := s.db.Model(&models.Job{}).
+		Where("runner_id = ? AND status = ? AND cancel_requested_at IS NOT NULL", runnerID, "running").
+		Pluck("id", &cancel).Error; err != nil {
+		return nil, err
+	}
+
+	return &types.HeartbeatResponse{Status: status, Cancel: cancel}, nil
+}
+
+// RunReaper periodically marks stale runners offline, recovers jobs whose
+// lease has expired and times out jobs that ran past their timeout. It
+// blocks until ctx is cancelled.
+func (s *Service) RunReaper(ctx context.Context, config ReaperConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reap(config); err != nil {
+				log.Printf("Reaper failed: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Service) reap(config ReaperConfig) error {
+	now := time.Now()
+
+	result := s.db.Model(&models.Runner{}).
+		Where("status <> ? AND last_seen < ?", "offline", now.Add(-config.StaleAfter)).
+		Update("status", "offline")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Marked %d stale runner(s) offline", result.RowsAffected)
+		if err := s.UpdateWaitingReasons(); err != nil {
+			return err
+		}
+	}
+
+	var expired []models.Job
+	if err := s.db.Where("status = ? AND lease_expires_at < ?", "running", now).
+		Find(&expired).Error; err != nil {
+		return err
+	}
+
+	for i := range expired {
+		if err := s.recoverExpiredJob(&expired[i], config.MaxRetries); err != nil {
+			return err
+		}
+		if err := s.advanceRun(expired[i].RunID); err != nil {
+			return err
+		}
+	}
+
+	// The runner enforces timeouts itself; this catches runners that went silent
+	var overdue []models.Job
+	if err := s.db.Where("status = ? AND timeout_at < ?", "running", now.Add(-TimeoutGrace)).
+		Find(&overdue).Error; err != nil {
+		return err
+	}
+
+	for i := range overdue {
+		if err := s.timeOutJob(&overdue[i]); err != nil {
+			return err
+		}
+		if err := s.advanceRun(overdue[i].RunID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeOutJob marks a running job that passed its timeout as timed out. The
+// runner loses its lease and aborts the job on its next renewal.
+func (s *Service) timeOutJob(job *models.Job) error {
+	timeout := time.Duration(job.TimeoutSeconds) * time.Second
+	log.Printf("Job %d on runner %s exceeded its timeout of %s", job.ID, job.RunnerID, timeout)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).Where("status = ?", "running").Updates(map[string]interface{}{
+			"status":           "timed_out",
+			"error":            fmt.Sprintf("job exceeded its timeout of %s", timeout),
+			"lease_expires_at": nil,
+			"finished_at":      time.Now(),
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		if err := tx.Model(&models.Step{}).
+			Where("job_id = ? AND status = ?", job.ID, "running").
+			Updates(map[string]interface{}{"status": "timed_out", "finished_at": time.Now()}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Step{}).
+			Where("job_id = ? AND status = ?", job.ID, "pending").
+			Update("status", "skipped").Error
+	})
+}
+
+// recoverExpiredJob requeues a job whose lease expired, or fails it once it
+// has used up its retries.
+func (s *Service) recoverExpiredJob(job *models.Job, maxRetries int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Re-check under lock: the runner may have reported or renewed meanwhile
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id = ? AND status = ? AND lease_expires_at < ?", job.ID, "running", time.Now()).
+			First(job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if job.CancelRequestedAt != nil {
+			log.Printf("Lease on cancelled job %d expired on runner %s", job.ID, job.RunnerID)
+
+			if err := tx.Model(job).Updates(map[string]interface{}{
+				"status":           "cancelled",
+				"status_reason":    "Run was cancelled",
+				"lease_expires_at": nil,
+				"finished_at":      time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&models.Step{}).
+				Where("job_id = ? AND status IN ?", job.ID, []string{"pending", "running"}).
+				Update("status", "skipped").Error
+		}
+
+		if job.Attempts < maxRetries {
+			log.Printf("Lease on job %d expired on runner %s, requeueing (retry %d/%d)",
+				job.ID, job.RunnerID, job.Attempts+1, maxRetries)
+
+			if err := tx.Model(job).Updates(map[string]interface{}{
+				"status":           "pending",
+				"status_reason":    fmt.Sprintf("Requeued after runner %s stopped responding", job.RunnerID),
+				"attempts":         job.Attempts + 1,
+				"runner_id":        "",
+				"error":            "",
+				"outputs":          "",
+				"lease_expires_at": nil,
+				"timeout_at":       nil,
+				"started_at":       nil,
+			}).Error; err != nil {
+				return err
+			}
+
+			// Nothing of the lost attempt is left to show next to the retry
+			return tx.Model(&models.Step{}).Where("job_id = ?", job.ID).Updates(map[string]interface{}{
+				"status":      "pending",
+				"outcome":     "",
+				"conclusion":  "",
+				"outputs":     "",
+				"exit_code":   nil,
+				"started_at":  nil,
+				"finished_at": nil,
+			}).Error
+		}
+
+		log.Printf("Lease on job %d expired on runner %s, no retries left", job.ID, job.RunnerID)
+
+		if err := tx.Model(job).Updates(map[string]interface{}{
+			"status":           "failed",
+			"error":            fmt.Sprintf("runner %s stopped responding", job.RunnerID),
+			"lease_expires_at": nil,
+			"finished_at":      time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Step{}).
+			Where("job_id = ? AND status IN ?", job.ID, []string{"pending", "running"}).
+			Update("status", "skipped").Error
+	})
+}
@@ -0,0 +1,195 @@
+package workflow
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// expireLease lets the lease on a job run out
+func expireLease(t *testing.T, s *Service, jobID uint) {
+	t.Helper()
+	if err := s.db.Model(&models.Job{}).Where("id = ?", jobID).
+		Update("lease_expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapExpiredLeases(t *testing.T) {
+	const maxRetries = 2
+
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	config := ReaperConfig{StaleAfter: time.Hour, MaxRetries: maxRetries}
+	label := fmt.Sprintf("retry-%d", time.Now().UnixNano())
+	run := startTestRun(t, s, fmt.Sprintf("name: retry\njobs:\n  build:\n    runs-on: %s\n    steps:\n      - run: make\n      - run: make test\n", label))
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		runner := createTestRunner(t, db, label)
+		assignment, err := s.AcquireJob(runner)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+
+		// The attempt gets as far as finishing a step before its runner dies
+		if err := s.RecordStepResult(runner.ID, assignment.JobID, types.StepResult{
+			StepID: assignment.StepIDs[0], Status: "failed", Outcome: "failed", Conclusion: "success",
+			ExitCode: 2, Outputs: map[string]string{"version": "1.2.0"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Model(&models.Job{}).Where("id = ?", assignment.JobID).
+			Updates(map[string]interface{}{"error": "lost", "outputs": `{"version":"1.2.0"}`}).Error; err != nil {
+			t.Fatal(err)
+		}
+		expireLease(t, s, assignment.JobID)
+		if err := s.reap(config); err != nil {
+			t.Fatal(err)
+		}
+
+		var job models.Job
+		if err := db.Preload("Steps").First(&job, assignment.JobID).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if attempt == maxRetries {
+			want := fmt.Sprintf("runner %s stopped responding", runner.ID)
+			if job.Status != "failed" || job.Error != want || job.Attempts != maxRetries {
+				t.Errorf("after the last retry the job is %s after %d attempts with error %q, want failed with %q", job.Status, job.Attempts, job.Error, want)
+			}
+			for _, step := range job.Steps {
+				want := "skipped"
+				if step.ID == assignment.StepIDs[0] {
+					want = "failed"
+				}
+				if step.Status != want {
+					t.Errorf("step %d is %s, want %s", step.ID, step.Status, want)
+				}
+			}
+			continue
+		}
+
+		if job.Status != "queued" || job.Attempts != attempt+1 || job.RunnerID != "" || job.LeaseExpiresAt != nil || job.StartedAt != nil {
+			t.Fatalf("attempt %d: job is %s on %q after %d attempts, want it queued again", attempt, job.Status, job.RunnerID, job.Attempts)
+		}
+		if job.Error != "" || job.Outputs != "" {
+			t.Errorf("attempt %d: requeued job kept error %q and outputs %q", attempt, job.Error, job.Outputs)
+		}
+		for _, step := range job.Steps {
+			if step.Status != "pending" || step.Outcome != "" || step.Conclusion != "" || step.Outputs != "" ||
+				step.ExitCode != nil || step.StartedAt != nil || step.FinishedAt != nil {
+				t.Errorf("attempt %d: step %d kept %s, outcome %q, conclusion %q, outputs %q of the lost attempt",
+					attempt, step.ID, step.Status, step.Outcome, step.Conclusion, step.Outputs)
+			}
+		}
+	}
+
+	var status string
+	if err := db.Model(&models.Run{}).Where("id = ?", run.ID).Pluck("status", &status).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status != "failed" {
+		t.Errorf("run status = %q, want failed", status)
+	}
+}
+
+func TestReapCancelledJob(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+
+	if err := db.Model(job).Update("cancel_requested_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	expireLease(t, s, job.ID)
+	if err := s.reap(ReaperConfig{StaleAfter: time.Hour, MaxRetries: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.First(job, job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != "cancelled" || job.Attempts != 0 {
+		t.Errorf("job is %s after %d attempts, want cancelled without a retry", job.Status, job.Attempts)
+	}
+}
+
+func TestReapOverdueJob(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+
+	var steps []models.Step
+	if err := db.Where("job_id = ?", job.ID).Find(&steps).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordStepResult(runner.ID, job.ID, types.StepResult{StepID: steps[0].ID, Status: "running"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(job).Updates(map[string]interface{}{
+		"timeout_seconds": 60,
+		"timeout_at":      time.Now().Add(-TimeoutGrace - time.Second),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reap(ReaperConfig{StaleAfter: time.Hour, MaxRetries: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Preload("Steps").First(job, job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != "timed_out" || job.Error != "job exceeded its timeout of 1m0s" {
+		t.Errorf("job is %s with error %q, want timed_out", job.Status, job.Error)
+	}
+	if len(job.Steps) != 1 || job.Steps[0].Status != "timed_out" {
+		t.Errorf("got steps %+v, want the running step timed out", job.Steps)
+	}
+	if _, err := s.RenewLease(runner.ID, job.ID); err != ErrLeaseNotHeld {
+		t.Errorf("renewing the lease of a timed out job: got %v, want ErrLeaseNotHeld", err)
+	}
+}
+
+func TestReapStaleRunners(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	stale := createTestRunner(t, db)
+	busy := createTestRunner(t, db)
+	fresh := createTestRunner(t, db)
+	for runner, updates := range map[*models.Runner]map[string]interface{}{
+		stale: {"last_seen": time.Now().Add(-2 * time.Minute)},
+		busy:  {"last_seen": time.Now().Add(-2 * time.Minute), "status": "busy"},
+	} {
+		if err := db.Model(runner).Updates(updates).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.reap(ReaperConfig{StaleAfter: time.Minute, MaxRetries: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for runner, want := range map[*models.Runner]string{stale: "offline", busy: "offline", fresh: "online"} {
+		var status string
+		if err := db.Model(&models.Runner{}).Where("id = ?", runner.ID).Pluck("status", &status).Error; err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("runner %s is %s, want %s", runner.ID, status, want)
+		}
+	}
+
+	// A heartbeat brings a runner back
+	response, err := s.Heartbeat(stale.ID, types.RunnerHeartbeat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "online" {
+		t.Errorf("heartbeat status = %q, want online", response.Status)
+	}
+}
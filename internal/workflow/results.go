@@ -0,0 +1,214 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// ErrInvalidStatus is returned when a runner reports a status that is not
+// valid for the reported entity.
+var ErrInvalidStatus = errors.New("invalid status")
+
+var (
+	jobResultStatuses  = map[string]bool{"success": true, "failed": true, "timed_out": true, "cancelled": true}
+	stepResultStatuses = map[string]bool{"running": true, "success": true, "failed": true, "skipped": true, "timed_out": true, "cancelled": true}
+)
+
+// RecordJobResult stores the final outcome of a job reported by the runner
+// holding its lease and rolls the status up to the parent run.
+func (s *Service) RecordJobResult(runnerID string, result types.JobResult) error {
+	if !jobResultStatuses[result.Status] {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, result.Status)
+	}
+
+	job, err := s.leasedJob(runnerID, result.JobID)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"status":           result.Status,
+		"error":            result.Error,
+		"finished_at":      parseTimestamp(result.FinishedAt),
+		"lease_expires_at": nil,
+	}
+	if result.StartedAt != "" {
+		updates["started_at"] = parseTimestamp(result.StartedAt)
+	}
+	if len(result.Outputs) > 0 {
+		outputs, _ := json.Marshal(result.Outputs)
+		updates["outputs"] = string(outputs)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// The reaper may have timed the job out since it was looked up
+		result := tx.Model(job).Where("status = ?", "running").Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseNotHeld
+		}
+
+		// Steps the runner never reached will not run anymore
+		if err := tx.Model(&models.Step{}).
+			Where("job_id = ? AND status IN ?", job.ID, []string{"pending", "running"}).
+			Update("status", "skipped").Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Runner{}).
+			Where("id = ?", runnerID).
+			Updates(map[string]interface{}{"status": "online", "last_seen": time.Now()}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.advanceRun(job.RunID)
+}
+
+// RecordStepResult stores the progress or outcome of a single step. The step
+// must belong to a job currently leased to the reporting runner.
+func (s *Service) RecordStepResult(runnerID string, jobID uint, result types.StepResult) error {
+	if !stepResultStatuses[result.Status] {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, result.Status)
+	}
+
+	job, err := s.leasedJob(runnerID, jobID)
+	if err != nil {
+		return err
+	}
+
+	var step models.Step
+	if err := s.db.Where("id = ? AND job_id = ?", result.StepID, jobID).First(&step).Error; err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"status": result.Status}
+	if result.StartedAt != "" {
+		updates["started_at"] = parseTimestamp(result.StartedAt)
+	}
+	if result.Status != "running" {
+		outcome, conclusion, err := stepConclusion(result)
+		if err != nil {
+			return err
+		}
+		exitCode := result.ExitCode
+		if len(result.Outputs) > 0 {
+			outputs, _ := json.Marshal(result.Outputs)
+			updates["outputs"] = string(outputs)
+		}
+		updates["outcome"] = outcome
+		updates["conclusion"] = conclusion
+		updates["exit_code"] = &exitCode
+		updates["finished_at"] = parseTimestamp(result.FinishedAt)
+	}
+
+	var logs []models.Log
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&step).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if result.Output != "" {
+			logs = append(logs, models.Log{StepID: step.ID, Attempt: job.Attempts, Content: result.Output, Level: "info", Timestamp: now})
+		}
+		if result.Error != "" {
+			logs = append(logs, models.Log{StepID: step.ID, Attempt: job.Attempts, Content: result.Error, Level: "error", Timestamp: now})
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+		return tx.Create(&logs).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publishLogs(job, logs)
+	return nil
+}
+
+// stepConclusion returns the outcome and conclusion of a finished step,
+// defaulting both to its status. A conclusion may only differ from the outcome
+// when continue-on-error turned a failure into a success.
+func stepConclusion(result types.StepResult) (outcome, conclusion string, err error) {
+	outcome, conclusion = result.Outcome, result.Conclusion
+	if outcome == "" {
+		outcome = result.Status
+	}
+	if conclusion == "" {
+		conclusion = outcome
+	}
+
+	if outcome == "running" || !stepResultStatuses[outcome] {
+		return "", "", fmt.Errorf("%w: outcome %q", ErrInvalidStatus, outcome)
+	}
+	tolerated := conclusion == "success" && (outcome == "failed" || outcome == "timed_out")
+	if conclusion != outcome && !tolerated {
+		return "", "", fmt.Errorf("%w: conclusion %q for outcome %q", ErrInvalidStatus, conclusion, outcome)
+	}
+	return outcome, conclusion, nil
+}
+
+// leasedJob loads a running job and verifies that the runner holds its lease
+func (s *Service) leasedJob(runnerID string, jobID uint) (*models.Job, error) {
+	var job models.Job
+	err := s.db.Where("id = ? AND runner_id = ? AND status = ?", jobID, runnerID, "running").First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrLeaseNotHeld
+	}
+	return &job, err
+}
+
+// updateRunStatus derives the status of a run from the status of its jobs.
+// A run that is already finished (e.g. cancelled) is left untouched.
+func (s *Service) updateRunStatus(runID uint) error {
+	var jobs []models.Job
+	if err := s.db.Where("run_id = ?", runID).Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	status, finished := runStatus(jobs)
+	if !finished {
+		return nil
+	}
+
+	return s.db.Model(&models.Run{}).
+		Where("id = ? AND status IN ?", runID, []string{"pending", "running"}).
+		Updates(map[string]interface{}{"status": status, "finished_at": time.Now()}).Error
+}
+
+// runStatus derives the final status of a run from its jobs. finished is
+// false while any job has not finished yet.
+func runStatus(jobs []models.Job) (status string, finished bool) {
+	status = "success"
+	for _, job := range jobs {
+		switch job.Status {
+		case "success", "skipped":
+		case "failed", "cancelled", "timed_out":
+			status = "failed"
+		default:
+			return "", false
+		}
+	}
+	return status, true
+}
+
+// parseTimestamp parses an RFC3339 timestamp reported by a runner, falling
+// back to the current time when it is missing or malformed.
+func parseTimestamp(value string) time.Time {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	return time.Now()
+}
@@ -0,0 +1,226 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestStepConclusion(t *testing.T) {
+	tests := []struct {
+		name           string
+		result         types.StepResult
+		wantOutcome    string
+		wantConclusion string
+		wantErr        bool
+	}{
+		{name: "defaults to status", result: types.StepResult{Status: "success"}, wantOutcome: "success", wantConclusion: "success"},
+		{name: "conclusion defaults to outcome", result: types.StepResult{Status: "failed", Outcome: "failed"}, wantOutcome: "failed", wantConclusion: "failed"},
+		{name: "continue-on-error failure", result: types.StepResult{Status: "success", Outcome: "failed", Conclusion: "success"}, wantOutcome: "failed", wantConclusion: "success"},
+		{name: "continue-on-error timeout", result: types.StepResult{Status: "success", Outcome: "timed_out", Conclusion: "success"}, wantOutcome: "timed_out", wantConclusion: "success"},
+		{name: "skipped", result: types.StepResult{Status: "skipped"}, wantOutcome: "skipped", wantConclusion: "skipped"},
+		{name: "running outcome", result: types.StepResult{Status: "success", Outcome: "running"}, wantErr: true},
+		{name: "unknown outcome", result: types.StepResult{Status: "success", Outcome: "done"}, wantErr: true},
+		{name: "success turned into failure", result: types.StepResult{Status: "failed", Outcome: "success", Conclusion: "failed"}, wantErr: true},
+		{name: "cancellation tolerated", result: types.StepResult{Status: "success", Outcome: "cancelled", Conclusion: "success"}, wantErr: true},
+		{name: "failure concluded as skipped", result: types.StepResult{Status: "failed", Outcome: "failed", Conclusion: "skipped"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outcome, conclusion, err := stepConclusion(test.result)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidStatus) {
+					t.Errorf("got %q, %q, %v; want ErrInvalidStatus", outcome, conclusion, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome != test.wantOutcome || conclusion != test.wantConclusion {
+				t.Errorf("got outcome %q, conclusion %q; want %q, %q", outcome, conclusion, test.wantOutcome, test.wantConclusion)
+			}
+		})
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string // empty while the run has not finished
+	}{
+		{name: "no jobs", want: "success"},
+		{name: "all succeeded", statuses: []string{"success", "success"}, want: "success"},
+		{name: "skipped jobs", statuses: []string{"success", "skipped"}, want: "success"},
+		{name: "all skipped", statuses: []string{"skipped"}, want: "success"},
+		{name: "failed", statuses: []string{"success", "failed", "skipped"}, want: "failed"},
+		{name: "timed out", statuses: []string{"timed_out", "success"}, want: "failed"},
+		{name: "cancelled", statuses: []string{"cancelled"}, want: "failed"},
+		{name: "pending", statuses: []string{"failed", "pending"}},
+		{name: "queued", statuses: []string{"success", "queued"}},
+		{name: "running", statuses: []string{"running", "failed"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var jobs []models.Job
+			for _, status := range test.statuses {
+				jobs = append(jobs, models.Job{Status: status})
+			}
+			status, finished := runStatus(jobs)
+			if finished != (test.want != "") || status != test.want {
+				t.Errorf("got %q (finished %v), want %q", status, finished, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordJobResultLease(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	other := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+
+	if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: job.ID, Status: "done"}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("invalid status: got %v, want ErrInvalidStatus", err)
+	}
+	if err := s.RecordJobResult(other.ID, types.JobResult{JobID: job.ID, Status: "success"}); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("another runner: got %v, want ErrLeaseNotHeld", err)
+	}
+
+	// The lease expires and the reaper gives the job to the next runner
+	if err := db.Model(job).Update("lease_expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reap(ReaperConfig{StaleAfter: time.Hour, MaxRetries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: job.ID, Status: "success"}); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("expired lease: got %v, want ErrLeaseNotHeld", err)
+	}
+	if err := s.RecordStepResult(runner.ID, job.ID, types.StepResult{StepID: 1, Status: "success"}); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("step of a job with an expired lease: got %v, want ErrLeaseNotHeld", err)
+	}
+
+	var requeued models.Job
+	if err := db.First(&requeued, job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if requeued.Status != "queued" || requeued.RunnerID != "" {
+		t.Errorf("job is %s on %q, want it queued for another runner", requeued.Status, requeued.RunnerID)
+	}
+}
+
+func TestRecordStepResult(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	other := createTestRunner(t, db)
+	job := leasedTestJob(t, s, runner)
+
+	var step models.Step
+	if err := db.Where("job_id = ?", job.ID).First(&step).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		runnerID string
+		result   types.StepResult
+		err      error
+	}{
+		{name: "another runner", runnerID: other.ID, result: types.StepResult{StepID: step.ID, Status: "success"}, err: ErrLeaseNotHeld},
+		{name: "unknown status", runnerID: runner.ID, result: types.StepResult{StepID: step.ID, Status: "done"}, err: ErrInvalidStatus},
+		{name: "invalid conclusion", runnerID: runner.ID, result: types.StepResult{StepID: step.ID, Status: "failed", Outcome: "failed", Conclusion: "cancelled"}, err: ErrInvalidStatus},
+		{name: "step of another job", runnerID: runner.ID, result: types.StepResult{StepID: step.ID + 1000000, Status: "success"}, err: gorm.ErrRecordNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := s.RecordStepResult(test.runnerID, job.ID, test.result); !errors.Is(err, test.err) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	// A rejected result leaves the step as it was
+	if err := db.First(&step, step.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if step.Status != "pending" || step.Outcome != "" {
+		t.Errorf("step is %s with outcome %q after rejected results", step.Status, step.Outcome)
+	}
+
+	result := types.StepResult{StepID: step.ID, Status: "success", Outcome: "failed", Conclusion: "success", ExitCode: 1}
+	if err := s.RecordStepResult(runner.ID, job.ID, result); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&step, step.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if step.Status != "success" || step.Outcome != "failed" || step.Conclusion != "success" || step.ExitCode == nil || *step.ExitCode != 1 {
+		t.Errorf("step is %s with outcome %q and conclusion %q, want success after a tolerated failure", step.Status, step.Outcome, step.Conclusion)
+	}
+}
+
+func TestRecordJobResultRunStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string // reported for the jobs in turn
+		want     string
+	}{
+		{name: "success", statuses: []string{"success", "success"}, want: "success"},
+		{name: "failed", statuses: []string{"success", "failed"}, want: "failed"},
+		{name: "timed out", statuses: []string{"timed_out", "success"}, want: "failed"},
+	}
+
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := createTestRunner(t, db)
+			run := startTestRun(t, s, fmt.Sprintf(`
+name: status
+jobs:
+  build:
+    runs-on: %[1]s
+    steps:
+      - run: make
+  lint:
+    runs-on: %[1]s
+    steps:
+      - run: make lint
+`, runner.ID))
+
+			for i, status := range test.statuses {
+				assignment, err := s.AcquireJob(runner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: assignment.JobID, Status: status}); err != nil {
+					t.Fatal(err)
+				}
+
+				var got models.Run
+				if err := db.First(&got, run.ID).Error; err != nil {
+					t.Fatal(err)
+				}
+				want := "running"
+				if i == len(test.statuses)-1 {
+					want = test.want
+				}
+				if got.Status != want {
+					t.Errorf("after %d results the run is %s, want %s", i+1, got.Status, want)
+				}
+			}
+		})
+	}
+}
@@ -1,22 +1,45 @@
 package workflow
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	"gopkg.in/yaml.v3"
 	"gorm.io/gorm"
 
 	"github.com/lockb0x-llc/relayforge/internal/models"
-	"github.com/lockb0x-llc/relayforge/pkg/types"
 )
 
 type Service struct {
-	db *gorm.DB
+	db       *gorm.DB
+	executor Executor
+	logs     LogPublisher
+	secrets  SecretResolver
+}
+
+// SecretResolver decrypts the secrets available to a user's workflow
+type SecretResolver interface {
+	Resolve(userID, workflowID uint) (map[string]string, error)
 }
 
 func NewService(db *gorm.DB) *Service {
-	return &Service{db: db}
+	return &Service{db: db, executor: NewRunnerExecutor(db)}
+}
+
+// SetExecutor replaces the executor that queued jobs are handed to
+func (s *Service) SetExecutor(executor Executor) {
+	s.executor = executor
+}
+
+// SetLogPublisher sets where log entries are published as they are stored
+func (s *Service) SetLogPublisher(logs LogPublisher) {
+	s.logs = logs
+}
+
+// SetSecrets sets where the secrets handed to runners come from
+func (s *Service) SetSecrets(secrets SecretResolver) {
+	s.secrets = secrets
 }
 
 // Workflow management
@@ -28,9 +51,8 @@ func (s *Service) GetUserWorkflows(userID uint) ([]models.Workflow, error) {
 
 func (s *Service) CreateWorkflow(workflow *models.Workflow) error {
 	// Validate YAML content
-	var spec types.WorkflowSpec
-	if err := yaml.Unmarshal([]byte(workflow.YAMLContent), &spec); err != nil {
-		return fmt.Errorf("invalid YAML content: %v", err)
+	if _, err := parseWorkflow(workflow.YAMLContent); err != nil {
+		return err
 	}
 
 	return s.db.Create(workflow).Error
@@ -58,9 +80,8 @@ func (s *Service) UpdateWorkflow(id, userID uint, name, description, yamlContent
 	}
 	if yamlContent != "" {
 		// Validate YAML content
-		var spec types.WorkflowSpec
-		if err := yaml.Unmarshal([]byte(yamlContent), &spec); err != nil {
-			return nil, fmt.Errorf("invalid YAML content: %v", err)
+		if _, err := parseWorkflow(yamlContent); err != nil {
+			return nil, err
 		}
 		workflow.YAMLContent = yamlContent
 	}
@@ -72,8 +93,15 @@ func (s *Service) UpdateWorkflow(id, userID uint, name, description, yamlContent
 	return &workflow, err
 }
 
+// DeleteWorkflow deletes a workflow along with its secrets
 func (s *Service) DeleteWorkflow(id, userID uint) error {
-	return s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Workflow{}).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Workflow{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return tx.Where("workflow_id = ? AND user_id = ?", id, userID).Delete(&models.Secret{}).Error
+	})
 }
 
 // Run management
@@ -86,7 +114,7 @@ func (s *Service) GetWorkflowRuns(workflowID, userID uint) ([]models.Run, error)
 	return runs, err
 }
 
-func (s *Service) CreateRun(workflowID, userID uint, inputs map[string]string) (*models.Run, error) {
+func (s *Service) CreateRun(workflowID, userID uint, inputs map[string]interface{}) (*models.Run, error) {
 	// Get workflow
 	var workflow models.Workflow
 	if err := s.db.Where("id = ? AND user_id = ?", workflowID, userID).First(&workflow).Error; err != nil {
@@ -98,162 +126,189 @@ func (s *Service) CreateRun(workflowID, userID uint, inputs map[string]string) (
 	}
 
 	// Parse workflow YAML
-	var spec types.WorkflowSpec
-	if err := yaml.Unmarshal([]byte(workflow.YAMLContent), &spec); err != nil {
-		return nil, fmt.Errorf("invalid workflow YAML: %v", err)
+	spec, err := parseWorkflow(workflow.YAMLContent)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create run
-	run := &models.Run{
-		WorkflowID: workflowID,
-		UserID:     userID,
-		Status:     "pending",
-	}
-
-	if err := s.db.Create(run).Error; err != nil {
+	resolved, err := resolveInputs(spec, inputs)
+	if err != nil {
 		return nil, err
 	}
 
-	// Create jobs
-	for jobName, jobSpec := range spec.Jobs {
-		job := &models.Job{
-			RunID:  run.ID,
-			Name:   jobName,
-			Status: "pending",
-		}
+	inputsJSON, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode inputs: %v", err)
+	}
+	// The run keeps the file it was started from, so that editing the
+	// workflow does not change the jobs of runs in progress
+	run := &models.Run{
+		WorkflowID:  workflowID,
+		UserID:      userID,
+		Status:      "pending",
+		Inputs:      string(inputsJSON),
+		YAMLContent: workflow.YAMLContent,
+	}
 
-		if err := s.db.Create(job).Error; err != nil {
-			return nil, err
+	// The run is created along with all of its jobs and steps or not at all
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(run).Error; err != nil {
+			return err
 		}
 
-		// Create steps
-		for i, stepSpec := range jobSpec.Steps {
-			stepName := stepSpec.Name
-			if stepName == "" {
-				stepName = fmt.Sprintf("Step %d", i+1)
-			}
-
-			step := &models.Step{
-				JobID:   job.ID,
-				Name:    stepName,
-				Command: stepSpec.Run,
-				Status:  "pending",
+		// Create jobs, one per matrix combination
+		for jobName, jobSpec := range spec.Jobs {
+			combinations, err := jobCombinations(jobSpec)
+			if err != nil {
+				return fmt.Errorf("job %q: %v", jobName, err)
 			}
 
-			if err := s.db.Create(step).Error; err != nil {
-				return nil, err
+			for _, combination := range combinations {
+				job, err := newJob(run.ID, jobName, jobSpec, combination, resolved)
+				if err != nil {
+					return err
+				}
+
+				if err := tx.Create(job).Error; err != nil {
+					return err
+				}
+
+				// Create steps
+				for i, stepSpec := range jobSpec.Steps {
+					stepName := stepSpec.Name
+					if stepName == "" {
+						stepName = fmt.Sprintf("Step %d", i+1)
+					}
+
+					step := &models.Step{
+						JobID:   job.ID,
+						Name:    stepName,
+						Command: stepSpec.Run,
+						Status:  "pending",
+					}
+
+					if err := tx.Create(step).Error; err != nil {
+						return err
+					}
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Load the complete run with jobs
-	if err := s.db.Preload("Jobs.Steps").First(run, run.ID).Error; err != nil {
+	// Queue the run's jobs for execution
+	if err := s.advanceRun(run.ID); err != nil {
 		return nil, err
 	}
 
-	// Queue the run for execution (in a real system, this would be sent to a job queue)
-	go s.executeRun(run)
+	// Reload so the response reflects the queued jobs
+	if err := s.db.Preload("Jobs.Steps").First(run, run.ID).Error; err != nil {
+		return nil, err
+	}
 
 	return run, nil
 }
 
+// GetRun loads a run with its jobs and steps. Logs are not included; each
+// step only reports how many log entries it has.
 func (s *Service) GetRun(id, userID uint) (*models.Run, error) {
 	var run models.Run
 	err := s.db.Where("id = ? AND user_id = ?", id, userID).
 		Preload("Workflow").
-		Preload("Jobs.Steps.Logs").
+		Preload("Jobs.Steps").
 		First(&run).Error
-	return &run, err
+	if err != nil {
+		return &run, err
+	}
+
+	var counts []struct {
+		StepID uint
+		Lines  int64
+	}
+	err = s.db.Model(&models.Log{}).
+		Select("logs.step_id, COUNT(*) AS lines").
+		Joins("JOIN steps ON logs.step_id = steps.id").
+		Joins("JOIN jobs ON steps.job_id = jobs.id").
+		Where("jobs.run_id = ?", run.ID).
+		Group("logs.step_id").
+		Scan(&counts).Error
+	if err != nil {
+		return &run, err
+	}
+
+	lines := make(map[uint]int64, len(counts))
+	for _, count := range counts {
+		lines[count.StepID] = count.Lines
+	}
+	for i := range run.Jobs {
+		for j := range run.Jobs[i].Steps {
+			run.Jobs[i].Steps[j].LogLines = lines[run.Jobs[i].Steps[j].ID]
+		}
+	}
+	return &run, nil
+}
+
+// GetRunJob loads a job of a run owned by the user
+func (s *Service) GetRunJob(runID, jobID, userID uint) (*models.Job, error) {
+	var job models.Job
+	err := s.db.Joins("JOIN runs ON jobs.run_id = runs.id").
+		Where("jobs.id = ? AND jobs.run_id = ? AND runs.user_id = ?", jobID, runID, userID).
+		First(&job).Error
+	return &job, err
 }
 
+// ErrRunFinished is returned when cancelling a run that has already finished.
+var ErrRunFinished = errors.New("run has already finished")
+
+// CancelRun cancels a run. Jobs that have not started are cancelled right
+// away. Running jobs are flagged so that their runner stops them; it still
+// runs their if: always() and cancelled() steps before reporting them as
+// cancelled.
 func (s *Service) CancelRun(id, userID uint) error {
 	var run models.Run
 	if err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&run).Error; err != nil {
 		return err
 	}
 
-	if run.Status == "running" || run.Status == "pending" {
-		run.Status = "cancelled"
-		finishedAt := time.Now()
-		run.FinishedAt = &finishedAt
-		return s.db.Save(&run).Error
-	}
-
-	return fmt.Errorf("run cannot be cancelled in current status: %s", run.Status)
-}
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&run).
+			Where("status IN ?", []string{"pending", "running"}).
+			Updates(map[string]interface{}{"status": "cancelled", "finished_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: run is %s", ErrRunFinished, run.Status)
+		}
 
-// Simulate run execution (in real system, this would be handled by runners)
-func (s *Service) executeRun(run *models.Run) {
-	// Update run status
-	run.Status = "running"
-	startedAt := time.Now()
-	run.StartedAt = &startedAt
-	s.db.Save(run)
-
-	// Execute jobs sequentially (simplified)
-	var jobs []models.Job
-	s.db.Where("run_id = ?", run.ID).Preload("Steps").Find(&jobs)
-
-	runSuccess := true
-	for _, job := range jobs {
-		job.Status = "running"
-		jobStartedAt := time.Now()
-		job.StartedAt = &jobStartedAt
-		s.db.Save(&job)
-
-		// Execute steps
-		jobSuccess := true
-		for _, step := range job.Steps {
-			step.Status = "running"
-			stepStartedAt := time.Now()
-			step.StartedAt = &stepStartedAt
-			s.db.Save(&step)
-
-			// Simulate step execution
-			time.Sleep(2 * time.Second)
-
-			// Create log entry
-			log := &models.Log{
-				StepID:  step.ID,
-				Content: fmt.Sprintf("Executing: %s", step.Command),
-				Level:   "info",
+		var waiting []uint
+		if err := tx.Model(&models.Job{}).
+			Where("run_id = ? AND status IN ?", id, []string{"pending", "queued"}).
+			Pluck("id", &waiting).Error; err != nil {
+			return err
+		}
+		if len(waiting) > 0 {
+			if err := tx.Model(&models.Job{}).Where("id IN ?", waiting).Updates(map[string]interface{}{
+				"status":        "cancelled",
+				"status_reason": "Run was cancelled",
+				"finished_at":   now,
+			}).Error; err != nil {
+				return err
 			}
-			s.db.Create(log)
-
-			// Simulate step completion
-			step.Status = "success"
-			stepFinishedAt := time.Now()
-			step.FinishedAt = &stepFinishedAt
-			s.db.Save(&step)
-
-			// Create completion log
-			completionLog := &models.Log{
-				StepID:  step.ID,
-				Content: fmt.Sprintf("Step completed successfully"),
-				Level:   "info",
+			if err := tx.Model(&models.Step{}).Where("job_id IN ?", waiting).
+				Update("status", "skipped").Error; err != nil {
+				return err
 			}
-			s.db.Create(completionLog)
 		}
 
-		// Update job status
-		if jobSuccess {
-			job.Status = "success"
-		} else {
-			job.Status = "failed"
-			runSuccess = false
-		}
-		jobFinishedAt := time.Now()
-		job.FinishedAt = &jobFinishedAt
-		s.db.Save(&job)
-	}
+		return tx.Model(&models.Job{}).
+			Where("run_id = ? AND status = ?", id, "running").
+			Update("cancel_requested_at", now).Error
+	})
+}
 
-	// Update run status
-	if runSuccess {
-		run.Status = "success"
-	} else {
-		run.Status = "failed"
-	}
-	finishedAt := time.Now()
-	run.FinishedAt = &finishedAt
-	s.db.Save(run)
-}
\ No newline at end of file
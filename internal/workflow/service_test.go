@@ -0,0 +1,113 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestCancelRun(t *testing.T) {
+	db := testDB(t)
+	s := &Service{db: db, executor: nopExecutor{}}
+	runner := createTestRunner(t, db)
+	run := startTestRun(t, s, fmt.Sprintf(`
+name: cancel
+jobs:
+  build:
+    runs-on: %s
+    steps:
+      - run: make
+  lint:
+    runs-on: nowhere-%d
+    steps:
+      - run: make lint
+  test:
+    needs: [build]
+    runs-on: %[1]s
+    steps:
+      - run: make test
+`, runner.ID, time.Now().UnixNano()))
+
+	assignment, err := s.AcquireJob(runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CancelRun(run.ID, run.UserID+1); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("cancelling another user's run: got %v, want ErrRecordNotFound", err)
+	}
+	if err := s.CancelRun(run.ID, run.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.First(run, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != "cancelled" || run.FinishedAt == nil {
+		t.Errorf("run is %s, finished at %v; want it cancelled", run.Status, run.FinishedAt)
+	}
+
+	var jobs []models.Job
+	if err := db.Preload("Steps").Where("run_id = ?", run.ID).Find(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		switch jobKey(&job) {
+		case "build":
+			// The runner stops the running job and reports it
+			if job.Status != "running" || job.CancelRequestedAt == nil {
+				t.Errorf("running job is %s with cancel requested at %v, want it flagged", job.Status, job.CancelRequestedAt)
+			}
+			if job.Steps[0].Status != "pending" {
+				t.Errorf("step of the running job is %s, want it left to the runner", job.Steps[0].Status)
+			}
+		default:
+			if job.Status != "cancelled" || job.StatusReason != "Run was cancelled" || job.CancelRequestedAt != nil {
+				t.Errorf("%s job is %s (%q), want cancelled", jobKey(&job), job.Status, job.StatusReason)
+			}
+			for _, step := range job.Steps {
+				if step.Status != "skipped" {
+					t.Errorf("step of the %s job is %s, want skipped", jobKey(&job), step.Status)
+				}
+			}
+		}
+	}
+
+	// The runner learns about it from its heartbeat and lease renewals
+	response, err := s.Heartbeat(runner.ID, types.RunnerHeartbeat{ActiveJobs: []uint{assignment.JobID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{assignment.JobID}; !reflect.DeepEqual(response.Cancel, want) {
+		t.Errorf("heartbeat asks to cancel %v, want %v", response.Cancel, want)
+	}
+	lease, err := s.RenewLease(runner.ID, assignment.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.Cancelled {
+		t.Error("lease renewal does not report the cancellation")
+	}
+
+	if err := s.RecordJobResult(runner.ID, types.JobResult{JobID: assignment.JobID, Status: "cancelled", Error: "run was cancelled"}); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := db.Model(&models.Run{}).Where("id = ?", run.ID).Pluck("status", &status).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status != "cancelled" {
+		t.Errorf("run status = %q after the runner reported, want cancelled", status)
+	}
+
+	if err := s.CancelRun(run.ID, run.UserID); !errors.Is(err, ErrRunFinished) {
+		t.Errorf("cancelling a finished run: got %v, want ErrRunFinished", err)
+	}
+}
@@ -0,0 +1,94 @@
+package workflow
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// simulationRunnerID is the runner ID recorded on jobs executed by the
+// SimulationExecutor.
+const simulationRunnerID = "simulator"
+
+// SimulationExecutor pretends to execute jobs without any runner: every step
+// sleeps for StepDelay and succeeds. It is meant for demo environments only.
+type SimulationExecutor struct {
+	service   *Service
+	StepDelay time.Duration
+}
+
+func NewSimulationExecutor(service *Service, stepDelay time.Duration) *SimulationExecutor {
+	return &SimulationExecutor{service: service, StepDelay: stepDelay}
+}
+
+func (e *SimulationExecutor) Enqueue(jobs []*models.Job) error {
+	for _, job := range jobs {
+		if err := leaseJob(e.service.db, job, simulationRunnerID, time.Now()); err != nil {
+			return err
+		}
+
+		go e.execute(job)
+	}
+	return nil
+}
+
+func (e *SimulationExecutor) execute(job *models.Job) {
+	var steps []models.Step
+	if err := e.service.db.Where("job_id = ?", job.ID).Order("id ASC").Find(&steps).Error; err != nil {
+		log.Printf("Simulation failed to load steps of job %d: %v", job.ID, err)
+		return
+	}
+
+	jobStartedAt := time.Now().Format(time.RFC3339)
+	for _, step := range steps {
+		lease, err := e.service.RenewLease(simulationRunnerID, job.ID)
+		if err != nil {
+			log.Printf("Simulation of job %d stopped: %v", job.ID, err)
+			return
+		}
+		if lease.Cancelled {
+			e.finish(job, "cancelled", jobStartedAt)
+			return
+		}
+
+		stepStartedAt := time.Now().Format(time.RFC3339)
+		if err := e.service.RecordStepResult(simulationRunnerID, job.ID, types.StepResult{
+			StepID:    step.ID,
+			Status:    "running",
+			StartedAt: stepStartedAt,
+		}); err != nil {
+			log.Printf("Simulation of job %d stopped: %v", job.ID, err)
+			return
+		}
+
+		// Simulate step execution
+		time.Sleep(e.StepDelay)
+
+		if err := e.service.RecordStepResult(simulationRunnerID, job.ID, types.StepResult{
+			StepID:     step.ID,
+			Status:     "success",
+			Output:     fmt.Sprintf("Executing: %s\nStep completed successfully", step.Command),
+			StartedAt:  stepStartedAt,
+			FinishedAt: time.Now().Format(time.RFC3339),
+		}); err != nil {
+			log.Printf("Simulation of job %d stopped: %v", job.ID, err)
+			return
+		}
+	}
+
+	e.finish(job, "success", jobStartedAt)
+}
+
+func (e *SimulationExecutor) finish(job *models.Job, status, startedAt string) {
+	if err := e.service.RecordJobResult(simulationRunnerID, types.JobResult{
+		JobID:      job.ID,
+		Status:     status,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now().Format(time.RFC3339),
+	}); err != nil {
+		log.Printf("Simulation failed to record result of job %d: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,508 @@
+package workflow
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lockb0x-llc/relayforge/internal/models"
+	"github.com/lockb0x-llc/relayforge/pkg/expr"
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+// ValidationError is returned when a workflow file does not pass validation.
+// It carries every problem that was found.
+type ValidationError struct {
+	Diagnostics []types.Diagnostic
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Diagnostics) == 0 {
+		return "invalid workflow"
+	}
+	d := e.Diagnostics[0]
+	msg := fmt.Sprintf("invalid workflow: line %d, column %d: %s", d.Line, d.Column, d.Message)
+	if len(e.Diagnostics) > 1 {
+		msg += fmt.Sprintf(" (and %d more problems)", len(e.Diagnostics)-1)
+	}
+	return msg
+}
+
+// ValidateWorkflow checks a workflow file and returns every problem found,
+// or nothing if the workflow is valid
+func (s *Service) ValidateWorkflow(yamlContent string) []types.Diagnostic {
+	_, diagnostics := validateWorkflow(yamlContent)
+	return diagnostics
+}
+
+// parseWorkflow validates a workflow file and decodes it. Any problem is
+// reported as a *ValidationError.
+func parseWorkflow(yamlContent string) (*types.WorkflowSpec, error) {
+	spec, diagnostics := validateWorkflow(yamlContent)
+	if len(diagnostics) > 0 {
+		return nil, &ValidationError{Diagnostics: diagnostics}
+	}
+	return spec, nil
+}
+
+// runSpec decodes the workflow file a run was started from. Runs from before
+// runs kept their file fall back to the workflow's current one.
+func runSpec(run *models.Run) (*types.WorkflowSpec, error) {
+	yamlContent := run.YAMLContent
+	if yamlContent == "" {
+		yamlContent = run.Workflow.YAMLContent
+	}
+	return parseWorkflow(yamlContent)
+}
+
+var (
+	labelsType  = reflect.TypeOf(types.Labels{})
+	triggerType = reflect.TypeOf(types.TriggerSpec{})
+	yamlLine    = regexp.MustCompile(`line (\d+)`)
+	// Service names are their hostnames on the job's network
+	serviceName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+)
+
+// validator collects diagnostics. It first checks the document structure
+// against the YAML tags of the workflow types, then checks the decoded
+// workflow. nodes indexes the YAML nodes by path so that problems found in
+// the decoded workflow can be reported at their position in the file.
+type validator struct {
+	diagnostics []types.Diagnostic
+	nodes       map[string]*yaml.Node
+}
+
+func validateWorkflow(yamlContent string) (*types.WorkflowSpec, []types.Diagnostic) {
+	v := &validator{nodes: make(map[string]*yaml.Node)}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(yamlContent), &doc); err != nil {
+		v.add(yamlErrorLine(err), 1, "", err.Error())
+		return nil, v.diagnostics
+	}
+	if len(doc.Content) == 0 {
+		v.add(1, 1, "", "workflow is empty")
+		return nil, v.diagnostics
+	}
+
+	root := doc.Content[0]
+	v.checkNode(root, reflect.TypeOf(types.WorkflowSpec{}), "")
+
+	// Unknown keys do not stop decoding, so the remaining checks still run
+	var spec types.WorkflowSpec
+	if err := root.Decode(&spec); err != nil {
+		if len(v.diagnostics) == 0 {
+			v.add(yamlErrorLine(err), 1, "", err.Error())
+		}
+		return nil, v.sorted()
+	}
+
+	v.checkSpec(&spec)
+	if len(v.diagnostics) > 0 {
+		return nil, v.sorted()
+	}
+	return &spec, nil
+}
+
+// yamlErrorLine extracts the line number from a yaml.v3 error message
+func yamlErrorLine(err error) int {
+	if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+		if line, err := strconv.Atoi(m[1]); err == nil {
+			return line
+		}
+	}
+	return 1
+}
+
+func (v *validator) add(line, column int, path, message string) {
+	v.diagnostics = append(v.diagnostics, types.Diagnostic{Line: line, Column: column, Path: path, Message: message})
+}
+
+// errorf reports a problem with the value at node
+func (v *validator) errorf(node *yaml.Node, path, format string, args ...interface{}) {
+	v.add(node.Line, node.Column, path, fmt.Sprintf(format, args...))
+}
+
+// errorAt reports a problem at path. Paths that are not in the document, such
+// as missing fields, are reported at their closest existing parent.
+func (v *validator) errorAt(path, format string, args ...interface{}) {
+	for p := path; ; p = parentPath(p) {
+		if node, ok := v.nodes[p]; ok {
+			v.errorf(node, path, format, args...)
+			return
+		}
+		if p == "" {
+			v.add(1, 1, path, fmt.Sprintf(format, args...))
+			return
+		}
+	}
+}
+
+func (v *validator) sorted() []types.Diagnostic {
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		a, b := v.diagnostics[i], v.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.diagnostics
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// checkNode checks that node has the shape of a value of type t: mappings
+// for structs and maps, sequences for slices and scalars for the rest. Keys
+// that do not correspond to a field are reported as unknown.
+func (v *validator) checkNode(node *yaml.Node, t reflect.Type, path string) {
+	v.nodes[path] = node
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+
+	switch t {
+	case labelsType:
+		if node.Kind == yaml.ScalarNode {
+			return
+		}
+		v.checkNode(node, reflect.TypeOf([]string{}), path)
+		return
+	case triggerType:
+		v.checkTrigger(node, path)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		v.checkNode(node, t.Elem(), path)
+
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, path, "expected a mapping")
+			return
+		}
+		fields, inline := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok && inline != nil {
+				// Keys of an inline map, such as matrix dimensions
+				field, ok = inline.Elem(), true
+			}
+			if !ok {
+				v.unknownKey(key, joinPath(path, key.Value), fields)
+				continue
+			}
+			v.checkNode(value, field, joinPath(path, key.Value))
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, path, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			v.checkNode(node.Content[i+1], t.Elem(), joinPath(path, key))
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(node, path, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			v.checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(node, path, "expected a string")
+		}
+
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			v.errorf(node, path, "expected true or false")
+		}
+	}
+}
+
+// checkTrigger checks the on: section. Only workflow_dispatch has a schema;
+// other events are kept as written.
+func (v *validator) checkTrigger(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+	case yaml.SequenceNode:
+		v.checkNode(node, reflect.TypeOf([]string{}), path)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+			v.nodes[keyPath] = value
+			if key.Value == "workflow_dispatch" {
+				v.checkNode(value, reflect.TypeOf(types.WorkflowDispatchSpec{}), keyPath)
+			}
+		}
+	default:
+		v.errorf(node, path, "expected an event, a list of events or a mapping")
+	}
+}
+
+// unknownKey reports a key that is not part of the schema, suggesting the
+// closest known key for likely typos such as run-on
+func (v *validator) unknownKey(key *yaml.Node, path string, fields map[string]reflect.Type) {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := editDistance(key.Value, name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if best != "" {
+		v.errorf(key, path, "unknown key %q, did you mean %q?", key.Value, best)
+		return
+	}
+	v.errorf(key, path, "unknown key %q", key.Value)
+}
+
+// yamlFields maps the YAML keys of a struct to their field types. inline is
+// the type of an inline map that collects all other keys, if the struct has one.
+func yamlFields(t reflect.Type) (fields map[string]reflect.Type, inline reflect.Type) {
+	fields = make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" && field.Type.Kind() == reflect.Map {
+			inline = field.Type
+			continue
+		}
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+		fields[tag[0]] = field.Type
+	}
+	return fields, inline
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// checkSpec checks the decoded workflow: required fields, job and step
+// rules, needs, timeouts, inputs and expressions
+func (v *validator) checkSpec(spec *types.WorkflowSpec) {
+	if len(spec.Jobs) == 0 {
+		v.errorAt("jobs", "workflow has no jobs")
+		return
+	}
+
+	inputs := declaredInputs(spec)
+	for _, name := range sortedKeys(inputs) {
+		if err := validateInputSpec(inputs[name]); err != nil {
+			v.errorAt("on.workflow_dispatch.inputs."+name, "input %q: %v", name, err)
+		}
+	}
+
+	v.checkEmbeddedMap("env", spec.Env)
+
+	needsValid := true
+	for _, name := range sortedKeys(spec.Jobs) {
+		job := spec.Jobs[name]
+		path := "jobs." + name
+
+		if len(job.RunsOn) == 0 {
+			v.errorAt(path+".runs-on", "runs-on is required")
+		}
+		for i, label := range job.RunsOn {
+			v.checkEmbedded(fmt.Sprintf("%s.runs-on[%d]", path, i), label)
+		}
+		if job.Strategy != nil {
+			if _, err := expandMatrix(job.Strategy.Matrix); err != nil {
+				v.errorAt(path+".strategy.matrix", "%v", err)
+			}
+			if job.Strategy.MaxParallel < 0 {
+				v.errorAt(path+".strategy.max-parallel", "max-parallel cannot be negative")
+			}
+		}
+		for i, need := range job.Needs {
+			needPath := fmt.Sprintf("%s.needs[%d]", path, i)
+			if need == name {
+				v.errorAt(needPath, "job %q cannot need itself", name)
+				needsValid = false
+			} else if _, ok := spec.Jobs[need]; !ok {
+				v.errorAt(needPath, "job %q needs unknown job %q", name, need)
+				needsValid = false
+			}
+		}
+		v.checkCondition(path+".if", job.If)
+		v.checkTimeout(path+".timeout", job.Timeout)
+		v.checkEmbeddedMap(path+".env", job.Env)
+		v.checkEmbeddedMap(path+".outputs", job.Outputs)
+		if job.Container != nil {
+			if strings.TrimSpace(job.Container.Image) == "" {
+				v.errorAt(path+".container.image", "container image is required")
+			}
+			v.checkEmbedded(path+".container.image", job.Container.Image)
+			v.checkEmbeddedMap(path+".container.env", job.Container.Env)
+		}
+		for _, serviceKey := range sortedKeys(job.Services) {
+			v.checkService(path+".services."+serviceKey, serviceKey, job.Services[serviceKey])
+		}
+
+		if len(job.Steps) == 0 {
+			v.errorAt(path+".steps", "job %q has no steps", name)
+		}
+		stepIDs := make(map[string]int)
+		for i, step := range job.Steps {
+			stepPath := fmt.Sprintf("%s.steps[%d]", path, i)
+			// Runners only execute shell commands
+			switch {
+			case step.Uses != "":
+				v.errorAt(stepPath+".uses", "uses is not supported, steps run a shell command with run")
+			case step.Run == "":
+				v.errorAt(stepPath, "step must have run")
+			}
+			if step.ID != "" {
+				if first, ok := stepIDs[step.ID]; ok {
+					v.errorAt(stepPath+".id", "duplicate step id %q, already used by step %d", step.ID, first+1)
+				} else {
+					stepIDs[step.ID] = i
+				}
+			}
+			v.checkCondition(stepPath+".if", step.If)
+			v.checkTimeout(stepPath+".timeout", step.Timeout)
+			v.checkEmbedded(stepPath+".run", step.Run)
+			v.checkEmbeddedMap(stepPath+".with", step.With)
+			v.checkEmbeddedMap(stepPath+".env", step.Env)
+		}
+	}
+
+	// Cycles are only meaningful once every need refers to another job
+	if needsValid {
+		if cycle := findCycle(spec); cycle != nil {
+			v.errorAt("jobs."+cycle[0]+".needs", "job dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+}
+
+func (v *validator) checkService(path, name string, service types.ServiceSpec) {
+	if !serviceName.MatchString(name) {
+		v.errorAt(path, "invalid service name %q, expected letters, digits and hyphens", name)
+	}
+	if strings.TrimSpace(service.Image) == "" {
+		v.errorAt(path+".image", "service image is required")
+	}
+	v.checkEmbedded(path+".image", service.Image)
+	v.checkEmbeddedMap(path+".env", service.Env)
+	for i, port := range service.Ports {
+		if _, _, err := types.ParsePort(port); err != nil {
+			v.errorAt(fmt.Sprintf("%s.ports[%d]", path, i), "%v", err)
+		}
+	}
+
+	if check := service.HealthCheck; check != nil {
+		if strings.TrimSpace(check.Command) == "" {
+			v.errorAt(path+".health-check.command", "health check command is required")
+		}
+		if d, err := time.ParseDuration(check.Interval); check.Interval != "" && (err != nil || d <= 0) {
+			v.errorAt(path+".health-check.interval", "invalid interval %q, expected a duration such as 5s", check.Interval)
+		}
+		if check.Retries < 0 {
+			v.errorAt(path+".health-check.retries", "retries cannot be negative")
+		}
+	}
+}
+
+func (v *validator) checkCondition(path, condition string) {
+	if condition == "" {
+		return
+	}
+	if err := expr.ValidateCondition(condition); err != nil {
+		v.errorAt(path, "invalid condition: %v", err)
+	}
+}
+
+func (v *validator) checkTimeout(path, timeout string) {
+	if timeout == "" {
+		return
+	}
+	if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+		v.errorAt(path, "invalid timeout %q, expected a duration such as 30m", timeout)
+	}
+}
+
+// checkEmbedded checks the ${{ }} expressions embedded in a value
+func (v *validator) checkEmbedded(path, value string) {
+	expressions, err := expr.Expressions(value)
+	if err != nil {
+		v.errorAt(path, "%v", err)
+		return
+	}
+	for _, expression := range expressions {
+		if err := expr.Validate(expression); err != nil {
+			v.errorAt(path, "invalid expression %q: %v", expression, err)
+		}
+	}
+}
+
+func (v *validator) checkEmbeddedMap(path string, values map[string]string) {
+	for _, key := range sortedKeys(values) {
+		v.checkEmbedded(joinPath(path, key), values[key])
+	}
+}
+
+// sortedKeys returns the keys of a map with string keys in order
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.String()
+	}
+	sort.Strings(names)
+	return names
+}
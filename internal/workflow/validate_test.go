@@ -0,0 +1,184 @@
+package workflow
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lockb0x-llc/relayforge/pkg/types"
+)
+
+func TestValidateWorkflow(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []types.Diagnostic
+	}{
+		{
+			name: "valid",
+			yaml: `
+name: build
+jobs:
+  build:
+    runs-on: linux
+    strategy:
+      matrix:
+        go: ["1.20", "1.21"]
+    steps:
+      - run: go test ./...
+  deploy:
+    needs: [build]
+    runs-on: linux
+    steps:
+      - run: ./deploy.sh
+`,
+		},
+		{
+			name: "unknown keys",
+			yaml: `
+name: build
+jobs:
+  build:
+    run-on: linux
+    steps:
+      - run: make
+        shell: bash
+`,
+			want: []types.Diagnostic{
+				{Line: 5, Column: 5, Path: "jobs.build.run-on", Message: `unknown key "run-on", did you mean "runs-on"?`},
+				{Line: 5, Column: 5, Path: "jobs.build.runs-on", Message: "runs-on is required"},
+				{Line: 8, Column: 9, Path: "jobs.build.steps[0].shell", Message: `unknown key "shell"`},
+			},
+		},
+		{
+			name: "wrong shapes",
+			yaml: `
+name: build
+jobs:
+  build:
+    runs-on: linux
+    steps:
+      - run: make
+        continue-on-error: maybe
+  test:
+    runs-on: linux
+    steps: make
+`,
+			want: []types.Diagnostic{
+				{Line: 8, Column: 28, Path: "jobs.build.steps[0].continue-on-error", Message: "expected true or false"},
+				{Line: 11, Column: 12, Path: "jobs.test.steps", Message: "expected a list"},
+			},
+		},
+		{
+			name: "unknown and own needs",
+			yaml: `
+name: build
+jobs:
+  build:
+    runs-on: linux
+    needs: [build, lint]
+    steps:
+      - run: make
+`,
+			want: []types.Diagnostic{
+				{Line: 6, Column: 13, Path: "jobs.build.needs[0]", Message: `job "build" cannot need itself`},
+				{Line: 6, Column: 20, Path: "jobs.build.needs[1]", Message: `job "build" needs unknown job "lint"`},
+			},
+		},
+		{
+			name: "needs cycle",
+			yaml: `
+name: build
+jobs:
+  a:
+    runs-on: linux
+    needs: [c]
+    steps:
+      - run: make
+  b:
+    runs-on: linux
+    needs: [a]
+    steps:
+      - run: make
+  c:
+    runs-on: linux
+    needs: [b]
+    steps:
+      - run: make
+`,
+			want: []types.Diagnostic{
+				{Line: 6, Column: 12, Path: "jobs.a.needs", Message: "job dependency cycle: a -> c -> b -> a"},
+			},
+		},
+		{
+			name: "bad matrix",
+			yaml: `
+name: build
+jobs:
+  test:
+    runs-on: linux
+    strategy:
+      max-parallel: -1
+      matrix:
+        os: []
+        exclude:
+          - arch: arm64
+    steps:
+      - run: make test
+`,
+			want: []types.Diagnostic{
+				{Line: 7, Column: 21, Path: "jobs.test.strategy.max-parallel", Message: "max-parallel cannot be negative"},
+				{Line: 9, Column: 9, Path: "jobs.test.strategy.matrix", Message: `matrix dimension "os" has no values`},
+			},
+		},
+		{
+			name: "uses",
+			yaml: `
+name: build
+jobs:
+  build:
+    runs-on: linux
+    steps:
+      - uses: actions/checkout@v4
+      - name: empty
+`,
+			want: []types.Diagnostic{
+				{Line: 7, Column: 15, Path: "jobs.build.steps[0].uses", Message: "uses is not supported, steps run a shell command with run"},
+				{Line: 8, Column: 9, Path: "jobs.build.steps[1]", Message: "step must have run"},
+			},
+		},
+		{
+			name: "missing jobs",
+			yaml: "name: build\n",
+			want: []types.Diagnostic{
+				{Line: 1, Column: 1, Path: "jobs", Message: "workflow has no jobs"},
+			},
+		},
+		{
+			name: "yaml syntax",
+			yaml: "name: build\njobs:\n  build:\n    runs-on: [linux\n",
+			want: []types.Diagnostic{
+				{Line: 3, Column: 1, Message: "yaml: line 3: did not find expected ',' or ']'"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, got := validateWorkflow(test.yaml)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got diagnostics\n%+v\nwant\n%+v", got, test.want)
+			}
+			if (spec != nil) != (len(test.want) == 0) {
+				t.Errorf("got spec %v with %d diagnostics", spec != nil, len(got))
+			}
+		})
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	_, err := parseWorkflow("name: build\njobs:\n  build:\n    run-on: linux\n")
+	want := `invalid workflow: line 4, column 5: unknown key "run-on", did you mean "runs-on"? (and 2 more problems)`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
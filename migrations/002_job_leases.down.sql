@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_status;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS lease_expires_at;
@@ -0,0 +1,3 @@
+ALTER TABLE steps DROP COLUMN IF EXISTS exit_code;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS error;
@@ -0,0 +1,3 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error TEXT;
+
+ALTER TABLE steps ADD COLUMN IF NOT EXISTS exit_code INTEGER;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS status_reason;
+ALTER TABLE jobs DROP COLUMN IF EXISTS needs;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS needs TEXT; -- JSON array of job names
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS status_reason TEXT;
@@ -0,0 +1 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS runs_on TEXT; -- JSON array of required runner labels
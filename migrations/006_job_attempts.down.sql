@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_lease_expires_at;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS attempts;
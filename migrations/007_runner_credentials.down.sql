@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS runner_tokens;
+
+ALTER TABLE runners DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE runners DROP COLUMN IF EXISTS secret_hash;
@@ -0,0 +1,3 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS condition;
+
+ALTER TABLE runs DROP COLUMN IF EXISTS inputs;
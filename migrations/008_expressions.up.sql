@@ -0,0 +1,3 @@
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS inputs TEXT;
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS condition TEXT;
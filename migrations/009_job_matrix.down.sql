@@ -0,0 +1,4 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS fail_fast;
+ALTER TABLE jobs DROP COLUMN IF EXISTS max_parallel;
+ALTER TABLE jobs DROP COLUMN IF EXISTS matrix;
+ALTER TABLE jobs DROP COLUMN IF EXISTS key;
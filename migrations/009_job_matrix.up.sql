@@ -0,0 +1,6 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS key VARCHAR(255); -- job key in the workflow
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS matrix TEXT; -- JSON object of matrix values
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_parallel INTEGER DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS fail_fast BOOLEAN DEFAULT FALSE;
+
+UPDATE jobs SET key = name WHERE key IS NULL;
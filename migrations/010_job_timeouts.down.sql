@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS timeout_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS timeout_seconds;
@@ -0,0 +1,2 @@
+ALTER TABLE steps DROP COLUMN IF EXISTS conclusion;
+ALTER TABLE steps DROP COLUMN IF EXISTS outcome;
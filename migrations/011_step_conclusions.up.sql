@@ -0,0 +1,2 @@
+ALTER TABLE steps ADD COLUMN IF NOT EXISTS outcome VARCHAR(50);
+ALTER TABLE steps ADD COLUMN IF NOT EXISTS conclusion VARCHAR(50);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_logs_step_line;
+
+ALTER TABLE logs DROP COLUMN IF EXISTS stream;
+ALTER TABLE logs DROP COLUMN IF EXISTS sequence;
+ALTER TABLE logs DROP COLUMN IF EXISTS attempt;
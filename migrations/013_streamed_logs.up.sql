@@ -0,0 +1,6 @@
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS attempt INTEGER DEFAULT 0;
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS sequence BIGINT DEFAULT 0;
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS stream VARCHAR(10);
+
+-- Streamed lines are numbered per step attempt so that resent lines are ignored
+CREATE UNIQUE INDEX IF NOT EXISTS idx_logs_step_line ON logs(step_id, attempt, sequence) WHERE sequence > 0;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS secrets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    workflow_id INTEGER NOT NULL DEFAULT 0, -- 0 for secrets of all the user's workflows
+    name VARCHAR(255) NOT NULL,
+    value TEXT NOT NULL, -- base64 AES-GCM nonce and ciphertext
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_secrets_scope_name ON secrets(user_id, workflow_id, name);
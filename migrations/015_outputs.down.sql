@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS outputs;
+ALTER TABLE steps DROP COLUMN IF EXISTS outputs;
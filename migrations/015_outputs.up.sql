@@ -0,0 +1,2 @@
+ALTER TABLE steps ADD COLUMN IF NOT EXISTS outputs TEXT; -- JSON object written to $RELAYFORGE_OUTPUT
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS outputs TEXT; -- JSON object of the job's declared outputs
@@ -0,0 +1,3 @@
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS yaml_content TEXT; -- workflow file the run was started from
+
+UPDATE runs SET yaml_content = workflows.yaml_content FROM workflows WHERE workflows.id = runs.workflow_id AND runs.yaml_content IS NULL;
@@ -0,0 +1,404 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+func (n *literalNode) eval(ctx *Context) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *contextNode) eval(ctx *Context) (interface{}, error) {
+	if value, ok := lookup(ctx.Values, n.name); ok {
+		return normalize(value), nil
+	}
+	return nil, fmt.Errorf("unknown context %q", n.name)
+}
+
+func (n *indexNode) eval(ctx *Context) (interface{}, error) {
+	target, err := n.target.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch target := target.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			key = ToString(index)
+		}
+		value, _ := lookup(target, key)
+		return normalize(value), nil
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok || i != math.Trunc(i) || i < 0 || int(i) >= len(target) {
+			return nil, nil
+		}
+		return normalize(target[int(i)]), nil
+	}
+	// Accessing a property of anything else yields null, like missing keys
+	return nil, nil
+}
+
+func (n *notNode) eval(ctx *Context) (interface{}, error) {
+	value, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !Truthy(value), nil
+}
+
+func (n *binaryNode) eval(ctx *Context) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit and yield one of their operands
+	switch n.op {
+	case "&&":
+		if !Truthy(left) {
+			return left, nil
+		}
+		return n.right.eval(ctx)
+	case "||":
+		if Truthy(left) {
+			return left, nil
+		}
+		return n.right.eval(ctx)
+	}
+
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	default:
+		return compare(n.op, left, right), nil
+	}
+}
+
+func (n *callNode) eval(ctx *Context) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return functions[n.name].call(ctx, args)
+}
+
+// lookup finds a key in a context object. Like property access in workflow
+// files, keys are matched case-insensitively.
+func lookup(values map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+	for k, value := range values {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// normalize converts Go values into the types the evaluator works with:
+// nil, bool, float64, string, map[string]interface{} and []interface{}.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, float64, string, map[string]interface{}, []interface{}:
+		return v
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = item
+		}
+		return m
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return list
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalize(rv.Elem().Interface())
+	}
+
+	// Anything else goes through JSON, e.g. structs
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	json.Unmarshal(data, &decoded)
+	return decoded
+}
+
+// Truthy reports whether a value counts as true in a condition. false, 0,
+// NaN, the empty string and null are falsy; everything else is truthy.
+func Truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// ToString converts a value to the text that is substituted for it when
+// interpolating.
+func ToString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// toNumber coerces a primitive value to a number. Values that have no
+// numeric meaning become NaN.
+func toNumber(value interface{}) float64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if n, err := parseNumber(s); err == nil {
+			return n
+		}
+	}
+	return math.NaN()
+}
+
+// equal compares two values. Values of the same type compare directly, with
+// strings compared case-insensitively; mixed primitive types are compared as
+// numbers. Objects and arrays never compare equal.
+func equal(left, right interface{}) bool {
+	switch l := left.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.EqualFold(l, r)
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return l == r
+		}
+	case nil:
+		if right == nil {
+			return true
+		}
+	}
+
+	switch right.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return toNumber(left) == toNumber(right)
+}
+
+// compare implements the ordering operators. Two strings are compared
+// case-insensitively; anything else is compared as numbers.
+func compare(op string, left, right interface{}) bool {
+	l, lok := left.(string)
+	r, rok := right.(string)
+	var cmp int
+	if lok && rok {
+		cmp = strings.Compare(strings.ToLower(l), strings.ToLower(r))
+	} else {
+		ln, rn := toNumber(left), toNumber(right)
+		if math.IsNaN(ln) || math.IsNaN(rn) {
+			return false
+		}
+		switch {
+		case ln < rn:
+			cmp = -1
+		case ln > rn:
+			cmp = 1
+		}
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+type function struct {
+	minArgs, maxArgs int  // maxArgs < 0 means variadic
+	status           bool // status functions decide whether a step runs at all
+	call             func(ctx *Context, args []interface{}) (interface{}, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"success": {status: true, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return ctx.Status == StatusSuccess, nil
+		}},
+		"failure": {status: true, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return ctx.Status == StatusFailure, nil
+		}},
+		"cancelled": {status: true, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return ctx.Status == StatusCancelled, nil
+		}},
+		"always": {status: true, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return true, nil
+		}},
+		"contains": {minArgs: 2, maxArgs: 2, call: fnContains},
+		"startswith": {minArgs: 2, maxArgs: 2, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return strings.HasPrefix(strings.ToLower(ToString(args[0])), strings.ToLower(ToString(args[1]))), nil
+		}},
+		"endswith": {minArgs: 2, maxArgs: 2, call: func(ctx *Context, args []interface{}) (interface{}, error) {
+			return strings.HasSuffix(strings.ToLower(ToString(args[0])), strings.ToLower(ToString(args[1]))), nil
+		}},
+		"format":   {minArgs: 1, maxArgs: -1, call: fnFormat},
+		"join":     {minArgs: 1, maxArgs: 2, call: fnJoin},
+		"tojson":   {minArgs: 1, maxArgs: 1, call: fnToJSON},
+		"fromjson": {minArgs: 1, maxArgs: 1, call: fnFromJSON},
+	}
+}
+
+// contains(search, item) checks for an element of an array or a substring
+func fnContains(ctx *Context, args []interface{}) (interface{}, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		for _, element := range list {
+			if equal(normalize(element), args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return strings.Contains(strings.ToLower(ToString(args[0])), strings.ToLower(ToString(args[1]))), nil
+}
+
+// format('{0} and {1}', a, b) substitutes positional arguments. Braces are
+// escaped by doubling them.
+func fnFormat(ctx *Context, args []interface{}) (interface{}, error) {
+	pattern := ToString(args[0])
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '{' && i+1 < len(pattern) && pattern[i+1] == '{':
+			sb.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(pattern) && pattern[i+1] == '}':
+			sb.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("format: unclosed '{' in %q", pattern)
+			}
+			n, err := strconv.Atoi(pattern[i+1 : i+end])
+			if err != nil || n < 0 || n+1 >= len(args) {
+				return nil, fmt.Errorf("format: invalid placeholder %q", pattern[i:i+end+1])
+			}
+			sb.WriteString(ToString(args[n+1]))
+			i += end
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
+
+// join(array, separator) joins the elements of an array, by default with a comma
+func fnJoin(ctx *Context, args []interface{}) (interface{}, error) {
+	separator := ","
+	if len(args) > 1 {
+		separator = ToString(args[1])
+	}
+
+	list, ok := args[0].([]interface{})
+	if !ok {
+		return ToString(args[0]), nil
+	}
+	parts := make([]string, len(list))
+	for i, element := range list {
+		parts[i] = ToString(normalize(element))
+	}
+	return strings.Join(parts, separator), nil
+}
+
+func fnToJSON(ctx *Context, args []interface{}) (interface{}, error) {
+	data, err := json.MarshalIndent(args[0], "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("toJSON: %v", err)
+	}
+	return string(data), nil
+}
+
+func fnFromJSON(ctx *Context, args []interface{}) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(ToString(args[0])), &value); err != nil {
+		return nil, fmt.Errorf("fromJSON: %v", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,174 @@
+// Package expr evaluates workflow expressions such as
+// ${{ success() && inputs.env == 'prod' }}.
+//
+// Expressions support null, boolean, number and single-quoted string
+// literals, property access (a.b, a['b'], a[0]), the operators ! < <= > >=
+// == != && ||, status functions (success, failure, cancelled, always) and the
+// functions contains, startsWith, endsWith, format, join, toJSON and fromJSON.
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Status is the status of the job so far, as seen by the status functions.
+type Status string
+
+const (
+	StatusSuccess   Status = "success"
+	StatusFailure   Status = "failure"
+	StatusCancelled Status = "cancelled"
+)
+
+// Context holds everything an expression can refer to.
+type Context struct {
+	// Values maps context names (inputs, env, needs, run, ...) to their contents
+	Values map[string]interface{}
+	// Status decides the result of success(), failure() and cancelled()
+	Status Status
+}
+
+// NewContext returns an empty context with a successful status
+func NewContext() *Context {
+	return &Context{Values: make(map[string]interface{}), Status: StatusSuccess}
+}
+
+// Evaluate parses and evaluates a bare expression (without ${{ }}).
+func Evaluate(expression string, ctx *Context) (interface{}, error) {
+	n, err := parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", expression, err)
+	}
+	value, err := n.eval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating %q: %v", expression, err)
+	}
+	return value, nil
+}
+
+// EvaluateCondition evaluates an if: condition. The ${{ }} wrapper is
+// optional. An empty condition means success(), and a condition that does
+// not call a status function is implicitly combined with success(), so it
+// only holds when nothing has failed so far.
+func EvaluateCondition(condition string, ctx *Context) (bool, error) {
+	condition = unwrapCondition(condition)
+
+	n, err := parse(condition)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %v", condition, err)
+	}
+	if !usesStatusFunction(n) {
+		n = &binaryNode{op: "&&", left: &callNode{name: "success"}, right: n}
+	}
+
+	value, err := n.eval(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error evaluating condition %q: %v", condition, err)
+	}
+	return Truthy(value), nil
+}
+
+// Validate checks that an expression parses without evaluating it.
+func Validate(expression string) error {
+	_, err := parse(expression)
+	return err
+}
+
+// ValidateCondition checks that an if: condition parses without evaluating it.
+func ValidateCondition(condition string) error {
+	_, err := parse(unwrapCondition(condition))
+	return err
+}
+
+// unwrapCondition strips the optional ${{ }} around a condition and defaults
+// an empty condition to success()
+func unwrapCondition(condition string) string {
+	condition = strings.TrimSpace(condition)
+	if strings.HasPrefix(condition, "${{") && strings.HasSuffix(condition, "}}") {
+		condition = strings.TrimSpace(condition[3 : len(condition)-2])
+	}
+	if condition == "" {
+		condition = "success()"
+	}
+	return condition
+}
+
+// Interpolate replaces every ${{ expression }} in s with the string form of
+// its value.
+func Interpolate(s string, ctx *Context) (string, error) {
+	if !strings.Contains(s, "${{") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "${{")
+		if start < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		sb.WriteString(s[:start])
+
+		end := closingBraces(s, start+3)
+		if end < 0 {
+			return "", fmt.Errorf("unclosed ${{ in %q", s)
+		}
+
+		value, err := Evaluate(strings.TrimSpace(s[start+3:end]), ctx)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(ToString(value))
+		s = s[end+2:]
+	}
+}
+
+// InterpolateMap interpolates every value of a map
+func InterpolateMap(values map[string]string, ctx *Context) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		interpolated, err := Interpolate(value, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		result[key] = interpolated
+	}
+	return result, nil
+}
+
+// Expressions returns the bare expressions embedded in s with ${{ }}
+func Expressions(s string) ([]string, error) {
+	var expressions []string
+	for {
+		start := strings.Index(s, "${{")
+		if start < 0 {
+			return expressions, nil
+		}
+		end := closingBraces(s, start+3)
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed ${{ in %q", s)
+		}
+		expressions = append(expressions, strings.TrimSpace(s[start+3:end]))
+		s = s[end+2:]
+	}
+}
+
+// closingBraces finds the }} that closes an expression starting at from,
+// skipping over string literals. It returns -1 if there is none.
+func closingBraces(s string, from int) int {
+	inString := false
+	for i := from; i < len(s); i++ {
+		switch {
+		case s[i] == '\'':
+			inString = !inString
+		case !inString && s[i] == '}' && i+1 < len(s) && s[i+1] == '}':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,242 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testContext() *Context {
+	ctx := NewContext()
+	ctx.Values["inputs"] = map[string]interface{}{
+		"env":     "prod",
+		"count":   3,
+		"debug":   false,
+		"regions": []string{"eu", "us"},
+	}
+	ctx.Values["env"] = map[string]string{"GREETING": "hello"}
+	ctx.Values["needs"] = map[string]interface{}{
+		"build": map[string]interface{}{
+			"result":  "success",
+			"outputs": map[string]interface{}{"version": "1.2.3"},
+		},
+	}
+	ctx.Values["matrix"] = map[string]interface{}{"os-name": "linux"}
+	return ctx
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       interface{}
+		err        string
+	}{
+		// Literals
+		{expression: "null", want: nil},
+		{expression: "true", want: true},
+		{expression: "42", want: 42.0},
+		{expression: "-1.5", want: -1.5},
+		{expression: "0xff", want: 255.0},
+		{expression: "1e3", want: 1000.0},
+		{expression: "'it''s'", want: "it's"},
+
+		// Property access
+		{expression: "inputs.env", want: "prod"},
+		{expression: "inputs['env']", want: "prod"},
+		{expression: "INPUTS.Env", want: "prod"},
+		{expression: "inputs.count", want: 3.0},
+		{expression: "inputs.regions[1]", want: "us"},
+		{expression: "inputs.regions[2]", want: nil},
+		{expression: "inputs.missing", want: nil},
+		{expression: "inputs.env.length", want: nil},
+		{expression: "env.GREETING", want: "hello"},
+		{expression: "needs.build.outputs.version", want: "1.2.3"},
+		{expression: "matrix.os-name", want: "linux"},
+		{expression: "secrets.TOKEN", err: `unknown context "secrets"`},
+
+		// Operators
+		{expression: "inputs.env == 'PROD'", want: true},
+		{expression: "inputs.env != 'prod'", want: false},
+		{expression: "inputs.count == '3'", want: true},
+		{expression: "inputs.count > 2 && inputs.count <= 3", want: true},
+		{expression: "'b' > 'A'", want: true},
+		{expression: "'abc' < 1", want: false},
+		{expression: "null == 0", want: true},
+		{expression: "inputs.regions == inputs.regions", want: false},
+		{expression: "!inputs.debug", want: true},
+		{expression: "!!''", want: false},
+		{expression: "inputs.debug || 'fallback'", want: "fallback"},
+		{expression: "inputs.env && inputs.count", want: 3.0},
+		{expression: "(true || false) && false", want: false},
+		{expression: "false && secrets.TOKEN", want: false},
+
+		// Functions
+		{expression: "contains(inputs.regions, 'EU')", want: true},
+		{expression: "contains('hello world', 'WORLD')", want: true},
+		{expression: "startsWith(inputs.env, 'pr')", want: true},
+		{expression: "endsWith(inputs.env, 'x')", want: false},
+		{expression: "format('{0}-{1} {{x}}', inputs.env, inputs.count)", want: "prod-3 {x}"},
+		{expression: "format('{1}', 'a')", err: "invalid placeholder"},
+		{expression: "join(inputs.regions)", want: "eu,us"},
+		{expression: "join(inputs.regions, ' ')", want: "eu us"},
+		{expression: "toJSON(inputs.regions)", want: "[\n  \"eu\",\n  \"us\"\n]"},
+		{expression: "fromJSON('{\"a\": [1]}').a[0]", want: 1.0},
+		{expression: "fromJSON('{')", err: "fromJSON"},
+
+		// Syntax errors
+		{expression: "inputs.", err: "expected property name"},
+		{expression: "inputs.*", err: "object filters"},
+		{expression: "'open", err: "unterminated string"},
+		{expression: "(true", err: `expected ")"`},
+		{expression: "true false", err: "unexpected"},
+		{expression: "1 + 1", err: "unexpected character"},
+		{expression: "nope()", err: "unknown function"},
+		{expression: "contains('a')", err: "wrong number of arguments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			got, err := Evaluate(tt.expression, testContext())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Evaluate() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Evaluate() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		status    Status
+		want      bool
+	}{
+		{condition: "", status: StatusSuccess, want: true},
+		{condition: "", status: StatusFailure, want: false},
+		{condition: "${{ inputs.env == 'prod' }}", status: StatusSuccess, want: true},
+		{condition: "inputs.env == 'prod'", status: StatusFailure, want: false},
+		{condition: "inputs.env == 'dev'", status: StatusSuccess, want: false},
+		{condition: "failure()", status: StatusFailure, want: true},
+		{condition: "failure()", status: StatusSuccess, want: false},
+		{condition: "always() && inputs.env == 'prod'", status: StatusCancelled, want: true},
+		{condition: "cancelled()", status: StatusCancelled, want: true},
+		{condition: "success()", status: StatusCancelled, want: false},
+		{condition: "!cancelled()", status: StatusFailure, want: true},
+		{condition: "contains(format('{0}', failure()), 'true')", status: StatusFailure, want: true},
+		{condition: "inputs.count", status: StatusSuccess, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status)+" "+tt.condition, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Status = tt.status
+			got, err := EvaluateCondition(tt.condition, ctx)
+			if err != nil {
+				t.Fatalf("EvaluateCondition() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("EvaluateCondition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   string
+	}{
+		{input: "no expressions", want: "no expressions"},
+		{input: "deploy to ${{ inputs.env }}", want: "deploy to prod"},
+		{input: "${{inputs.count}}x${{ inputs.debug }}", want: "3xfalse"},
+		{input: "${{ inputs.missing }}", want: ""},
+		{input: "${{ 'a}}b' }}", want: "a}}b"},
+		{input: "${{ inputs.regions }}", want: `["eu","us"]`},
+		{input: "v${{ needs.build.outputs.version }}", want: "v1.2.3"},
+		{input: "${{ inputs.env", err: "unclosed ${{"},
+		{input: "${{ secrets.TOKEN }}", err: `unknown context "secrets"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Interpolate(tt.input, testContext())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Interpolate() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Interpolate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Interpolate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	got, err := Expressions("${{ inputs.env }} and ${{ format('{0}', 'x}}') }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"inputs.env", "format('{0}', 'x}}')"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expressions() = %q, want %q", got, want)
+	}
+}
+
+func TestToString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{value: nil, want: ""},
+		{value: true, want: "true"},
+		{value: 3.0, want: "3"},
+		{value: 1.5, want: "1.5"},
+		{value: 1e20, want: "100000000000000000000"},
+		{value: "text", want: "text"},
+		{value: map[string]interface{}{"a": 1.0}, want: `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		if got := ToString(tt.value); got != tt.want {
+			t.Errorf("ToString(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTruthy(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  bool
+	}{
+		{value: nil, want: false},
+		{value: false, want: false},
+		{value: 0.0, want: false},
+		{value: math.NaN(), want: false},
+		{value: "", want: false},
+		{value: "false", want: true},
+		{value: -1.0, want: true},
+		{value: []interface{}{}, want: true},
+		{value: map[string]interface{}{}, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := Truthy(tt.value); got != tt.want {
+			t.Errorf("Truthy(%#v) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
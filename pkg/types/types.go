@@ -1,26 +1,212 @@
 package types
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnyLabel is the runs-on wildcard that matches every runner
+const AnyLabel = "any"
+
 // WorkflowSpec represents the YAML workflow specification
 type WorkflowSpec struct {
 	Name        string             `yaml:"name"`
 	Description string             `yaml:"description,omitempty"`
-	On          map[string]interface{} `yaml:"on,omitempty"`
+	On          TriggerSpec        `yaml:"on,omitempty"`
+	Env         map[string]string  `yaml:"env,omitempty"` // for every job, below the job's own env
 	Jobs        map[string]JobSpec `yaml:"jobs"`
 }
 
+// Input types for workflow_dispatch inputs
+const (
+	InputTypeString  = "string"
+	InputTypeBoolean = "boolean"
+	InputTypeNumber  = "number"
+	InputTypeChoice  = "choice"
+)
+
+// TriggerSpec lists the events that start a workflow. In YAML it may be
+// written as a single event, a list of events or a map of event configs.
+type TriggerSpec struct {
+	WorkflowDispatch *WorkflowDispatchSpec  `yaml:"workflow_dispatch,omitempty"`
+	Events           map[string]interface{} `yaml:",inline"` // other events, kept as written
+}
+
+// UnmarshalYAML accepts `on: workflow_dispatch`, `on: [push, workflow_dispatch]`
+// and the map form
+func (t *TriggerSpec) UnmarshalYAML(value *yaml.Node) error {
+	var events []string
+	switch value.Kind {
+	case yaml.ScalarNode:
+		events = []string{value.Value}
+	case yaml.SequenceNode:
+		if err := value.Decode(&events); err != nil {
+			return err
+		}
+	default:
+		type plain TriggerSpec
+		if err := value.Decode((*plain)(t)); err != nil {
+			return err
+		}
+		// `workflow_dispatch:` without a body still enables manual runs
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if value.Content[i].Value == "workflow_dispatch" && t.WorkflowDispatch == nil {
+				t.WorkflowDispatch = &WorkflowDispatchSpec{}
+			}
+		}
+		return nil
+	}
+
+	for _, event := range events {
+		if event == "workflow_dispatch" {
+			t.WorkflowDispatch = &WorkflowDispatchSpec{}
+			continue
+		}
+		if t.Events == nil {
+			t.Events = make(map[string]interface{})
+		}
+		t.Events[event] = nil
+	}
+	return nil
+}
+
+// WorkflowDispatchSpec configures manually started runs
+type WorkflowDispatchSpec struct {
+	Inputs map[string]InputSpec `yaml:"inputs,omitempty"`
+}
+
+// InputSpec declares an input a run can be started with
+type InputSpec struct {
+	Description string      `yaml:"description,omitempty"`
+	Type        string      `yaml:"type,omitempty"` // string (default), boolean, number or choice
+	Required    bool        `yaml:"required,omitempty"`
+	Default     interface{} `yaml:"default,omitempty"`
+	Options     []string    `yaml:"options,omitempty"` // allowed values of a choice input
+}
+
 // JobSpec represents a job in the workflow
 type JobSpec struct {
 	Name     string     `yaml:"name,omitempty"`
-	RunsOn   string     `yaml:"runs-on"`
+	RunsOn   Labels     `yaml:"runs-on"`
 	Needs    []string   `yaml:"needs,omitempty"`
 	If       string     `yaml:"if,omitempty"`
+	Strategy *StrategySpec `yaml:"strategy,omitempty"`
 	Steps    []StepSpec `yaml:"steps"`
 	Env      map[string]string `yaml:"env,omitempty"`
 	Timeout  string     `yaml:"timeout,omitempty"`
+	Outputs  map[string]string `yaml:"outputs,omitempty"` // values for dependent jobs, usually from steps.<id>.outputs
+	Container *ContainerSpec `yaml:"container,omitempty"` // runs the steps in a container instead of on the host
+	Services map[string]ServiceSpec `yaml:"services,omitempty"` // containers running alongside the steps, by hostname
+}
+
+// ContainerSpec is the container a job's steps run in
+type ContainerSpec struct {
+	Image string            `yaml:"image"`
+	Env   map[string]string `yaml:"env,omitempty"`
+}
+
+// ServiceSpec is a container, such as a database, that runs alongside a
+// job's steps
+type ServiceSpec struct {
+	Image       string            `yaml:"image"`
+	Ports       []string          `yaml:"ports,omitempty"` // CONTAINER or HOST:CONTAINER, e.g. "5432" or "8080:80"
+	Env         map[string]string `yaml:"env,omitempty"`
+	HealthCheck *HealthCheckSpec  `yaml:"health-check,omitempty"`
+}
+
+// HealthCheckSpec decides when a service is ready for the steps
+type HealthCheckSpec struct {
+	Command  string `yaml:"command"`            // run in the service container; ready once it succeeds
+	Interval string `yaml:"interval,omitempty"` // between attempts, 2s by default
+	Retries  int    `yaml:"retries,omitempty"`  // failed attempts before giving up, 30 by default
+}
+
+// ParsePort splits a service port into its host and container part. host is
+// empty if the port only names the container port. The container port may
+// end in /tcp or /udp.
+func ParsePort(port string) (host, container string, err error) {
+	container = port
+	if before, after, ok := strings.Cut(port, ":"); ok {
+		host, container = before, after
+		if !validPort(host) {
+			return "", "", fmt.Errorf("invalid host port %q", host)
+		}
+	}
+
+	number := strings.TrimSuffix(strings.TrimSuffix(container, "/tcp"), "/udp")
+	if !validPort(number) {
+		return "", "", fmt.Errorf("invalid port %q, expected CONTAINER or HOST:CONTAINER", port)
+	}
+	return host, container, nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535 && strconv.Itoa(n) == port
+}
+
+// StrategySpec fans a job out over a matrix of values
+type StrategySpec struct {
+	Matrix      MatrixSpec `yaml:"matrix"`
+	FailFast    *bool      `yaml:"fail-fast,omitempty"`    // cancel the other combinations when one fails, default true
+	MaxParallel int        `yaml:"max-parallel,omitempty"` // 0 means no limit
+}
+
+// MatrixSpec lists the values of each matrix dimension. The job runs once
+// for every combination, minus the combinations matching an exclude entry,
+// plus the include entries.
+type MatrixSpec struct {
+	Dimensions map[string][]interface{}  `yaml:",inline"`
+	Include    []map[string]interface{} `yaml:"include,omitempty"`
+	Exclude    []map[string]interface{} `yaml:"exclude,omitempty"`
+}
+
+// FailsFast reports whether the other combinations are cancelled when one fails
+func (s *StrategySpec) FailsFast() bool {
+	return s.FailFast == nil || *s.FailFast
+}
+
+// Labels is a list of runner labels. In YAML it may be written either as a
+// single label or as a list of labels.
+type Labels []string
+
+// UnmarshalYAML accepts both `runs-on: docker` and `runs-on: [linux, docker]`
+func (l *Labels) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = Labels{value.Value}
+		return nil
+	}
+
+	var labels []string
+	if err := value.Decode(&labels); err != nil {
+		return err
+	}
+	*l = labels
+	return nil
+}
+
+// Required returns the trimmed, de-duplicated labels a runner must carry.
+// The any wildcard is dropped, so `runs-on: any` requires no labels at all.
+func (l Labels) Required() []string {
+	required := []string{}
+	seen := make(map[string]bool)
+	for _, label := range l {
+		label = strings.TrimSpace(label)
+		if label == "" || label == AnyLabel || seen[label] {
+			continue
+		}
+		seen[label] = true
+		required = append(required, label)
+	}
+	return required
 }
 
 // StepSpec represents a step in a job
 type StepSpec struct {
+	ID        string            `yaml:"id,omitempty"`
 	Name      string            `yaml:"name,omitempty"`
 	Uses      string            `yaml:"uses,omitempty"`
 	Run       string            `yaml:"run,omitempty"`
@@ -32,23 +218,48 @@ type StepSpec struct {
 	WorkingDir string           `yaml:"working-directory,omitempty"`
 }
 
+// Diagnostic describes a problem found while validating a workflow file.
+// Line and Column are 1-based positions in the YAML source.
+type Diagnostic struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path,omitempty"` // e.g. jobs.build.steps[0].run
+	Message string `json:"message"`
+}
+
 // RunRequest represents a request to start a workflow run
 type RunRequest struct {
 	WorkflowID uint              `json:"workflow_id"`
-	Inputs     map[string]string `json:"inputs,omitempty"`
+	Inputs     map[string]interface{} `json:"inputs,omitempty"`
 	Ref        string            `json:"ref,omitempty"`
 }
 
 // LogEntry represents a log entry for streaming
 type LogEntry struct {
+	ID        uint   `json:"id"` // increases with every stored entry; clients resume after it
 	RunID     uint   `json:"run_id"`
 	JobID     uint   `json:"job_id"`
 	StepID    uint   `json:"step_id"`
+	Sequence  int64  `json:"sequence,omitempty"`
+	Stream    string `json:"stream,omitempty"`
 	Content   string `json:"content"`
 	Level     string `json:"level"`
 	Timestamp string `json:"timestamp"`
 }
 
+// LogLine is a line of step output streamed by a runner while the step runs
+type LogLine struct {
+	Sequence  int64  `json:"sequence"` // numbers the lines of a step attempt from 1
+	Stream    string `json:"stream"`   // stdout or stderr
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+}
+
+// LogChunk is a batch of streamed log lines for a step
+type LogChunk struct {
+	Lines []LogLine `json:"lines" binding:"required"`
+}
+
 // RunnerRegistration represents runner registration request
 type RunnerRegistration struct {
 	Name    string   `json:"name"`
@@ -56,12 +267,41 @@ type RunnerRegistration struct {
 	Tags    []string `json:"tags"`
 }
 
+// RunnerCredentials represents the identity a runner receives on registration
+type RunnerCredentials struct {
+	RunnerID string `json:"runner_id"`
+	Secret   string `json:"secret"`
+}
+
+// RunnerHeartbeat represents the periodic liveness report of a runner
+type RunnerHeartbeat struct {
+	ActiveJobs []uint `json:"active_jobs"`
+}
+
+// HeartbeatResponse represents the server's answer to a runner heartbeat
+type HeartbeatResponse struct {
+	Status string `json:"status"`
+	Cancel []uint `json:"cancel,omitempty"` // active jobs the runner should cancel
+}
+
 // JobAssignment represents a job assignment to a runner
 type JobAssignment struct {
-	JobID    uint         `json:"job_id"`
-	RunID    uint         `json:"run_id"`
-	JobSpec  JobSpec      `json:"job_spec"`
-	Workflow WorkflowSpec `json:"workflow"`
+	JobID          uint         `json:"job_id"`
+	RunID          uint         `json:"run_id"`
+	JobSpec        JobSpec      `json:"job_spec"`
+	Workflow       WorkflowSpec `json:"workflow"`
+	StepIDs        []uint       `json:"step_ids"` // in the same order as JobSpec.Steps
+	LeaseExpiresAt string       `json:"lease_expires_at"`
+	// Contexts are the expression contexts (run, inputs, env, needs) for step
+	// conditions and interpolation
+	Contexts map[string]interface{} `json:"contexts"`
+}
+
+// JobLease represents a renewed lease on an assigned job
+type JobLease struct {
+	JobID          uint   `json:"job_id"`
+	LeaseExpiresAt string `json:"lease_expires_at"`
+	Cancelled      bool   `json:"cancelled,omitempty"` // the job's run was cancelled
 }
 
 // JobResult represents the result of job execution
@@ -69,6 +309,7 @@ type JobResult struct {
 	JobID     uint   `json:"job_id"`
 	Status    string `json:"status"`
 	Error     string `json:"error,omitempty"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
 	StartedAt string `json:"started_at,omitempty"`
 	FinishedAt string `json:"finished_at,omitempty"`
 }
@@ -77,9 +318,12 @@ type JobResult struct {
 type StepResult struct {
 	StepID     uint   `json:"step_id"`
 	Status     string `json:"status"`
+	Outcome    string `json:"outcome,omitempty"`    // what happened, defaults to Status
+	Conclusion string `json:"conclusion,omitempty"` // what counts for the job, defaults to Outcome
 	ExitCode   int    `json:"exit_code"`
 	Output     string `json:"output"`
 	Error      string `json:"error,omitempty"`
+	Outputs    map[string]string `json:"outputs,omitempty"` // values written to $RELAYFORGE_OUTPUT
 	StartedAt  string `json:"started_at,omitempty"`
 	FinishedAt string `json:"finished_at,omitempty"`
 }
\ No newline at end of file
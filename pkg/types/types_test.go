@@ -0,0 +1,51 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		want     Labels
+		required []string
+	}{
+		{name: "single label", yaml: "runs-on: docker", want: Labels{"docker"}, required: []string{"docker"}},
+		{name: "list", yaml: "runs-on: [linux, docker]", want: Labels{"linux", "docker"}, required: []string{"linux", "docker"}},
+		{name: "any", yaml: "runs-on: any", want: Labels{"any"}, required: []string{}},
+		{name: "any among labels", yaml: "runs-on: [any, gpu]", want: Labels{"any", "gpu"}, required: []string{"gpu"}},
+		{name: "duplicates and blanks", yaml: `runs-on: [linux, " linux ", "", gpu]`, want: Labels{"linux", " linux ", "", "gpu"}, required: []string{"linux", "gpu"}},
+		{name: "empty list", yaml: "runs-on: []", want: Labels{}, required: []string{}},
+		{name: "missing", yaml: "{}", want: nil, required: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var job struct {
+				RunsOn Labels `yaml:"runs-on"`
+			}
+			if err := yaml.Unmarshal([]byte(test.yaml), &job); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(job.RunsOn, test.want) {
+				t.Errorf("decoded %q, want %q", job.RunsOn, test.want)
+			}
+			if got := job.RunsOn.Required(); !reflect.DeepEqual(got, test.required) {
+				t.Errorf("Required() = %q, want %q", got, test.required)
+			}
+		})
+	}
+}
+
+func TestLabelsInvalid(t *testing.T) {
+	var job struct {
+		RunsOn Labels `yaml:"runs-on"`
+	}
+	if err := yaml.Unmarshal([]byte("runs-on: {os: linux}"), &job); err == nil {
+		t.Errorf("decoded a mapping as labels %q", job.RunsOn)
+	}
+}